@@ -38,7 +38,7 @@ func main() {
 		errChan <- httpServer.ListenAndServe()
 	}()
 
-	signalChan := make(chan os.Signal)
+	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
 	for {
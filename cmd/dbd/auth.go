@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/askcarter/spacerep/lib/db"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// auth issues and checks the bearer tokens that dbd's clients authenticate
+// with.  A token is "payload.signature", both base64 encoded: the payload is
+// the user's email and the Unix time the token expires, and the signature is
+// an HMAC-SHA256 of the payload keyed with dbd's secret.  Tokens can't be
+// forged without the secret, and stay valid across restarts as long as the
+// secret does.
+//
+// Passwords are hashed with bcrypt at cost.  Hashes made at another cost are
+// rehashed the next time their user logs in.
+type auth struct {
+	secret []byte
+	admins map[string]bool
+	ttl    time.Duration
+	cost   int
+}
+
+// newAuth returns an auth signing tokens with secret, which lets the users
+// with the comma separated emails in admins administer dbd.  Without a
+// secret, a random one is made up, and tokens only last until dbd exits.
+func newAuth(secret, admins string, ttl time.Duration, cost int) (*auth, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("auth: bcrypt cost must be from %d to %d.", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	a := &auth{secret: []byte(secret), admins: map[string]bool{}, ttl: ttl, cost: cost}
+	if secret == "" {
+		a.secret = make([]byte, 32)
+		if _, err := rand.Read(a.secret); err != nil {
+			return nil, err
+		}
+		log.Println("No -secret given; tokens won't survive a restart.")
+	}
+	for _, e := range strings.Split(admins, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			a.admins[strings.ToLower(e)] = true
+		}
+	}
+	return a, nil
+}
+
+// isAdmin reports whether the user with the given email is an admin.
+func (a *auth) isAdmin(email string) bool {
+	return a.admins[strings.ToLower(email)]
+}
+
+func (a *auth) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// token returns a token for the user with the given email, which expires
+// after a.ttl.
+func (a *auth) token(email string, now time.Time) (string, time.Time) {
+	exp := now.Add(a.ttl).Truncate(time.Second)
+	payload := strings.ToLower(email) + "\n" + strconv.FormatInt(exp.Unix(), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + a.sign(payload), exp
+}
+
+// errBadToken is returned for every token that can't be used, so that
+// clients learn nothing about why.
+var errBadToken = errors.New("auth: invalid or expired token.")
+
+// verify returns the email of the user tok was issued to.
+func (a *auth) verify(tok string, now time.Time) (string, error) {
+	i := strings.Index(tok, ".")
+	if i < 0 {
+		return "", errBadToken
+	}
+	b, err := base64.RawURLEncoding.DecodeString(tok[:i])
+	if err != nil {
+		return "", errBadToken
+	}
+	payload := string(b)
+	if !hmac.Equal([]byte(a.sign(payload)), []byte(tok[i+1:])) {
+		return "", errBadToken
+	}
+
+	j := strings.LastIndex(payload, "\n")
+	if j < 0 {
+		return "", errBadToken
+	}
+	exp, err := strconv.ParseInt(payload[j+1:], 10, 64)
+	if err != nil || now.Unix() >= exp {
+		return "", errBadToken
+	}
+	return payload[:j], nil
+}
+
+type ctxKey int
+
+const (
+	userKey ctxKey = iota
+	adminKey
+	roleKey
+	requestIDKey
+)
+
+// userFrom returns the email of the user that made r, as set by
+// appDB.authenticate.
+func userFrom(r *http.Request) string {
+	u, _ := r.Context().Value(userKey).(string)
+	return u
+}
+
+// isAdmin reports whether r was made by an admin, or with an admin API key.
+func isAdmin(r *http.Request) bool {
+	admin, _ := r.Context().Value(adminKey).(bool)
+	return admin
+}
+
+// roleFrom returns the role of the user that made r.
+func roleFrom(r *http.Request) string {
+	role, _ := r.Context().Value(roleKey).(string)
+	return role
+}
+
+// authenticate authenticates requests with an "Authorization: Bearer <token>"
+// header, where the token is either from /login or an API key, before passing
+// them on to h.  Requests without a valid token, or from users that no longer
+// exist, are turned away, as are requests that read-only API keys can't make.
+//
+// Users named by -admins and users with the admin role are admins, as are
+// admin API keys.
+func (a *appDB) authenticate(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		var u, role string
+		var admin bool
+		var err error
+		isKey := strings.HasPrefix(tok, keyPrefix)
+		if isKey {
+			var k db.APIKey
+			k, err = a.ds.APIKey(hashKey(tok))
+			if err == db.ErrNotFound {
+				err = errBadToken
+			}
+			if err == nil && k.Scope == db.ScopeRead && r.Method != "GET" {
+				writeError(w, r, http.StatusForbidden,
+					fmt.Errorf("auth: read-only key %d can't %s %s.", k.ID, r.Method, r.URL.Path))
+				return
+			}
+			u, admin = k.Owner, k.Scope == db.ScopeAdmin
+		} else {
+			u, err = a.auth.verify(tok, time.Now())
+		}
+		if err == nil {
+			role, err = a.ds.Role(u)
+			if err == db.ErrNotFound {
+				err = errBadToken
+			}
+			if !isKey {
+				admin = a.auth.isAdmin(u) || role == db.RoleAdmin
+			}
+		}
+		if err == errBadToken {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dbd"`)
+			writeError(w, r, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userKey, u)
+		ctx = context.WithValue(ctx, adminKey, admin)
+		ctx = context.WithValue(ctx, roleKey, role)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// dummyHash is compared against when logging in as an unknown user, so that
+// unknown users take as long to turn away as wrong passwords do.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+
+// login checks the email and password it's given, as
+// {"email": "user1@test.com", "password": "secret"}, against the user's
+// stored bcrypt hash, and replies with a token for them.
+func (a *appDB) login(w http.ResponseWriter, r *http.Request) (int, error) {
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := decode(r, &req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	email := strings.ToLower(req.Email)
+	if email == "" {
+		return http.StatusBadRequest, errors.New("appDB.login(): Invalid email.")
+	}
+
+	hash, found := dummyHash, true
+	h, err := a.ds.Credentials(email)
+	switch {
+	case err == db.ErrNotFound:
+		found = false
+	case err != nil:
+		return http.StatusInternalServerError, err
+	default:
+		hash = []byte(h)
+	}
+	err = bcrypt.CompareHashAndPassword(hash, []byte(req.Password))
+	if err != nil || !found {
+		return http.StatusUnauthorized, fmt.Errorf("appDB.login(): Bad login for %q.", email)
+	}
+
+	// Now's the only time the password is known, so it's when hashes made
+	// at an old cost can be brought up to date.
+	if cost, err := bcrypt.Cost(hash); err == nil && cost != a.auth.cost {
+		if err := a.setPassword(email, req.Password); err != nil {
+			log.Printf("appDB.login(): Can't rehash %q's password: %v", email, err)
+		}
+	}
+
+	tok, exp := a.auth.token(email, time.Now())
+	resp := struct {
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}{tok, exp}
+	b, err := json.MarshalIndent(resp, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Write(b)
+
+	return http.StatusOK, nil
+}
+
+// Passwords must be from minPassword to maxPassword bytes long.  bcrypt
+// ignores everything past the first 72 bytes.
+const (
+	minPassword = 8
+	maxPassword = 72
+)
+
+// checkPassword returns an error if p can't be the password of the user with
+// the given email.
+func checkPassword(email, p string) error {
+	if _, err := bcrypt.Cost([]byte(p)); err == nil {
+		return errors.New("auth: password is already hashed; send the password itself.")
+	}
+	if len(p) < minPassword {
+		return fmt.Errorf("auth: password must be at least %d characters.", minPassword)
+	}
+	if len(p) > maxPassword {
+		return fmt.Errorf("auth: password must be at most %d bytes.", maxPassword)
+	}
+	if strings.EqualFold(p, email) || strings.TrimLeft(p, p[:1]) == "" {
+		return errors.New("auth: password is too easy to guess.")
+	}
+	return nil
+}
+
+// setPassword hashes p and makes it the password of the user with the given
+// email.
+func (a *appDB) setPassword(email, p string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(p), a.auth.cost)
+	if err != nil {
+		return err
+	}
+	return a.ds.SetCredentials(email, string(hash))
+}
+
+// signup creates a user from the email, name and password it's given, as
+// {"email": "user1@test.com", "name": "User1", "password": "secret"}.
+func (a *appDB) signup(w http.ResponseWriter, r *http.Request) (int, error) {
+	var req struct {
+		Email    string `json:"email"`
+		Name     string `json:"name"`
+		Password string `json:"password"`
+	}
+	if err := decode(r, &req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	email := strings.ToLower(req.Email)
+	if err := validate(r, db.UserList{{Email: email, Name: req.Name}}); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if strings.ContainsAny(email, ":*") {
+		return http.StatusBadRequest, errors.New("appDB.signup(): Invalid email.")
+	}
+	if err := checkPassword(email, req.Password); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), a.auth.cost)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	u := db.User{Email: email, Name: req.Name, Password: string(hash)}
+	if err := a.ds.CreateUser(u); err != nil {
+		return errStatus(err), err
+	}
+
+	fmt.Fprintf(w, `{"message": "signed up"}`)
+
+	return http.StatusOK, nil
+}
+
+// password changes a password, given as
+// {"old_password": "secret", "password": "new secret"}.  Admins can change
+// anyone's password without knowing it, by adding their "email".
+func (a *appDB) password(w http.ResponseWriter, r *http.Request) (int, error) {
+	var req struct {
+		Email       string `json:"email"`
+		OldPassword string `json:"old_password"`
+		Password    string `json:"password"`
+	}
+	if err := decode(r, &req); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	u := userFrom(r)
+	email := u
+	if req.Email != "" && !strings.EqualFold(req.Email, u) {
+		if !isAdmin(r) {
+			return http.StatusForbidden, errors.New("appDB.password(): Only admins can change others' passwords.")
+		}
+		email = strings.ToLower(req.Email)
+	} else {
+		hash, err := a.ds.Credentials(email)
+		if err != nil && err != db.ErrNotFound {
+			return http.StatusInternalServerError, err
+		}
+		if err != nil || bcrypt.CompareHashAndPassword([]byte(hash), []byte(req.OldPassword)) != nil {
+			return http.StatusUnauthorized, fmt.Errorf("appDB.password(): Bad old password for %q.", email)
+		}
+	}
+	if err := checkPassword(email, req.Password); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	err := a.setPassword(email, req.Password)
+	if err != nil {
+		return errStatus(err), err
+	}
+
+	fmt.Fprintf(w, `{"message": "password changed"}`)
+
+	return http.StatusOK, nil
+}
@@ -2,61 +2,248 @@
 dbd is a simple database server.  It registers an endpoint that
 can be used to retrieve data to/from it's database.
 
+Every endpoint but /login needs a bearer token, which /login hands out for
+a user's email and password.  Tokens are signed with -secret (or
+$DBD_SECRET) and last for -token-ttl.
+
+New users sign up with their email, name and password:
+
+    $ curl -X POST -d '{"email": "user3@test.com", "name": "User3", "password": "correct horse"}' "http://127.0.0.1:55555/signup"
+
+and can change their password by posting {"old_password", "password"} to
+/password.  Passwords must be 8 to 72 bytes long, and are hashed with bcrypt
+at -bcrypt-cost; a user's hash is redone at the new cost when they next log in
+after it changes.  Passwords can't be set with /store.
+
+Services use API keys instead of logging in.  Admins mint them for a user,
+with a scope of "read" (list only), "write" (list, store and review) or
+"admin" (anything an admin can do):
+
+    $ curl -X POST -H "Authorization: Bearer $TOKEN" -d '{"owner": "user1@test.com", "name": "app", "scope": "read"}' "http://127.0.0.1:55555/keys"
+
+The reply holds the key, which starts with "sk_" and is never shown again;
+dbd only keeps its hash.  Keys are sent just like tokens, listed with GET
+/keys and revoked with DELETE /keys/{id}.  Users can list their own keys, but
+only admins can list everyone's.
+
+Users can only list, store into and review their own decks and cards, and
+the decks shared with them.  Admins -- the users listed in -admins, and users
+with the "admin" role -- can list and store into anyone's, and are the only
+ones who can list or store users, or init the database.  Other users are
+"editor"s, who can make decks of their own, or "learner"s, who can only list
+and review; admins set a user's "role" with /store?type=users.
+
+Deck owners share a deck with another user, or with a group of users, to
+"read" (list and review) or to "edit" (also store cards into):
+
+    $ curl -X POST -H "Authorization: Bearer $TOKEN" -d '[{"name": "class", "owner": "user1@test.com", "members": ["user2@test.com"]}]' "http://127.0.0.1:55555/store?type=groups"
+    $ curl -X POST -H "Authorization: Bearer $TOKEN" -d '[{"deck_id": 1, "group": "class", "access": "read"}]' "http://127.0.0.1:55555/store?type=shares"
+
+Decks and cards can also be reached as resources, by the same rules:
+
+    PUT, DELETE      /users/{email}
+    GET, POST        /users/{email}/decks
+    GET, PUT, DELETE /decks/{id}
+    GET, POST        /decks/{id}/cards
+    GET, PUT, DELETE /cards/{id}
+
+POST takes a single deck or card, and replies 201 Created with it and its
+Location.  PUT changes a user's name (and, for admins, role), a deck's name,
+description or scheduler, or a card's front, back, tags or deck, leaving its
+schedule alone, and replies with the result.  DELETE replies 204 No Content;
+deleting a user or deck deletes everything in it.  Only admins can delete
+users.  /list and /store keep working, and cards stored there with an "id"
+replace that card.
+
+Shared decks are listed with the "access" their user has.  type=groups lists
+the groups a user owns or is in, and type=shares the shares of their decks.
+Owners stop sharing a deck with DELETE /decks/{id}/shares?user={email} or
+?group={name}, and delete a group, and the shares made to it, with DELETE
+/groups/{name}.
+
+Errors are replied to with a JSON body:
+
+    {
+        "code": "conflict",
+        "message": "db.Store(): group \"class\" belongs to someone else.",
+        "request_id": "5fdaa37b1bb159ed"
+    }
+
+code is the status in snake case: "bad_request" for input that doesn't make
+sense, "not_found" for things that don't exist, "conflict" for things that
+would clash with ones that do, and so on.  Server errors only say
+"Internal Server Error"; the rest is in dbd's log, under the request ID.
+Every reply carries its request ID in an X-Request-ID header, which is the
+request's own X-Request-ID if it sent a sane one.
+
+Users, decks and cards are checked before anything is stored: emails must be
+addresses, names, fronts and backs can't be empty or too long, decks must be
+the caller's own (unless they're an admin) and use a scheduler that exists,
+and fields dbd doesn't know are refused.  If anything in a batch is wrong,
+none of it is stored, and "errors" lists every bad field by its index in the
+batch:
+
+    "errors": [
+        {"index": 2, "field": "back", "message": "is required"}
+    ]
+
 For example
-    $ go build && ./dbd --http :55555 &
-    $ curl "http://127.0.0.1:55555/list?type=cards&user=user1@test.com&q=*"
+    $ go build && ./dbd --http :55555 -secret "$(head -c 32 /dev/urandom | base64)" &
+    $ curl -X POST -d '{"email": "user1@test.com", "password": "password"}' "http://127.0.0.1:55555/login"
+    {
+        "token": "dXNlcjFAdGVzdC5jb20KMTQ2NTUwMzg4Nw.5Vq3...",
+        "expires": "2016-06-09T20:24:47Z"
+    }
+
+    $ TOKEN=dXNlcjFAdGVzdC5jb20KMTQ2NTUwMzg4Nw.5Vq3...
+    $ curl -H "Authorization: Bearer $TOKEN" "http://127.0.0.1:55555/list?type=cards&q=*"
     [
         {
             "id": 8,
+            "deck_id": 2,
             "owner": "user2@test.com:algebra",
             "front": "x+x",
             "back": "2x"
         },
         {
             "id": 9,
+            "deck_id": 3,
             "owner": "user2@test.com:programming",
             "front": "favorite programming language",
             "back": "Go"
         },
         {
             "id": 10,
+            "deck_id": 3,
             "owner": "user2@test.com:programming",
             "front": "public interface",
             "back": "API"
         }
     ]
 
-    $ curl "http://127.0.0.1:55555/list?type=decks&user=admin&q=*"
+    $ curl -H "Authorization: Bearer $TOKEN" "http://127.0.0.1:55555/list?type=cards&due=now&limit=20"
+
+Adding due=now (or an RFC 3339 time) lists only the user's cards that are due
+by then, soonest first.
+
+Cards can be stored with "tags", such as ["verbs", "a1"], and lists of cards,
+/decks/{id}/cards and /search narrow what they find with a filter:
+
+    $ curl -G -H "Authorization: Bearer $TOKEN" "http://127.0.0.1:55555/list?type=cards&q=*" --data-urlencode 'filter=deck = "user1@test.com:spanish" AND tag = verbs AND due < now+7d'
+
+A filter compares fields of a card -- deck, front, back, tag, due, created,
+reps, interval, box and ease -- with =, !=, <, <=, >, >= or ~ (contains,
+ignoring case), and combines comparisons with AND, OR, NOT and parentheses.
+Times can be RFC 3339 times, dates, or now or today moved by hours, days or
+weeks, as in now-12h or today+2w.  A filter that doesn't make sense is a bad
+request, which says what's wrong with it.
+
+Lists come a page at a time: limit sets how many results are in a page, up to
+and by default 1000.  When there may be more, the reply has a Link header
+for the next page, which carries the same query with an opaque cursor added:
+
+    Link: </list?cursor=WyJ1c2VyMUB0ZXN0LmNvbSIsInNwYW5pc2giLDJd&limit=2&q=%2A&type=cards>; rel="next"
+
+The last page has no Link.  /users/{email}/decks and /decks/{id}/cards are
+paged the same way.
+
+Bulk consumers can instead ask for a whole list as newline-delimited JSON,
+which dbd streams as it reads it rather than a page at a time:
+
+    $ curl -H "Authorization: Bearer $TOKEN" -H "Accept: application/x-ndjson" "http://127.0.0.1:55555/list?type=cards&q=*"
+    {"id":8,"deck_id":2,"owner":"user2@test.com:algebra","front":"x+x","back":"2x",...}
+    {"id":9,"deck_id":3,"owner":"user2@test.com:programming","front":"favorite programming language","back":"Go",...}
+
+limit and cursor still say where a stream ends and starts.  Should something
+go wrong once a stream has started, its last line is an error body (see
+above) instead of a result.
+
+/search finds cards by the words on their front or back, ignoring case, among
+the cards the user can list.  Cards with every word in q are found, best
+match first, with a snippet of the words around the match; deck narrows the
+search with an 'email:deck' pattern like list's q:
+
+    $ curl -H "Authorization: Bearer $TOKEN" "http://127.0.0.1:55555/search?q=interface&deck=user2@test.com:*"
+    [
+        {
+            "id": 10,
+            "deck_id": 3,
+            "owner": "user2@test.com:programming",
+            "front": "public interface",
+            "back": "API",
+            ...
+            "rank": 1.5,
+            "snippet": "public **interface**"
+        }
+    ]
+
+Searches take a limit and a filter, and can be streamed, but aren't paged.
+
+    $ curl -H "Authorization: Bearer $TOKEN" "http://127.0.0.1:55555/list?type=decks&q=*"
     [
         {
-            "name": "user1@test.com.com:spanish"
+            "id": 1,
+            "owner": "user1@test.com",
+            "name": "spanish"
         },
         {
-            "name": "user2@test.com:algebra"
+            "id": 2,
+            "owner": "user2@test.com",
+            "name": "algebra"
         },
         {
-            "name": "user2@test.com:programming"
+            "id": 3,
+            "owner": "user2@test.com",
+            "name": "programming"
         }
     ]
 
-    $ curl "http://127.0.0.1:55555/list?type=users&user=admin&q=*"
+    $ curl -H "Authorization: Bearer $TOKEN" "http://127.0.0.1:55555/list?type=users&q=*"
     [
         {
             "email": "user1@test.com.com",
-            "name": "User1",
-            "password": "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"
+            "name": "User1"
         },
         {
             "email": "user2@test.com",
-            "name": "User2",
-            "password": "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"
+            "name": "User2"
         }
     ]
 
+Users are listed without their password hashes.
+
     $  curl -X POST -H "Content-Type: application/json" -d '[{"owner": "user2@test.com:numbers", "front": "x+x", "back": "2x"}]
 
+    $ curl -X POST -H "Authorization: Bearer $TOKEN" -d '{"id": 8, "grade": "good"}' "http://127.0.0.1:55555/review"
+    {
+        "id": 8,
+        "due": "2016-06-09T20:24:47Z"
+    }
+
+Review grades an answer to a card (0-5, or one of again/hard/good/easy) and
+reschedules the card using its deck's scheduler.  The grade is required; a
+review without one is a bad request.  Decks use SM-2 unless
+stored with "scheduler" set to "fsrs" or "leitner", optionally tuned with
+"params", e.g.
+
+    [{"name": "user2@test.com:algebra", "scheduler": "fsrs", "params": {"retention": 0.85}}]
+    [{"name": "user2@test.com:spanish", "scheduler": "leitner", "params": {"intervals": [1, 3, 7], "demote": "down"}}]
+
+Cards in Leitner decks are listed with the "box" they're in.
+
+Every answer is kept in a review log, which
+can be listed with type=reviews and q matching the reviewer's email.
+
+dbd brings its database's schema up to date when it starts.  Run
+"dbd migrate" to do so without serving, or "dbd migrate status" to see the
+schema version and any pending migrations.  With -mem, dbd keeps its data in
+memory instead, and forgets it when it exits.
+
 The database operates on Card, Deck, and User types.  Users own Decks which are
-made up of Cards.
+made up of Cards.  Decks are stored with an "owner" email and cards with a
+"deck_id", though the older 'email:deck' form is still accepted as a deck's
+"name" or a card's "owner".  A deck's owner has to exist before the deck can be
+stored, and a deck before its cards.
 
 */
 package main
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/askcarter/spacerep/lib/db"
+)
+
+// errStatus returns the HTTP status for an error from the DataSource: 404
+// for things that don't exist, 409 for things that clash with what does, 400
+// for bad input, and 500 for everything else.
+func errStatus(err error) int {
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, db.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, db.ErrInvalid):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// apiError is the body of every error reply.  Code is the status text in
+// snake case, e.g. "not_found", so that clients needn't parse Message.
+//
+// Errors lists every invalid field of a payload that failed validation.
+type apiError struct {
+	Code      string       `json:"code"`
+	Message   string       `json:"message"`
+	RequestID string       `json:"request_id"`
+	Errors    []fieldError `json:"errors,omitempty"`
+}
+
+// errorCode returns the code of errors with the given status.
+func errorCode(status int) string {
+	return strings.ToLower(strings.ReplaceAll(http.StatusText(status), " ", "_"))
+}
+
+// writeError logs err and replies to r with status and an apiError.  Server
+// errors are only described by their status text, since err may say more
+// about dbd's insides than clients should know.
+func writeError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	id := requestIDFrom(r)
+	if err != nil {
+		log.Printf("[%s] %v", id, err)
+	}
+	msg := http.StatusText(status)
+	if err != nil && status < 500 {
+		msg = err.Error()
+	}
+	e := apiError{
+		Code:      errorCode(status),
+		Message:   msg,
+		RequestID: id,
+	}
+	var invalid invalidError
+	if errors.As(err, &invalid) {
+		e.Message = "Invalid payload; see errors."
+		e.Errors = invalid
+	}
+	b, _ := json.MarshalIndent(e, "", "\t")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// notFound and methodNotAllowed reply to requests that don't match any of
+// dbd's routes.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, errors.New("dbd: No such route."))
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, errors.New("dbd: Method not allowed."))
+}
+
+// maxRequestID is the longest X-Request-ID header that's passed through.
+const maxRequestID = 64
+
+// withRequestID gives every request an ID, which is echoed in the
+// X-Request-ID header of the reply and in error bodies and logs.  Requests
+// that come with a sane X-Request-ID, e.g. from a proxy, keep it; the rest
+// get a random one.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !saneRequestID(id) {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// saneRequestID reports whether id is short and only uses letters, digits,
+// '-', '_' and '.', so that it's safe to log and echo.
+func saneRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDFrom returns the ID withRequestID gave r.
+func requestIDFrom(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
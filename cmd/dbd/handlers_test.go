@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/askcarter/spacerep/lib/db"
 	"github.com/askcarter/test"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var tests = []struct {
@@ -17,58 +22,526 @@ var tests = []struct {
 	method, path, data string
 	expect             string
 	status             int
+
+	// user, if set, is who the request is made as.  Requests without one
+	// aren't authenticated.
+	user string
+	// key, if set, is the API key the request is made with.
+	key string
+
+	// body, if set, is expected to appear in the response.
+	body string
 }{
+	// Login handler tests.
+
+	{path: "/login", method: "POST",
+		data:   `{"email": "User1@test.com", "password": "password"}`,
+		expect: "credentials user1@test.com\nsetcredentials user1@test.com",
+		status: http.StatusOK,
+		body:   `"token": `,
+		desc:   "login works as intended.",
+	},
+	{path: "/login", method: "POST",
+		data:   `{"email": "user1@test.com", "password": "wrong"}`,
+		expect: "credentials user1@test.com",
+		status: http.StatusUnauthorized,
+		desc:   "login with the wrong password errors out.",
+	},
+	{path: "/login", method: "POST",
+		data:   `{"email": "nobody@test.com", "password": "dummy"}`,
+		expect: "credentials nobody@test.com",
+		status: http.StatusUnauthorized,
+		desc:   "login as an unknown user errors out.",
+	},
+	{path: "/login", method: "POST",
+		data:   `{"email": "user1@test.com"`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "login with a bad body errors out.",
+	},
+	{path: "/login", method: "POST",
+		data:   `{"email": "user1@test.com", "pasword": "password"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "login with an unknown field errors out.",
+	},
+
+	// Signup and password handler tests.
+
+	{path: "/signup", method: "POST",
+		data:   `{"email": "New@test.com", "name": "New", "password": "correct horse"}`,
+		expect: "createuser new@test.com New",
+		status: http.StatusOK,
+		desc:   "signup works as intended.",
+	},
+	{path: "/signup", method: "POST",
+		data:   `{"email": "user1@test.com", "name": "Bill", "password": "correct horse"}`,
+		expect: "createuser user1@test.com Bill",
+		status: http.StatusConflict,
+		desc:   "signup as an existing user errors out.",
+	},
+	{path: "/signup", method: "POST",
+		data:   `{"email": "new@test.com", "password": "short"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "signup with a weak password errors out.",
+	},
+	{path: "/signup", method: "POST",
+		data:   `{"email": "new@test.com", "password": "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "signup with a hashed password errors out.",
+	},
+	{path: "/signup", method: "POST",
+		data:   `{"email": "not an email", "name": "New", "password": "correct horse"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		body:   `"field": "email"`,
+		desc:   "signup with an invalid email errors out.",
+	},
+	{path: "/signup", method: "POST",
+		data:   `{"email": "new@test.com", "name": "` + strings.Repeat("x", 5000) + `", "password": "correct horse"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		body:   `"field": "name"`,
+		desc:   "signup with an overlong name errors out.",
+	},
+	{path: "/signup", method: "POST",
+		data:   `{"email": "new@test.com", "password": "correct horse", "role": "admin"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "signup with unknown fields errors out.",
+	},
+	{path: "/password", user: "user1@test.com", method: "POST",
+		data:   `{"old_password": "password", "password": "correct horse"}`,
+		expect: "credentials user1@test.com\nsetcredentials user1@test.com",
+		status: http.StatusOK,
+		desc:   "password works as intended.",
+	},
+	{path: "/password", user: "user1@test.com", method: "POST",
+		data:   `{"old_password": "wrong", "password": "correct horse"}`,
+		expect: "credentials user1@test.com",
+		status: http.StatusUnauthorized,
+		desc:   "password needs the old password.",
+	},
+	{path: "/password", user: "user1@test.com", method: "POST",
+		data:   `{"old_password": "password", "password": "aaaaaaaaaa"}`,
+		expect: "credentials user1@test.com",
+		status: http.StatusBadRequest,
+		desc:   "password rejects weak passwords.",
+	},
+	{path: "/password", user: "user1@test.com", method: "POST",
+		data:   `{"email": "user2@test.com", "password": "correct horse"}`,
+		expect: "",
+		status: http.StatusForbidden,
+		desc:   "password can't change others' passwords.",
+	},
+	{path: "/password", user: "admin@test.com", method: "POST",
+		data:   `{"email": "user2@test.com", "password": "correct horse"}`,
+		expect: "setcredentials user2@test.com",
+		status: http.StatusOK,
+		desc:   "password can change others' passwords for admins.",
+	},
+	{path: "/password", user: "user1@test.com", method: "POST",
+		data:   `{"old_pasword": "password", "password": "correct horse"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "password with an unknown field errors out.",
+	},
+	{path: "/password", method: "POST",
+		data:   `{"old_password": "password", "password": "correct horse"}`,
+		expect: "",
+		status: http.StatusUnauthorized,
+		desc:   "password without a token errors out.",
+	},
+
 	// init Handler Tests.
 
-	{path: "/init?user=admin", method: "POST",
+	{path: "/init", user: "admin@test.com", method: "POST",
 		data:   "",
 		expect: "init called",
 		status: http.StatusOK,
 		desc:   "init handler test.",
 	},
-	{path: "/init?user=not-admin", method: "POST",
+	{path: "/init", user: "user1@test.com", method: "POST",
 		data:   "",
 		expect: "",
-		status: http.StatusUnauthorized,
-		desc:   "init w/o 'user=admin' errors out.",
+		status: http.StatusForbidden,
+		desc:   "init by a non-admin errors out.",
 	},
 	{path: "/init", method: "POST",
 		data:   "",
 		expect: "",
 		status: http.StatusUnauthorized,
-		desc:   "init w/o 'user' param errors out.",
+		desc:   "init without a token errors out.",
 	},
 
 	// List handler tests.
 
-	{path: "/list?type=cards&user=carter&q=programming",
+	{path: "/list?type=cards&q=programming", user: "carter",
 		method: "GET",
 		data:   "",
 		expect: `list called`,
 		status: http.StatusOK,
 		desc:   "list handler passed query as is",
 	},
-	{path: "/list?type=unknown",
+	{path: "/list?type=decks&q=user1@test.com:*", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: `list called`,
+		status: http.StatusOK,
+		body:   `"desc": "Essential Camus quotes."`,
+		desc:   "list handler honors wildcards",
+	},
+	{path: "/list?type=decks&q=user1@test.com:*", user: "carter",
+		method: "GET",
+		data:   "",
+		expect: `list called`,
+		status: http.StatusOK,
+		body:   `null`,
+		desc:   "list handler only lists the user's own decks",
+	},
+	{path: "/list?type=cards&q=*", user: "admin@test.com",
+		method: "GET",
+		data:   "",
+		expect: `list called`,
+		status: http.StatusOK,
+		body:   `"owner": "user2@test.com:deck1"`,
+		desc:   "list handler lists everything for admins",
+	},
+	{path: "/list?type=users&q=*", user: "admin@test.com",
+		method: "GET",
+		data:   "",
+		expect: `list called`,
+		status: http.StatusOK,
+		body:   `"email": "user2@test.com"`,
+		desc:   "list(users) works for admins",
+	},
+	{path: "/list?type=users&q=*", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: "",
+		status: http.StatusForbidden,
+		desc:   "list(users) only works for admins",
+	},
+	{path: "/list?type=cards&due=now&limit=1", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: `list called`,
+		status: http.StatusOK,
+		body:   `"front": "big"`,
+		desc:   "list handler returns due cards",
+	},
+	{path: "/list?type=reviews&q=carter", user: "carter",
+		method: "GET",
+		data:   "",
+		expect: `list called`,
+		status: http.StatusOK,
+		desc:   "list handler returns the review log",
+	},
+	{path: "/list?type=unknown", user: "carter",
 		method: "GET",
 		data:   ``,
 		expect: "",
-		status: http.StatusInternalServerError,
+		status: http.StatusBadRequest,
 		desc:   "list with unknown type errors out.",
 	},
-	{path: "/list?type=decks",
+	{path: "/list?type=decks", user: "carter",
 		method: "GET",
 		data:   ``,
 		expect: "",
-		status: http.StatusInternalServerError,
+		status: http.StatusBadRequest,
 		desc:   "list with no 'q' param will error out.",
 	},
 
+	{path: "/list?type=cards&due=now&limit=20", user: "carter",
+		method: "GET",
+		data:   "",
+		expect: `list called`,
+		status: http.StatusOK,
+		desc:   "list of due cards doesn't need a 'q' param",
+	},
+	{path: "/list?type=cards&q=*&due=tomorrow", user: "carter",
+		method: "GET",
+		data:   "",
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "list with an invalid 'due' param will error out.",
+	},
+	{path: "/list?type=cards&q=*&limit=-1", user: "carter",
+		method: "GET",
+		data:   "",
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "list with an invalid 'limit' param will error out.",
+	},
 	{path: "/list?type=users&q=test",
 		method: "GET",
 		data:   ``,
 		expect: "",
-		status: http.StatusInternalServerError,
-		desc:   "list with no 'user' param will error out.",
+		status: http.StatusUnauthorized,
+		desc:   "list without a token will error out.",
+	},
+	{path: "/list?type=decks&q=*", user: "ghost@test.com",
+		method: "GET",
+		data:   ``,
+		expect: "",
+		status: http.StatusUnauthorized,
+		desc:   "list by a user that no longer exists will error out.",
+	},
+
+	// Role and sharing tests.
+
+	{path: "/list?type=users&q=*", user: "boss@test.com",
+		method: "GET",
+		data:   "",
+		expect: `list called`,
+		status: http.StatusOK,
+		body:   `"role": "learner"`,
+		desc:   "users with the admin role are admins",
+	},
+	{path: "/list?type=decks&q=*", user: "learner@test.com",
+		method: "GET",
+		data:   "",
+		expect: `list called`,
+		status: http.StatusOK,
+		body:   `"access": "read"`,
+		desc:   "list handler lists decks shared through a group",
+	},
+	{path: "/review", user: "learner@test.com",
+		method: "POST",
+		data:   `{"id": 1, "grade": "good"}`,
+		expect: "review 1 learner@test.com 4 0s",
+		status: http.StatusOK,
+		desc:   "learners can review shared cards",
+	},
+	{path: "/store?type=decks", user: "learner@test.com",
+		method: "POST",
+		data:   `[{"owner": "learner@test.com", "name": "mine"}]`,
+		expect: "",
+		status: http.StatusForbidden,
+		desc:   "learners can't store decks",
+	},
+	{path: "/store?type=cards", user: "user1@test.com",
+		method: "POST",
+		data: `[{"deck_id": 1, "front": "", "back": "where"},
+                {"deck_id": 1, "front": "adonde", "back": "where"},
+                {"owner": "nodeck", "front": "adonde", "back": ""}]`,
+		expect: "",
+		status: http.StatusBadRequest,
+		body:   `"index": 2`,
+		desc:   "store(card) reports every invalid card, and stores none",
+	},
+	{path: "/store?type=users", user: "admin@test.com",
+		method: "POST",
+		data:   `[{"email":"email1@gmail.com","name":"One"},{"email":"not an email","name":"Two"}]`,
+		expect: "",
+		status: http.StatusBadRequest,
+		body:   `"field": "email"`,
+		desc:   "store(user) needs an email address",
+	},
+	{path: "/store?type=decks", user: "user1@test.com",
+		method: "POST",
+		data:   `[{"owner": "user1@test.com", "name": "deck3", "colour": "red"}]`,
+		expect: "",
+		status: http.StatusBadRequest,
+		body:   `unknown field`,
+		desc:   "store(deck) refuses unknown fields",
+	},
+	{path: "/store?type=cards", user: "aingau",
+		method: "POST",
+		data:   `[{"deck_id": 3, "front": "adonde", "back": "where"}]`,
+		expect: "list called\n adonde where",
+		status: http.StatusOK,
+		desc:   "store(card) stores into decks shared to edit",
+	},
+	{path: "/store?type=shares", user: "user1@test.com",
+		method: "POST",
+		data:   `[{"deck_id": 2, "user": "user2@test.com", "access": "read"}]`,
+		expect: "list called\nshare 2 user2@test.com  read",
+		status: http.StatusOK,
+		desc:   "store(share) works as intended",
+	},
+	{path: "/store?type=shares", user: "aingau",
+		method: "POST",
+		data:   `[{"deck_id": 1, "user": "aingau", "access": "edit"}]`,
+		expect: "list called",
+		status: http.StatusForbidden,
+		desc:   "store(share) only shares the user's own decks",
+	},
+	{path: "/store?type=groups", user: "user1@test.com",
+		method: "POST",
+		data:   `[{"name": "team", "owner": "user1@test.com", "members": ["user2@test.com"]}]`,
+		expect: "group team user1@test.com",
+		status: http.StatusOK,
+		desc:   "store(group) works as intended",
+	},
+	{path: "/store?type=groups", user: "aingau",
+		method: "POST",
+		data:   `[{"name": "team", "owner": "user1@test.com"}]`,
+		expect: "",
+		status: http.StatusForbidden,
+		desc:   "store(group) only stores the user's own groups",
+	},
+	{path: "/store?type=groups", user: "admin@test.com",
+		method: "POST",
+		data:   `[{"name": "class", "owner": "carter"}]`,
+		expect: "group class carter",
+		status: http.StatusConflict,
+		body:   `"code": "conflict"`,
+		desc:   "store(group) of someone else's group is a conflict",
+	},
+	{path: "/store?type=decks", user: "admin@test.com",
+		method: "POST",
+		data:   `[{"owner": "nobody@test.com", "name": "deck"}]`,
+		expect: "deck",
+		status: http.StatusBadRequest,
+		body:   `"code": "bad_request"`,
+		desc:   "store(deck) for an unknown owner is a bad request",
+	},
+	{path: "/list?type=shares&q=*", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: `list called`,
+		status: http.StatusOK,
+		body:   `"group": "class"`,
+		desc:   "list handler lists the shares of the user's decks",
+	},
+
+	// API key tests.
+
+	{path: "/list?type=decks&q=*", key: "sk_read",
+		method: "GET",
+		data:   "",
+		expect: "apikey\nlist called",
+		status: http.StatusOK,
+		body:   `"desc": "Essential Camus quotes."`,
+		desc:   "API keys act as their owner",
+	},
+	{path: "/review", key: "sk_read",
+		method: "POST",
+		data:   `{"id": 3, "grade": "good"}`,
+		expect: "apikey",
+		status: http.StatusForbidden,
+		desc:   "read-only API keys can't review",
+	},
+	{path: "/review", key: "sk_write",
+		method: "POST",
+		data:   `{"id": 3, "grade": "good"}`,
+		expect: "apikey\nreview 3 user1@test.com 4 0s",
+		status: http.StatusOK,
+		desc:   "write API keys can review",
+	},
+	{path: "/list?type=users&q=*", key: "sk_write",
+		method: "GET",
+		data:   "",
+		expect: "apikey",
+		status: http.StatusForbidden,
+		desc:   "write API keys can't administer",
+	},
+	{path: "/list?type=users&q=*", key: "sk_admin",
+		method: "GET",
+		data:   "",
+		expect: "apikey\nlist called",
+		status: http.StatusOK,
+		body:   `"email": "user1@test.com"`,
+		desc:   "admin API keys can administer",
+	},
+	{path: "/list?type=decks&q=*", key: "sk_unknown",
+		method: "GET",
+		data:   "",
+		expect: "apikey",
+		status: http.StatusUnauthorized,
+		desc:   "unknown API keys are turned away",
+	},
+	{path: "/keys", user: "admin@test.com",
+		method: "POST",
+		data:   `{"owner": "User1@test.com", "name": "app", "scope": "read"}`,
+		expect: "credentials User1@test.com\napikey",
+		status: http.StatusOK,
+		body:   `"key": "sk_`,
+		desc:   "keys can be minted by admins",
+	},
+	{path: "/keys", user: "user1@test.com",
+		method: "POST",
+		data:   `{"name": "app", "scope": "read"}`,
+		expect: "",
+		status: http.StatusForbidden,
+		desc:   "keys can only be minted by admins",
+	},
+	{path: "/keys", user: "admin@test.com",
+		method: "POST",
+		data:   `{"owner": "user1@test.com", "name": "app", "scope": "root"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "keys need a valid scope",
+	},
+	{path: "/keys", user: "admin@test.com",
+		method: "POST",
+		data:   `{"owner": "user1@test.com", "name": "app", "scop": "read"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "keys with an unknown field error out",
+	},
+	{path: "/keys", user: "admin@test.com",
+		method: "POST",
+		data:   `{"owner": "nobody@test.com", "name": "app", "scope": "read"}`,
+		expect: "credentials nobody@test.com",
+		status: http.StatusBadRequest,
+		desc:   "keys need an existing owner",
+	},
+	{path: "/keys", user: "admin@test.com",
+		method: "GET",
+		data:   "",
+		expect: "list called",
+		status: http.StatusOK,
+		body:   `"scope": "admin"`,
+		desc:   "keys can be listed by admins",
+	},
+	{path: "/keys", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: "list called",
+		status: http.StatusOK,
+		body:   `"scope": "write"`,
+		desc:   "keys can be listed by their owners",
+	},
+	{path: "/keys?q=user2@test.com", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: "list called",
+		status: http.StatusOK,
+		body:   `null`,
+		desc:   "keys of other users aren't listed",
+	},
+	{path: "/list?type=keys&q=*", user: "admin@test.com",
+		method: "GET",
+		data:   "",
+		expect: "list called",
+		status: http.StatusOK,
+		body:   `"scope": "admin"`,
+		desc:   "list(keys) replies with the keys",
+	},
+	{path: "/keys/1", user: "admin@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "revoke 1",
+		status: http.StatusOK,
+		desc:   "keys can be revoked by admins",
+	},
+	{path: "/keys/99", user: "admin@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "revoke 99",
+		status: http.StatusNotFound,
+		desc:   "revoking a missing key is not found",
+	},
+	{path: "/keys/1", user: "user1@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "",
+		status: http.StatusForbidden,
+		desc:   "keys can only be revoked by admins",
 	},
 
 	// Store handler tests.
@@ -77,35 +550,42 @@ var tests = []struct {
 		method: "POST",
 		data:   ``,
 		expect: "",
-		status: http.StatusInternalServerError,
-		desc:   "store with no user param will error out.",
+		status: http.StatusUnauthorized,
+		desc:   "store without a token will error out.",
 	},
-	{path: "/store?type=unknown&user=carter",
+	{path: "/store?type=unknown", user: "carter",
 		method: "POST",
 		data:   ``,
 		expect: "",
-		status: http.StatusInternalServerError,
+		status: http.StatusBadRequest,
 		desc:   "store with invalid type param will error out.",
 	},
 
-	{path: "/store?type=users&user=admin",
+	{path: "/store?type=users", user: "admin@test.com",
 		method: "POST",
-		data: `[{"email":"email1@gmail.com","name":"One","password":"$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"},
-                {"email":"email2@gmail.com","name":"Two","password":"$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"}]`,
+		data: `[{"email":"email1@gmail.com","name":"One"},
+                {"email":"email2@gmail.com","name":"Two"}]`,
 		expect: "email1@gmail.com One\nemail2@gmail.com Two",
 		status: http.StatusOK,
 		desc:   "store(user) works as intended.",
 	},
-	{path: "/store?type=users&user=carter",
+	{path: "/store?type=users", user: "admin@test.com",
+		method: "POST",
+		data:   `[{"email":"email1@gmail.com","name":"One","password":"$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"}]`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "store(user) won't store passwords",
+	},
+	{path: "/store?type=users", user: "carter",
 		method: "POST",
 		data: `[{"email":"email1@gmail.com","name":"One","password":"$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"},
                 {"email":"email2@gmail.com","name":"Two","password":"$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"}]`,
 		expect: "",
-		status: http.StatusUnauthorized,
+		status: http.StatusForbidden,
 		desc:   "store(user) only works for the admin",
 	},
 
-	{path: "/store?type=decks&user=aingau",
+	{path: "/store?type=decks", user: "aingau",
 		method: "POST",
 		data:   `[{"name":"aingau:geometry", "desc": "Math learnings."},{"name":"aingau:cooking", "desc": "Favorite recipes!"}]`,
 		expect: "aingau:geometry Math learnings.\naingau:cooking Favorite recipes!",
@@ -113,20 +593,439 @@ var tests = []struct {
 		desc:   "store(deck) works as intended",
 	},
 
-	{path: "/store?type=cards&user=aingau",
+	{path: "/store?type=cards", user: "aingau",
 		method: "POST",
 		data:   `[{"owner": "aingau:spanish", "front": "adonde", "back": "where"}]`,
-		expect: "aingau:spanish adonde where",
+		expect: "list called\naingau:spanish adonde where",
 		status: http.StatusOK,
 		desc:   "store(card) works as expected.",
 	},
+	{path: "/store?type=decks", user: "aingau",
+		method: "POST",
+		data:   `[{"owner": "user1@test.com", "name": "deck3"}]`,
+		expect: "",
+		status: http.StatusBadRequest,
+		body:   `"field": "owner"`,
+		desc:   "store(deck) only stores the user's own decks",
+	},
+	{path: "/store?type=cards", user: "aingau",
+		method: "POST",
+		data:   `[{"owner": "user1@test.com:deck1", "front": "adonde", "back": "where"}]`,
+		expect: "list called",
+		status: http.StatusForbidden,
+		desc:   "store(card) only stores into the user's own decks",
+	},
+	{path: "/store?type=cards", user: "aingau",
+		method: "POST",
+		data:   `[{"deck_id": 1, "front": "adonde", "back": "where"}]`,
+		expect: "list called",
+		status: http.StatusForbidden,
+		desc:   "store(card) only stores into the user's own decks, by id too",
+	},
+	{path: "/store?type=cards", user: "admin@test.com",
+		method: "POST",
+		data:   `[{"deck_id": 1, "front": "adonde", "back": "where"}]`,
+		expect: " adonde where",
+		status: http.StatusOK,
+		desc:   "store(card) stores into anyone's decks for admins",
+	},
+
+	// Resource route tests.
+
+	{path: "/users/user1@test.com/decks", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: "list called",
+		status: http.StatusOK,
+		body:   `"name": "deck2"`,
+		desc:   "GET /users/{email}/decks lists the user's decks",
+	},
+	{path: "/users/user1@test.com/decks", user: "carter",
+		method: "GET",
+		data:   "",
+		expect: "list called",
+		status: http.StatusOK,
+		body:   `null`,
+		desc:   "GET /users/{email}/decks only lists decks the caller can see",
+	},
+	{path: "/users/User1@test.com/decks", user: "user1@test.com",
+		method: "POST",
+		data:   `{"name": "deck9", "desc": "New."}`,
+		expect: "createdeck deck9 New.",
+		status: http.StatusCreated,
+		body:   `"id": 5`,
+		desc:   "POST /users/{email}/decks creates a deck",
+	},
+	{path: "/users/user1@test.com/decks", user: "user1@test.com",
+		method: "POST",
+		data:   `{"name": "Deck1"}`,
+		expect: "createdeck deck1 ",
+		status: http.StatusConflict,
+		desc:   "POST /users/{email}/decks won't replace a deck",
+	},
+	{path: "/users/user2@test.com/decks", user: "user1@test.com",
+		method: "POST",
+		data:   `{"name": "deck9"}`,
+		expect: "",
+		status: http.StatusForbidden,
+		desc:   "POST /users/{email}/decks only creates the caller's decks",
+	},
+	{path: "/users/nobody@test.com/decks", user: "admin@test.com",
+		method: "POST",
+		data:   `{"name": "deck9"}`,
+		expect: "",
+		status: http.StatusNotFound,
+		desc:   "POST /users/{email}/decks needs an existing user",
+	},
+	{path: "/decks/2", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: "list called",
+		status: http.StatusOK,
+		body:   `"desc": "Essential Camus quotes."`,
+		desc:   "GET /decks/{id} works as intended",
+	},
+	{path: "/decks/3", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: "list called",
+		status: http.StatusNotFound,
+		desc:   "GET /decks/{id} of someone else's deck is not found",
+	},
+	{path: "/decks/1", user: "learner@test.com",
+		method: "GET",
+		data:   "",
+		expect: "list called",
+		status: http.StatusOK,
+		body:   `"access": "read"`,
+		desc:   "GET /decks/{id} works for shared decks",
+	},
+	{path: "/decks/1/cards", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: "list called\nlist called",
+		status: http.StatusOK,
+		body:   `"front": "tall"`,
+		desc:   "GET /decks/{id}/cards lists the deck's cards",
+	},
+	{path: "/decks/1/cards", user: "user1@test.com",
+		method: "POST",
+		data:   `{"front": "up", "back": "down"}`,
+		expect: "list called\n up down\nlist called",
+		status: http.StatusCreated,
+		body:   `"owner": "user1@test.com:deck1"`,
+		desc:   "POST /decks/{id}/cards creates a card",
+	},
+	{path: "/decks/1/cards", user: "learner@test.com",
+		method: "POST",
+		data:   `{"front": "up", "back": "down"}`,
+		expect: "list called",
+		status: http.StatusForbidden,
+		desc:   "POST /decks/{id}/cards needs a deck the caller can edit",
+	},
+	{path: "/decks/3/cards", user: "aingau",
+		method: "POST",
+		data:   `{"front": "up", "back": "down"}`,
+		expect: "list called\n up down\nlist called",
+		status: http.StatusCreated,
+		desc:   "POST /decks/{id}/cards works for decks shared to edit",
+	},
+	{path: "/cards/3", user: "user1@test.com",
+		method: "GET",
+		data:   "",
+		expect: "list called\nlist called",
+		status: http.StatusOK,
+		body:   `"front": "sky"`,
+		desc:   "GET /cards/{id} works as intended",
+	},
+	{path: "/cards/3", user: "aingau",
+		method: "GET",
+		data:   "",
+		expect: "list called",
+		status: http.StatusNotFound,
+		desc:   "GET /cards/{id} of someone else's card is not found",
+	},
+	{path: "/cards/3", user: "user1@test.com",
+		method: "PUT",
+		data:   `{"front": "sea", "back": "green"}`,
+		expect: "list called\nlist called\nupdate db.CardList\nlist called\nlist called",
+		status: http.StatusOK,
+		body:   `"back": "green"`,
+		desc:   "PUT /cards/{id} changes a card",
+	},
+	{path: "/cards/3", user: "user1@test.com",
+		method: "PUT",
+		data:   `{"front": "sea", "back": "green", "deck_id": 3}`,
+		expect: "list called\nlist called\nlist called",
+		status: http.StatusForbidden,
+		desc:   "PUT /cards/{id} only moves cards to decks the caller can edit",
+	},
+	{path: "/cards/1", user: "learner@test.com",
+		method: "PUT",
+		data:   `{"front": "sea", "back": "green"}`,
+		expect: "list called\nlist called",
+		status: http.StatusForbidden,
+		desc:   "PUT /cards/{id} needs a deck the caller can edit",
+	},
+	{path: "/cards/3", user: "user1@test.com",
+		method: "PUT",
+		data:   `{"front": "", "back": "green"}`,
+		expect: "list called\nlist called",
+		status: http.StatusBadRequest,
+		body:   `"field": "front"`,
+		desc:   "PUT /cards/{id} needs a front",
+	},
+	{path: "/cards/4", user: "aingau",
+		method: "DELETE",
+		data:   "",
+		expect: "list called\nlist called\ndelete db.CardList",
+		status: http.StatusNoContent,
+		desc:   "DELETE /cards/{id} works for decks shared to edit",
+	},
+	{path: "/cards/4", user: "user1@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "list called",
+		status: http.StatusNotFound,
+		desc:   "DELETE /cards/{id} of someone else's card is not found",
+	},
+	{path: "/decks/2", user: "user1@test.com",
+		method: "PUT",
+		data:   `{"name": "camus", "desc": "Renamed."}`,
+		expect: "list called\nupdate db.DeckList\nlist called",
+		status: http.StatusOK,
+		body:   `"name": "camus"`,
+		desc:   "PUT /decks/{id} changes a deck",
+	},
+	{path: "/decks/3", user: "aingau",
+		method: "PUT",
+		data:   `{"name": "mine"}`,
+		expect: "list called",
+		status: http.StatusForbidden,
+		desc:   "PUT /decks/{id} only changes the caller's own decks",
+	},
+	{path: "/decks/1", user: "user1@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "list called\ndelete db.DeckList",
+		status: http.StatusNoContent,
+		desc:   "DELETE /decks/{id} deletes a deck",
+	},
+	{path: "/decks/1", user: "learner@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "list called",
+		status: http.StatusForbidden,
+		desc:   "DELETE /decks/{id} only deletes the caller's own decks",
+	},
+	{path: "/users/user1@test.com", user: "user1@test.com",
+		method: "PUT",
+		data:   `{"name": "William"}`,
+		expect: "update db.UserList\nlist called",
+		status: http.StatusOK,
+		body:   `"name": "William"`,
+		desc:   "PUT /users/{email} changes the caller's name",
+	},
+	{path: "/users/user1@test.com", user: "user1@test.com",
+		method: "PUT",
+		data:   `{"name": "William", "role": "admin"}`,
+		expect: "",
+		status: http.StatusForbidden,
+		desc:   "PUT /users/{email} only changes roles for admins",
+	},
+	{path: "/users/user1@test.com", user: "admin@test.com",
+		method: "PUT",
+		data:   `{"name": "Bill", "role": "learner"}`,
+		expect: "update db.UserList\nlist called",
+		status: http.StatusOK,
+		body:   `"role": "learner"`,
+		desc:   "PUT /users/{email} changes roles for admins",
+	},
+	{path: "/users/user2@test.com", user: "admin@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "delete db.UserList",
+		status: http.StatusNoContent,
+		desc:   "DELETE /users/{email} works for admins",
+	},
+	{path: "/users/user2@test.com", user: "user1@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "",
+		status: http.StatusForbidden,
+		desc:   "DELETE /users/{email} only works for admins",
+	},
+	{path: "/decks/1/shares?group=class", user: "user1@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "list called\nlist called\ndelete db.ShareList",
+		status: http.StatusNoContent,
+		desc:   "DELETE /decks/{id}/shares stops sharing a deck with a group",
+	},
+	{path: "/decks/3/shares?user=aingau", user: "admin@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "list called\ndelete db.ShareList",
+		status: http.StatusNoContent,
+		desc:   "DELETE /decks/{id}/shares works for admins",
+	},
+	{path: "/decks/3/shares?user=aingau", user: "aingau",
+		method: "DELETE",
+		data:   "",
+		expect: "list called\nlist called",
+		status: http.StatusForbidden,
+		desc:   "DELETE /decks/{id}/shares only works for the deck's owner",
+	},
+	{path: "/decks/1/shares?user=aingau", user: "user1@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "list called\nlist called\ndelete db.ShareList",
+		status: http.StatusNotFound,
+		desc:   "DELETE /decks/{id}/shares of a missing share is not found",
+	},
+	{path: "/decks/1/shares", user: "user1@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "list called",
+		status: http.StatusBadRequest,
+		desc:   "DELETE /decks/{id}/shares needs a user or a group",
+	},
+	{path: "/groups/class", user: "user1@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "list called\ndelete db.GroupList",
+		status: http.StatusNoContent,
+		desc:   "DELETE /groups/{name} deletes a group",
+	},
+	{path: "/groups/Class", user: "admin@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "list called\ndelete db.GroupList",
+		status: http.StatusNoContent,
+		desc:   "DELETE /groups/{name} works for admins",
+	},
+	{path: "/groups/class", user: "aingau",
+		method: "DELETE",
+		data:   "",
+		expect: "list called",
+		status: http.StatusForbidden,
+		desc:   "DELETE /groups/{name} only works for the group's owner",
+	},
+	{path: "/groups/class", user: "user2@test.com",
+		method: "DELETE",
+		data:   "",
+		expect: "list called",
+		status: http.StatusNotFound,
+		desc:   "DELETE /groups/{name} of someone else's group is not found",
+	},
+	{path: "/store?type=cards", user: "aingau",
+		method: "POST",
+		data:   `[{"id": 3, "deck_id": 3, "front": "mine", "back": "now"}]`,
+		expect: "list called\nlist called",
+		status: http.StatusForbidden,
+		desc:   "store(card) won't replace cards in others' decks",
+	},
+	{path: "/store?type=cards", user: "user1@test.com",
+		method: "POST",
+		data:   `[{"id": 3, "deck_id": 2, "front": "sky", "back": "grey"}]`,
+		expect: "list called\nlist called\n sky grey",
+		status: http.StatusOK,
+		desc:   "store(card) replaces cards stored with an ID",
+	},
+	{path: "/cards/3", user: "user1@test.com",
+		method: "POST",
+		data:   `{"front": "sea"}`,
+		expect: "",
+		status: http.StatusMethodNotAllowed,
+		desc:   "resource routes only answer their own verbs",
+	},
+	{path: "/decks/1",
+		method: "GET",
+		data:   "",
+		expect: "",
+		status: http.StatusUnauthorized,
+		desc:   "resource routes need a token",
+	},
+
+	// Review handler tests.
+
+	{path: "/review", user: "user1@test.com",
+		method: "POST",
+		data:   `{"id": 3, "grade": "good", "response_ms": 2500}`,
+		expect: "review 3 user1@test.com 4 2.5s",
+		status: http.StatusOK,
+		desc:   "review works as expected.",
+	},
+	{path: "/review", user: "user1@test.com",
+		method: "POST",
+		data:   `{"id": 3, "grade": 2}`,
+		expect: "review 3 user1@test.com 2 0s",
+		status: http.StatusOK,
+		desc:   "review accepts numeric grades.",
+	},
+	{path: "/review", user: "aingau",
+		method: "POST",
+		data:   `{"id": 3, "grade": "good"}`,
+		expect: "review 3 aingau 4 0s",
+		status: http.StatusNotFound,
+		desc:   "review of someone else's card is not found.",
+	},
+	{path: "/review",
+		method: "POST",
+		data:   `{"id": 3, "grade": "good"}`,
+		expect: "",
+		status: http.StatusUnauthorized,
+		desc:   "review without a token will error out.",
+	},
+	{path: "/review", user: "aingau",
+		method: "POST",
+		data:   `{"id": 3, "grade": "perfect"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "review with an invalid grade will error out.",
+	},
+	{path: "/review", user: "aingau",
+		method: "POST",
+		data:   `{"grade": "good"}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "review with no card id will error out.",
+	},
+	{path: "/review", user: "user1@test.com",
+		method: "POST",
+		data:   `{"id": 3}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "review with no grade will error out rather than reset the card.",
+	},
+	{path: "/review", user: "user1@test.com",
+		method: "POST",
+		data:   `{"id": 3, "grade": 4, "grad": 4}`,
+		expect: "",
+		status: http.StatusBadRequest,
+		desc:   "review with an unknown field will error out.",
+	},
+	{path: "/review", user: "user1@test.com",
+		method: "POST",
+		data:   `{"id": 3, "grade": 0}`,
+		expect: "review 3 user1@test.com 0 0s",
+		status: http.StatusOK,
+		desc:   "review still takes an explicit grade of 0.",
+	},
+	{path: "/review", user: "aingau",
+		method: "POST",
+		data:   `{"id": 404, "grade": "good"}`,
+		expect: "review 404 aingau 4 0s",
+		status: http.StatusNotFound,
+		desc:   "review of a missing card is not found.",
+	},
 }
 
 func TestAppDB_Handlers(t *testing.T) {
 	for i, tt := range tests {
 		c := test.Checker(t, test.Summary(fmt.Sprintf("With test %v: %s", i, tt.desc)))
 
-		adb := &appDB{&mockDB{new(bytes.Buffer)}}
+		adb := &appDB{ds: newMockDB(t), auth: testAuth}
 		mr := router(adb)
 
 		var r *http.Request
@@ -136,6 +1035,13 @@ func TestAppDB_Handlers(t *testing.T) {
 		} else {
 			r = httptest.NewRequest(tt.method, tt.path, nil)
 		}
+		if tt.user != "" {
+			tok, _ := testAuth.token(tt.user, time.Now())
+			r.Header.Set("Authorization", "Bearer "+tok)
+		}
+		if tt.key != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.key)
+		}
 		w := httptest.NewRecorder()
 		mr.ServeHTTP(w, r)
 
@@ -149,11 +1055,503 @@ func TestAppDB_Handlers(t *testing.T) {
 		if tt.status == http.StatusOK {
 			c.Expect(test.NE, nil, w.Body)
 		}
+		if !strings.Contains(w.Body.String(), tt.body) {
+			t.Errorf("%s handler returned %v, expected it to contain %v", tt.path, w.Body, tt.body)
+		}
 	}
 }
 
+// TestListHidesPasswords checks that no list response, for anyone and in
+// either format, contains a bcrypt hash or the hash of an API key.
+func TestListHidesPasswords(t *testing.T) {
+	adb := &appDB{ds: newMockDB(t), auth: testAuth}
+	mr := router(adb)
+
+	secrets := []string{"$2a$", hashKey("sk_read"), hashKey("sk_write"), hashKey("sk_admin")}
+	for _, u := range []string{"admin@test.com", "user1@test.com"} {
+		for _, accept := range []string{"", ndjson} {
+			for _, what := range []string{"users", "decks", "cards", "reviews", "groups", "shares", "keys"} {
+				r := httptest.NewRequest("GET", "/list?type="+what+"&q=*", nil)
+				tok, _ := testAuth.token(u, time.Now())
+				r.Header.Set("Authorization", "Bearer "+tok)
+				r.Header.Set("Accept", accept)
+				w := httptest.NewRecorder()
+				mr.ServeHTTP(w, r)
+
+				if what == "keys" && !strings.Contains(w.Body.String(), `"owner"`) {
+					t.Errorf("list of keys for %s (%q) returned no keys: %v", u, accept, w.Body)
+				}
+				for _, s := range secrets {
+					if strings.Contains(w.Body.String(), s) {
+						t.Errorf("list of %s for %s (%q) returned a secret %q: %v", what, u, accept, s, w.Body)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	c := test.Checker(t)
+
+	adb := &appDB{ds: newMockDB(t), auth: testAuth}
+	mr := router(adb)
+	do := func(method, path, auth, data string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(data))
+		r.Header.Set("Authorization", "Bearer "+auth)
+		w := httptest.NewRecorder()
+		mr.ServeHTTP(w, r)
+		return w
+	}
+
+	tok, _ := testAuth.token("admin@test.com", time.Now())
+	w := do("POST", "/keys", tok, `{"owner": "user2@test.com", "name": "app", "scope": "write"}`)
+	c.Expect(test.EQ, http.StatusOK, w.Code)
+	var k struct {
+		ID  int    `json:"id"`
+		Key string `json:"key"`
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &k)
+	c.Expect(test.EQ, nil, err)
+
+	// Only the key's hash is stored.
+	_, err = adb.ds.APIKey(k.Key)
+	c.Expect(test.EQ, db.ErrNotFound, err)
+
+	w = do("GET", "/list?type=cards&q=*", k.Key, "")
+	c.Expect(test.EQ, http.StatusOK, w.Code)
+	c.Expect(test.EQ, true, strings.Contains(w.Body.String(), "peanut butter"))
+	c.Expect(test.EQ, false, strings.Contains(w.Body.String(), "sky"))
+
+	w = do("DELETE", fmt.Sprintf("/keys/%d", k.ID), tok, "")
+	c.Expect(test.EQ, http.StatusOK, w.Code)
+
+	w = do("GET", "/list?type=cards&q=*", k.Key, "")
+	c.Expect(test.EQ, http.StatusUnauthorized, w.Code)
+}
+
+// TestListPages checks that long lists are paged through by following the
+// Link header of each page.
+func TestListPages(t *testing.T) {
+	c := test.Checker(t)
+
+	adb := &appDB{ds: newMockDB(t), auth: testAuth}
+	mr := router(adb)
+	tok, _ := testAuth.token("admin@test.com", time.Now())
+
+	all, err := adb.ds.List(db.ListOp{What: "cards", Query: "*"})
+	c.Expect(test.EQ, nil, err)
+
+	var got db.CardList
+	link := "/list?type=cards&q=*&limit=2"
+	for pages := 0; link != ""; pages++ {
+		if pages > len(all.(db.CardList)) {
+			t.Fatal("Too many pages.")
+		}
+		r := httptest.NewRequest("GET", link, nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		mr.ServeHTTP(w, r)
+		c.Expect(test.EQ, http.StatusOK, w.Code)
+
+		var page db.CardList
+		err := json.Unmarshal(w.Body.Bytes(), &page)
+		c.Expect(test.EQ, nil, err)
+		c.Expect(test.EQ, true, len(page) <= 2)
+		got = append(got, page...)
+
+		link = w.Header().Get("Link")
+		if link != "" {
+			link = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+		}
+	}
+	c.Expect(test.EQ, len(all.(db.CardList)), len(got))
+	for i := range got {
+		c.Expect(test.EQ, all.(db.CardList)[i].ID, got[i].ID)
+	}
+
+	r := httptest.NewRequest("GET", "/list?type=cards&q=*&cursor=nonsense", nil)
+	r.Header.Set("Authorization", "Bearer "+tok)
+	w := httptest.NewRecorder()
+	mr.ServeHTTP(w, r)
+	c.Expect(test.EQ, http.StatusBadRequest, w.Code)
+}
+
+// TestListStreams checks that /list streams newline-delimited JSON to
+// clients that accept it.
+func TestListStreams(t *testing.T) {
+	c := test.Checker(t)
+
+	adb := &appDB{ds: newMockDB(t), auth: testAuth}
+	mr := router(adb)
+	tok, _ := testAuth.token("admin@test.com", time.Now())
+	do := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		r.Header.Set("Accept", "application/x-ndjson")
+		w := httptest.NewRecorder()
+		mr.ServeHTTP(w, r)
+		return w
+	}
+
+	all, err := adb.ds.List(db.ListOp{What: "cards", Query: "*"})
+	c.Expect(test.EQ, nil, err)
+
+	w := do("/list?type=cards&q=*")
+	c.Expect(test.EQ, http.StatusOK, w.Code)
+	c.Expect(test.EQ, "application/x-ndjson", w.Header().Get("Content-Type"))
+	c.Expect(test.EQ, "", w.Header().Get("Link"))
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	c.Expect(test.EQ, len(all.(db.CardList)), len(lines))
+	for i, line := range lines {
+		var card db.Card
+		err := json.Unmarshal([]byte(line), &card)
+		c.Expect(test.EQ, nil, err)
+		c.Expect(test.EQ, all.(db.CardList)[i].ID, card.ID)
+	}
+
+	w = do("/list?type=users&q=*")
+	c.Expect(test.EQ, http.StatusOK, w.Code)
+	c.Expect(test.EQ, false, strings.Contains(w.Body.String(), "$2a$"))
+
+	w = do("/list?type=cards&q=*&limit=2")
+	c.Expect(test.EQ, 2, strings.Count(w.Body.String(), "\n"))
+
+	// Errors found before anything is streamed are replied to as usual.
+	w = do("/list?type=cards&q=*&cursor=nonsense")
+	c.Expect(test.EQ, http.StatusBadRequest, w.Code)
+	c.Expect(test.EQ, "application/json", w.Header().Get("Content-Type"))
+}
+
+// TestSearch checks that /search finds cards by their content, among those
+// the user can list.
+func TestSearch(t *testing.T) {
+	c := test.Checker(t)
+
+	adb := &appDB{ds: newMockDB(t), auth: testAuth}
+	mr := router(adb)
+	do := func(user, path string) *httptest.ResponseRecorder {
+		tok, _ := testAuth.token(user, time.Now())
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		mr.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, tt := range []struct {
+		user, path string
+		status     int
+		fronts     []string
+	}{
+		{"user1@test.com", "/search?q=SKY", http.StatusOK, []string{"sky"}},
+		{"user1@test.com", "/search?q=sky+blue", http.StatusOK, []string{"sky"}},
+		{"user1@test.com", "/search?q=sky&deck=user1@test.com:deck1", http.StatusOK, nil},
+		{"user1@test.com", "/search?q=jelly", http.StatusOK, nil},
+		{"aingau", "/search?q=jelly", http.StatusOK, []string{"peanut butter"}},
+		{"admin@test.com", "/search?q=jelly", http.StatusOK, []string{"peanut butter"}},
+		{"user1@test.com", "/search?q=", http.StatusBadRequest, nil},
+		{"user1@test.com", "/search?q=%3F%3F", http.StatusBadRequest, nil},
+		{"user1@test.com", "/search?q=sky&cursor=WzFd", http.StatusBadRequest, nil},
+	} {
+		w := do(tt.user, tt.path)
+		c.Expect(test.EQ, tt.status, w.Code)
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var hits db.HitList
+		err := json.Unmarshal(w.Body.Bytes(), &hits)
+		c.Expect(test.EQ, nil, err)
+		var fronts []string
+		for _, h := range hits {
+			fronts = append(fronts, h.Front)
+		}
+		c.Expect(test.EQ, tt.fronts, fronts)
+	}
+
+	w := do("user1@test.com", "/search?q=sky")
+	c.Expect(test.EQ, true, strings.Contains(w.Body.String(), `"snippet": "**sky**"`))
+	c.Expect(test.EQ, "", w.Header().Get("Link"))
+}
+
+// TestListFilters checks that the filter param narrows lists of cards and
+// searches, and that bad filters are bad requests.
+func TestListFilters(t *testing.T) {
+	c := test.Checker(t)
+
+	adb := &appDB{ds: newMockDB(t), auth: testAuth}
+	mr := router(adb)
+	tok, _ := testAuth.token("user1@test.com", time.Now())
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		mr.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("POST", "/store?type=cards", `[{"owner": "user1@test.com:deck1", "front": "ser", "back": "to be", "tags": ["Verbs"]}]`)
+	c.Expect(test.EQ, http.StatusOK, w.Code)
+
+	for _, tt := range []struct {
+		path   string
+		status int
+		fronts []string
+	}{
+		{"/list?type=cards&q=*&filter=tag+%3D+verbs", http.StatusOK, []string{"ser"}},
+		{"/list?type=cards&q=*&filter=" + url.QueryEscape(`front ~ "a" AND NOT tag = verbs`), http.StatusOK, []string{"tall"}},
+		{"/decks/1/cards?filter=" + url.QueryEscape(`back = "to be" OR front = big`), http.StatusOK, []string{"big", "ser"}},
+		{"/decks/2/cards?filter=tag+%3D+verbs", http.StatusOK, nil},
+		{"/search?q=be&filter=tag+%3D+verbs", http.StatusOK, []string{"ser"}},
+		{"/search?q=be&filter=tag+%21%3D+verbs", http.StatusOK, nil},
+		{"/list?type=cards&q=*&filter=tag+%3D", http.StatusBadRequest, nil},
+		{"/list?type=decks&q=*&filter=tag+%3D+verbs", http.StatusBadRequest, nil},
+	} {
+		w := do("GET", tt.path, "")
+		c.Expect(test.EQ, tt.status, w.Code)
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var cards []db.Card
+		err := json.Unmarshal(w.Body.Bytes(), &cards)
+		c.Expect(test.EQ, nil, err)
+		var fronts []string
+		for _, card := range cards {
+			fronts = append(fronts, card.Front)
+		}
+		c.Expect(test.EQ, tt.fronts, fronts)
+	}
+
+	w = do("GET", "/list?type=cards&q=*&filter=tag+%3D+verbs", "")
+	c.Expect(test.EQ, true, strings.Contains(w.Body.String(), `"tags": [`))
+}
+
+// TestResourceRoutes checks that every resource route doc.go lists is served
+// for each of its verbs, by a handler that does what it says rather than
+// replying 501 Not Implemented.
+func TestResourceRoutes(t *testing.T) {
+	tok, _ := testAuth.token("admin@test.com", time.Now())
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"PUT", "/users/user1@test.com", `{"name": "William"}`, http.StatusOK},
+		{"DELETE", "/users/user2@test.com", "", http.StatusNoContent},
+		{"GET", "/users/user1@test.com/decks", "", http.StatusOK},
+		{"POST", "/users/user1@test.com/decks", `{"name": "spanish"}`, http.StatusCreated},
+		{"GET", "/decks/1", "", http.StatusOK},
+		{"PUT", "/decks/2", `{"name": "camus"}`, http.StatusOK},
+		{"DELETE", "/decks/1", "", http.StatusNoContent},
+		{"GET", "/decks/1/cards", "", http.StatusOK},
+		{"POST", "/decks/1/cards", `{"front": "adonde", "back": "where"}`, http.StatusCreated},
+		{"DELETE", "/decks/1/shares?group=class", "", http.StatusNoContent},
+		{"GET", "/cards/1", "", http.StatusOK},
+		{"PUT", "/cards/1", `{"front": "huge", "back": "tiny"}`, http.StatusOK},
+		{"DELETE", "/cards/1", "", http.StatusNoContent},
+		{"DELETE", "/groups/class", "", http.StatusNoContent},
+	} {
+		mr := router(&appDB{ds: newMockDB(t), auth: testAuth})
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		r.Header.Set("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		mr.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s replied %d, expected %d", tt.method, tt.path, w.Code, tt.status)
+		}
+	}
+}
+
+// TestErrorBodies checks that errors are replied to with a JSON body
+// carrying the request's ID, which is echoed when it's sane and made up
+// otherwise.
+func TestErrorBodies(t *testing.T) {
+	c := test.Checker(t)
+
+	adb := &appDB{ds: newMockDB(t), auth: testAuth}
+	mr := router(adb)
+	tok, _ := testAuth.token("user1@test.com", time.Now())
+
+	for _, tt := range []struct {
+		path, id string
+		status   int
+		code     string
+		echoed   bool
+	}{
+		{"/decks/1000", "abc-123", http.StatusNotFound, "not_found", true},
+		{"/nowhere", "abc-123", http.StatusNotFound, "not_found", true},
+		{"/list?type=users&q=*", "", http.StatusForbidden, "forbidden", false},
+		{"/list?type=decks", "bad id\n", http.StatusBadRequest, "bad_request", false},
+	} {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("Authorization", "Bearer "+tok)
+		if tt.id != "" {
+			r.Header.Set("X-Request-ID", tt.id)
+		}
+		w := httptest.NewRecorder()
+		mr.ServeHTTP(w, r)
+
+		c.Expect(test.EQ, tt.status, w.Code)
+		c.Expect(test.EQ, "application/json", w.Header().Get("Content-Type"))
+		var e apiError
+		err := json.Unmarshal(w.Body.Bytes(), &e)
+		c.Expect(test.EQ, nil, err)
+		c.Expect(test.EQ, tt.code, e.Code)
+		c.Expect(test.NE, "", e.Message)
+		c.Expect(test.EQ, w.Header().Get("X-Request-ID"), e.RequestID)
+		c.Expect(test.EQ, tt.echoed, e.RequestID == tt.id)
+		c.Expect(test.NE, "", e.RequestID)
+	}
+
+	// Server errors don't say what went wrong.
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	writeError(w, r, http.StatusInternalServerError, fmt.Errorf("secret stuff"))
+	c.Expect(test.EQ, false, strings.Contains(w.Body.String(), "secret"))
+}
+
+func TestValidate(t *testing.T) {
+	c := test.Checker(t)
+
+	r := httptest.NewRequest("POST", "/store", nil)
+	r = r.WithContext(context.WithValue(r.Context(), userKey, "user1@test.com"))
+
+	err := validate(r, db.DeckList{
+		{Owner: "user1@test.com", Name: "spanish"},
+		{Owner: "user2@test.com", Name: ""},
+		{Name: "user1@test.com:fsrs", Scheduler: "fsrs", Params: []byte(`{"retention": 2}`)},
+	})
+	c.Expect(test.EQ, invalidError{
+		{1, "name", "is required"},
+		{1, "owner", `must be "user1@test.com"`},
+		{2, "scheduler", "db.FSRS: retention must be between 0 and 1."},
+	}, err)
+
+	err = validate(r, db.UserList{
+		{Email: "user3@test.com", Name: strings.Repeat("x", maxName+1)},
+		{Email: "user4@test.com", Role: "king", Password: "secret"},
+	})
+	c.Expect(test.EQ, invalidError{
+		{0, "name", "must be at most 200 bytes"},
+		{1, "role", "must be one of admin, editor, learner"},
+		{1, "password", "can't be stored; use /password"},
+	}, err)
+
+	err = validate(r, db.CardList{{DeckID: 1, Front: "adonde", Back: "where", Tags: []string{"a1", "ser/estar"}}})
+	c.Expect(test.EQ, nil, err)
+
+	err = validate(r, db.CardList{
+		{DeckID: 1, Front: "a", Back: "b", Tags: []string{"", "two words"}},
+		{DeckID: 1, Front: "a", Back: "b", Tags: make([]string, maxTags+1)},
+	})
+	c.Expect(test.EQ, invalidError{
+		{0, "tags", "is required"},
+		{0, "tags", "must only have letters, digits and -_.:/"},
+		{1, "tags", "can't be more than 20"},
+	}, err)
+}
+
+var testAuth = &auth{
+	secret: []byte("secret"),
+	admins: map[string]bool{"admin@test.com": true},
+	ttl:    time.Hour,
+	cost:   bcrypt.MinCost,
+}
+
+func TestAuth(t *testing.T) {
+	c := test.Checker(t)
+
+	now := time.Now()
+	tok, exp := testAuth.token("User1@test.com", now)
+	c.Expect(test.EQ, true, exp.After(now))
+
+	u, err := testAuth.verify(tok, now)
+	c.Expect(test.EQ, nil, err)
+	c.Expect(test.EQ, "user1@test.com", u)
+
+	_, err = testAuth.verify(tok, exp)
+	c.Expect(test.EQ, errBadToken, err)
+
+	other := &auth{secret: []byte("other"), ttl: time.Hour}
+	_, err = other.verify(tok, now)
+	c.Expect(test.EQ, errBadToken, err)
+
+	// Changing who a token is for invalidates it.
+	forged, _ := other.token("admin@test.com", now)
+	i := strings.Index(tok, ".")
+	j := strings.Index(forged, ".")
+	_, err = testAuth.verify(forged[:j]+tok[i:], now)
+	c.Expect(test.EQ, errBadToken, err)
+
+	for _, bad := range []string{"", ".", "garbage", tok + "x"} {
+		_, err = testAuth.verify(bad, now)
+		c.Expect(test.EQ, errBadToken, err)
+	}
+
+	for _, p := range []string{"", "short", "user1@test.com", "xxxxxxxxxx", "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK", strings.Repeat("long", 20)} {
+		c.Expect(test.NE, nil, checkPassword("user1@test.com", p))
+	}
+	c.Expect(test.EQ, nil, checkPassword("user1@test.com", "correct horse"))
+
+	c.Expect(test.EQ, true, testAuth.isAdmin("Admin@test.com"))
+	c.Expect(test.EQ, false, testAuth.isAdmin("user1@test.com"))
+}
+
+// mockDB records the calls made to it, and otherwise behaves like the
+// in-memory database it wraps.
 type mockDB struct {
 	*bytes.Buffer
+	mem *db.Mem
+}
+
+// newMockDB returns a mockDB holding a few users, decks and cards, with
+// user1@test.com's first deck shared with a group and user2@test.com's deck
+// shared with aingau.
+func newMockDB(t *testing.T) *mockDB {
+	m := &mockDB{new(bytes.Buffer), &db.Mem{}}
+	if err := m.mem.Open(""); err != nil {
+		t.Fatal(err)
+	}
+	data := []db.ListStorer{
+		db.UserList{
+			{Email: "user1@test.com", Name: "Bill", Password: "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"},
+			{Email: "user2@test.com", Name: "Jill", Password: "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"},
+			{Email: "aingau"},
+			{Email: "carter"},
+			{Email: "admin@test.com"},
+			{Email: "boss@test.com", Role: db.RoleAdmin},
+			{Email: "learner@test.com", Role: db.RoleLearner},
+		},
+		db.DeckList{
+			{Owner: "user1@test.com", Name: "deck1", Desc: "The meaning of life."},
+			{Owner: "user1@test.com", Name: "deck2", Desc: "Essential Camus quotes."},
+			{Owner: "user2@test.com", Name: "deck1"},
+			{Owner: "aingau", Name: "spanish"},
+		},
+		db.CardList{
+			{Owner: "user1@test.com:deck1", Front: "big", Back: "small"},
+			{Owner: "user1@test.com:deck1", Front: "tall", Back: "short"},
+			{Owner: "user1@test.com:deck2", Front: "sky", Back: "blue"},
+			{Owner: "user2@test.com:deck1", Front: "peanut butter", Back: "jelly"},
+		},
+		db.APIKeyList{
+			{Name: "read", Owner: "user1@test.com", Scope: db.ScopeRead, Hash: hashKey("sk_read")},
+			{Name: "write", Owner: "user1@test.com", Scope: db.ScopeWrite, Hash: hashKey("sk_write")},
+			{Name: "admin", Owner: "user2@test.com", Scope: db.ScopeAdmin, Hash: hashKey("sk_admin")},
+		},
+		db.GroupList{
+			{Name: "class", Owner: "user1@test.com", Members: []string{"learner@test.com", "aingau"}},
+		},
+		db.ShareList{
+			{DeckID: 1, Group: "class", Access: db.AccessRead},
+			{DeckID: 3, User: "aingau", Access: db.AccessEdit},
+		},
+	}
+	for _, ls := range data {
+		if err := m.mem.Store(ls); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
 }
 
 func (m *mockDB) Open(file string) error { return nil }
@@ -163,34 +1561,53 @@ func (m *mockDB) Init(dir string) error {
 	return nil
 }
 func (m *mockDB) List(l db.ListOp) (db.ListStorer, error) {
-	fmt.Fprintf(m, "list called")
-	var ls db.ListStorer
-	switch l.What {
-	case "users":
-		ls = db.UserList{
-			{Email: "user1@test.com", Name: "Bill", Password: "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"},
-			{Email: "user2@test.com", Name: "Jill", Password: "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"},
-		}
-	case "decks":
-		ls = db.DeckList{
-			{Name: "test1:deck1", Desc: "The meaning of life."},
-			{Name: "test1:deck2", Desc: "Essential Camus quotes."},
-		}
-	case "cards":
-		ls = db.CardList{
-			{Owner: "user1:deck1", Front: "big", Back: "small"},
-			{Owner: "user1:deck1", Front: "tall", Back: "short"},
-			{Owner: "user1:deck1", Front: "ugly", Back: "pretty"},
-			{Owner: "user1:deck2", Front: "sky", Back: "blue"},
-			{Owner: "user1:deck2", Front: "grass", Back: "green"},
-			{Owner: "user2:deck1", Front: "peanut butter", Back: "jelly"},
-			{Owner: "user2:deck1", Front: "sausage", Back: "egg"},
-			{Owner: "user2:deck1", Front: "burger", Back: "fries"},
-		}
-	default:
-		return nil, fmt.Errorf("mockDB.List(): Bad typed passed in (%v).", l.What)
-	}
-	return ls, nil
+	fmt.Fprintln(m, "list called")
+	return m.mem.List(l)
+}
+func (m *mockDB) Stream(l db.ListOp, fn func(interface{}) error) error {
+	fmt.Fprintln(m, "stream called")
+	return m.mem.Stream(l, fn)
+}
+func (m *mockDB) Review(r db.ReviewOp) (db.Card, error) {
+	fmt.Fprintln(m, "review", r.CardID, r.User, r.Grade, r.ResponseTime)
+	return m.mem.Review(r)
+}
+func (m *mockDB) Credentials(email string) (string, error) {
+	fmt.Fprintln(m, "credentials", email)
+	return m.mem.Credentials(email)
+}
+
+// Role isn't recorded, since every authenticated request calls it.
+func (m *mockDB) Role(email string) (string, error) {
+	return m.mem.Role(email)
+}
+func (m *mockDB) SetCredentials(email, hash string) error {
+	fmt.Fprintln(m, "setcredentials", email)
+	return m.mem.SetCredentials(email, hash)
+}
+func (m *mockDB) CreateDeck(d db.Deck) (db.Deck, error) {
+	fmt.Fprintln(m, "createdeck", d.Name, d.Desc)
+	return m.mem.CreateDeck(d)
+}
+func (m *mockDB) CreateUser(u db.User) error {
+	fmt.Fprintln(m, "createuser", u.Email, u.Name)
+	return m.mem.CreateUser(u)
+}
+func (m *mockDB) APIKey(hash string) (db.APIKey, error) {
+	fmt.Fprintln(m, "apikey")
+	return m.mem.APIKey(hash)
+}
+func (m *mockDB) RevokeAPIKey(id int) error {
+	fmt.Fprintln(m, "revoke", id)
+	return m.mem.RevokeAPIKey(id)
+}
+func (m *mockDB) Update(ls db.ListStorer) error {
+	fmt.Fprintf(m, "update %T\n", ls)
+	return m.mem.Update(ls)
+}
+func (m *mockDB) Delete(ls db.ListStorer) error {
+	fmt.Fprintf(m, "delete %T\n", ls)
+	return m.mem.Delete(ls)
 }
 func (m *mockDB) Store(ls db.ListStorer) error {
 	switch ls := ls.(type) {
@@ -206,8 +1623,14 @@ func (m *mockDB) Store(ls db.ListStorer) error {
 		for _, c := range ls {
 			fmt.Fprintln(m, c.Owner, c.Front, c.Back)
 		}
-	default:
-		return fmt.Errorf("mockDB.List(): Bad typed passed in (%T).", ls)
+	case db.GroupList:
+		for _, g := range ls {
+			fmt.Fprintln(m, "group", g.Name, g.Owner)
+		}
+	case db.ShareList:
+		for _, s := range ls {
+			fmt.Fprintln(m, "share", s.DeckID, s.User, s.Group, s.Access)
+		}
 	}
-	return nil
+	return m.mem.Store(ls)
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/askcarter/spacerep/lib/db"
+	"github.com/gorilla/mux"
+)
+
+// keyPrefix starts every API key, which tells them apart from login tokens.
+const keyPrefix = "sk_"
+
+// newKey returns a new, random API key.
+func newKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return keyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashKey returns the hash that API key k is stored as.  Keys are random
+// enough that, unlike passwords, a plain SHA-256 hash keeps them safe.
+func hashKey(k string) string {
+	sum := sha256.Sum256([]byte(k))
+	return hex.EncodeToString(sum[:])
+}
+
+// createKey mints an API key for a service, given as
+// {"owner": "user1@test.com", "name": "app", "scope": "read"}, and replies
+// with the key.  This is the only time the key is ever shown.  Only admins can
+// mint keys.
+func (a *appDB) createKey(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !isAdmin(r) {
+		return http.StatusForbidden, errors.New("appDB.createKey(): Only admins can mint keys.")
+	}
+
+	var req struct {
+		Owner string `json:"owner"`
+		Name  string `json:"name"`
+		Scope string `json:"scope"`
+	}
+	if err := decode(r, &req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	switch req.Scope {
+	case db.ScopeRead, db.ScopeWrite, db.ScopeAdmin:
+	default:
+		return http.StatusBadRequest, errors.New("appDB.createKey(): Invalid scope.")
+	}
+	if req.Owner == "" {
+		req.Owner = userFrom(r)
+	}
+	if _, err := a.ds.Credentials(req.Owner); err != nil {
+		if err == db.ErrNotFound {
+			return http.StatusBadRequest, errors.New("appDB.createKey(): Unknown owner.")
+		}
+		return http.StatusInternalServerError, err
+	}
+
+	key, err := newKey()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	k := db.APIKey{
+		Owner: strings.ToLower(req.Owner),
+		Name:  req.Name,
+		Scope: req.Scope,
+		Hash:  hashKey(key),
+	}
+	if err := a.ds.Store(db.APIKeyList{k}); err != nil {
+		return errStatus(err), err
+	}
+	k, err = a.ds.APIKey(k.Hash)
+	if err != nil {
+		return errStatus(err), err
+	}
+
+	resp := struct {
+		db.APIKey
+		Key string `json:"key"`
+	}{k, key}
+	b, err := json.MarshalIndent(resp, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Write(b)
+
+	return http.StatusOK, nil
+}
+
+// listKeys lists the API keys whose owner matches the q param, which defaults
+// to "*".  Admins can list every key, and others only their own.
+func (a *appDB) listKeys(w http.ResponseWriter, r *http.Request) (int, error) {
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		q = "*"
+	}
+	ls, err := a.ds.List(db.ListOp{What: "keys", Query: q, User: scope(r)})
+	if err != nil {
+		return errStatus(err), err
+	}
+	b, err := json.MarshalIndent(ls, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Write(b)
+
+	return http.StatusOK, nil
+}
+
+// revokeKey revokes the API key with the id in its path, so it can't be used
+// again.  Only admins can revoke keys.
+func (a *appDB) revokeKey(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !isAdmin(r) {
+		return http.StatusForbidden, errors.New("appDB.revokeKey(): Only admins can revoke keys.")
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	err = a.ds.RevokeAPIKey(id)
+	if err != nil {
+		return errStatus(err), err
+	}
+
+	fmt.Fprintf(w, `{"message": "revoked key"}`)
+
+	return http.StatusOK, nil
+}
@@ -9,11 +9,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/askcarter/spacerep/lib/db"
 	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func main() {
@@ -21,11 +24,42 @@ func main() {
 		httpAddr = flag.String("http", ":80", "HTTP service address.")
 		// healthAddr = flag.String("health", ":81", "Health service address.")
 		file = flag.String("f", "test", "DB file")
+		dsn  = flag.String("dsn", "", "PostgreSQL connection string.  Overrides -f.")
+		mem  = flag.Bool("mem", false, "Keep data in memory only, e.g. for demos.  Overrides -f and -dsn.")
+
+		secret   = flag.String("secret", os.Getenv("DBD_SECRET"), "Key that login tokens are signed with.  Defaults to $DBD_SECRET.")
+		admins   = flag.String("admins", "", "Comma separated emails of the users that administer dbd.")
+		tokenTTL = flag.Duration("token-ttl", 24*time.Hour, "How long login tokens last.")
+		cost     = flag.Int("bcrypt-cost", bcrypt.DefaultCost, "bcrypt cost that passwords are hashed at.")
 	)
 	flag.Parse()
 
-	adb := &appDB{&db.DB{}}
-	if err := adb.ds.Open(*file); err != nil {
+	// dbd keeps its data in an SQLite file unless it's given a PostgreSQL
+	// database to use instead.
+	var d database = &db.DB{}
+	source := *file
+	if *dsn != "" {
+		d = &db.Postgres{}
+		source = *dsn
+	}
+
+	if flag.Arg(0) == "migrate" {
+		if err := migrate(d, source, flag.Arg(1)); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	a, err := newAuth(*secret, *admins, *tokenTTL, *cost)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	adb := &appDB{ds: d, auth: a}
+	if *mem {
+		adb.ds = &db.Mem{}
+	}
+	if err := adb.ds.Open(source); err != nil {
 		panic(err)
 	}
 	defer adb.ds.Close()
@@ -46,7 +80,7 @@ func main() {
 		errChan <- httpServer.ListenAndServe()
 	}()
 
-	signalChan := make(chan os.Signal)
+	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
 	for {
@@ -62,25 +96,101 @@ func main() {
 	}
 }
 
-func router(adb *appDB) *mux.Router {
+// database is a DataSource with a migratable SQL schema, as both *db.DB and
+// *db.Postgres are.
+type database interface {
+	db.DataSource
+
+	Connect(source string) error
+	Migrate() ([]db.Migration, error)
+	MigrationStatus() (int, []db.Migration, error)
+}
+
+// migrate runs dbd's migrate mode.  "dbd migrate" brings the database's
+// schema up to date without serving, and "dbd migrate status" reports what
+// that would do.
+func migrate(d database, source, cmd string) error {
+	if err := d.Connect(source); err != nil {
+		return err
+	}
+	defer d.Close()
+
+	switch cmd {
+	case "", "up":
+		applied, err := d.Migrate()
+		if err != nil {
+			return err
+		}
+		for _, m := range applied {
+			fmt.Println("applied", m)
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+	case "status":
+		v, pending, err := d.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		fmt.Println("schema version", v)
+		for _, m := range pending {
+			fmt.Println("pending", m)
+		}
+	default:
+		return fmt.Errorf("migrate: unknown command %q.", cmd)
+	}
+	return nil
+}
+
+func router(adb *appDB) http.Handler {
 	r := mux.NewRouter().StrictSlash(true)
-	r.Handle("/init", appHandler(adb.init)).Methods("POST")
-	r.Handle("/list", appHandler(adb.list)).Methods("GET")
-	r.Handle("/store", appHandler(adb.store)).Methods("POST")
-	return r
+	r.NotFoundHandler = http.HandlerFunc(notFound)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowed)
+	r.Handle("/login", appHandler(adb.login)).Methods("POST")
+	r.Handle("/signup", appHandler(adb.signup)).Methods("POST")
+
+	// Everything else needs a token from /login.
+	authed := adb.authenticate
+	r.Handle("/init", authed(appHandler(adb.init))).Methods("POST")
+	r.Handle("/list", authed(appHandler(adb.list))).Methods("GET")
+	r.Handle("/search", authed(appHandler(adb.search))).Methods("GET")
+	r.Handle("/store", authed(appHandler(adb.store))).Methods("POST")
+	r.Handle("/review", authed(appHandler(adb.review))).Methods("POST")
+	r.Handle("/password", authed(appHandler(adb.password))).Methods("POST")
+	r.Handle("/keys", authed(appHandler(adb.createKey))).Methods("POST")
+	r.Handle("/keys", authed(appHandler(adb.listKeys))).Methods("GET")
+	r.Handle("/keys/{id:[0-9]+}", authed(appHandler(adb.revokeKey))).Methods("DELETE")
+
+	// Resource routes, which /list and /store predate.
+	r.Handle("/users/{email}", authed(appHandler(adb.updateUser))).Methods("PUT")
+	r.Handle("/users/{email}", authed(appHandler(adb.deleteUser))).Methods("DELETE")
+	r.Handle("/users/{email}/decks", authed(appHandler(adb.userDecks))).Methods("GET")
+	r.Handle("/users/{email}/decks", authed(appHandler(adb.createDeck))).Methods("POST")
+	r.Handle("/decks/{id:[0-9]+}", authed(appHandler(adb.getDeck))).Methods("GET")
+	r.Handle("/decks/{id:[0-9]+}", authed(appHandler(adb.updateDeck))).Methods("PUT")
+	r.Handle("/decks/{id:[0-9]+}", authed(appHandler(adb.deleteDeck))).Methods("DELETE")
+	r.Handle("/decks/{id:[0-9]+}/cards", authed(appHandler(adb.deckCards))).Methods("GET")
+	r.Handle("/decks/{id:[0-9]+}/cards", authed(appHandler(adb.createCard))).Methods("POST")
+	r.Handle("/decks/{id:[0-9]+}/shares", authed(appHandler(adb.deleteShare))).Methods("DELETE")
+	r.Handle("/cards/{id:[0-9]+}", authed(appHandler(adb.getCard))).Methods("GET")
+	r.Handle("/cards/{id:[0-9]+}", authed(appHandler(adb.updateCard))).Methods("PUT")
+	r.Handle("/cards/{id:[0-9]+}", authed(appHandler(adb.deleteCard))).Methods("DELETE")
+	r.Handle("/groups/{name}", authed(appHandler(adb.deleteGroup))).Methods("DELETE")
+	return withRequestID(r)
 }
 
 type appDB struct {
-	ds db.DataSource
+	ds   db.DataSource
+	auth *auth
 }
 
 func (a *appDB) init(w http.ResponseWriter, r *http.Request) (int, error) {
-	if u := r.URL.Query().Get("user"); u != "admin" {
-		return http.StatusUnauthorized, errors.New("appdDB.init(): Only admin can init database.")
+	if !isAdmin(r) {
+		return http.StatusForbidden, errors.New("appdDB.init(): Only admin can init database.")
 	}
 
 	if err := a.ds.Init("./testdata"); err != nil {
-		return http.StatusInternalServerError, err
+		return errStatus(err), err
 	}
 
 	fmt.Fprintf(w, `{"message": "initialized db"}`)
@@ -91,27 +201,46 @@ func (a *appDB) init(w http.ResponseWriter, r *http.Request) (int, error) {
 func (a *appDB) list(w http.ResponseWriter, r *http.Request) (int, error) {
 	t := r.URL.Query().Get("type")
 	q := r.URL.Query().Get("q")
-	u := r.URL.Query().Get("user")
+	u := userFrom(r)
+	admin := isAdmin(r)
+	if t == "users" && !admin {
+		return http.StatusForbidden, errors.New("appDB.list(users): only works for admins.")
+	}
 
-	if u == "" || q == "" || t == "" {
-		return http.StatusInternalServerError, errors.New("appdDB.list(): Missing expected param.")
+	// Users only see what they own or has been shared with them, while
+	// admins see everything.
+	l := db.ListOp{What: t, User: u, Query: q, Filter: r.URL.Query().Get("filter")}
+	if admin {
+		l.User = ""
+	}
+	if d := r.URL.Query().Get("due"); d != "" {
+		due, err := parseDue(d)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		l.Due = due
+		// Even for admins, a due queue is their own.
+		l.User = u
+		// A due queue spans all of the user's decks unless told otherwise.
+		if l.Query == "" {
+			l.Query = "*"
+		}
 	}
 
-	l := db.ListOp{What: t, User: u, Query: q}
-	ls, err := a.ds.List(l)
-	if err != nil {
-		return http.StatusInternalServerError, err
+	if l.Query == "" || l.What == "" {
+		return http.StatusBadRequest, errors.New("appdDB.list(): Missing expected param.")
 	}
 
-	var b []byte
-	switch ls.(type) {
-	case db.UserList:
-		b, err = json.MarshalIndent(ls.(db.UserList), "", "\t")
-	case db.DeckList:
-		b, err = json.MarshalIndent(ls.(db.DeckList), "", "\t")
-	case db.CardList:
-		b, err = json.MarshalIndent(ls.(db.CardList), "", "\t")
+	if strings.Contains(r.Header.Get("Accept"), ndjson) {
+		return a.stream(w, r, l)
+	}
+
+	ls, status, err := a.page(w, r, l)
+	if err != nil {
+		return status, err
 	}
+
+	b, err := json.MarshalIndent(ls, "", "\t")
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
@@ -120,44 +249,202 @@ func (a *appDB) list(w http.ResponseWriter, r *http.Request) (int, error) {
 	return http.StatusOK, nil
 }
 
-func (a *appDB) store(w http.ResponseWriter, r *http.Request) (int, error) {
-	t := r.URL.Query().Get("type")
-	u := r.URL.Query().Get("user")
-	if u == "" {
-		return http.StatusInternalServerError, errors.New("appDB.store(): Missing user param.")
+// search finds the cards whose front or back has every word in r's q param,
+// best first, in the decks its deck param matches, as list's q does for
+// cards, and that pass its filter param.  Users only search what they can
+// list.
+func (a *appDB) search(w http.ResponseWriter, r *http.Request) (int, error) {
+	q := r.URL.Query().Get("q")
+	if strings.TrimSpace(q) == "" {
+		return http.StatusBadRequest, errors.New("appDB.search(): Missing q param.")
+	}
+	deck := r.URL.Query().Get("deck")
+	if deck == "" {
+		deck = "*"
+	}
+	l := db.ListOp{What: "search", User: scope(r), Query: deck, Search: q,
+		Filter: r.URL.Query().Get("filter")}
+
+	if strings.Contains(r.Header.Get("Accept"), ndjson) {
+		return a.stream(w, r, l)
+	}
+	ls, status, err := a.page(w, r, l)
+	if err != nil {
+		return status, err
 	}
+	return reply(w, http.StatusOK, ls.(db.HitList))
+}
+
+// maxPage is the most results a list request replies with.  Longer lists are
+// paged through by following the Link header of each page to the next.
+const maxPage = 1000
+
+// page lists the page of l that r asks for with its limit and cursor params,
+// and links w to the page after it, if there is one.
+func (a *appDB) page(w http.ResponseWriter, r *http.Request, l db.ListOp) (db.ListStorer, int, error) {
+	limit, err := limitParam(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	l.Limit = maxPage
+	if limit > 0 && limit < maxPage {
+		l.Limit = limit
+	}
+	l.Cursor = r.URL.Query().Get("cursor")
+
+	ls, next, err := db.Page(a.ds, l)
+	if err != nil {
+		return nil, errStatus(err), err
+	}
+	if next != "" {
+		q := r.URL.Query()
+		q.Set("cursor", next)
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, q.Encode()))
+	}
+	return ls, http.StatusOK, nil
+}
+
+// limitParam returns r's limit param, or 0 if it doesn't have one.
+func limitParam(r *http.Request) (int, error) {
+	n := r.URL.Query().Get("limit")
+	if n == "" {
+		return 0, nil
+	}
+	limit, err := strconv.Atoi(n)
+	if err != nil || limit < 0 {
+		return 0, errors.New("appDB.list(): Invalid limit param.")
+	}
+	return limit, nil
+}
+
+// ndjson is the media type of newline-delimited JSON, which list streams to
+// clients that accept it.
+const ndjson = "application/x-ndjson"
 
-	d := json.NewDecoder(r.Body)
+// flushEvery is how many results stream writes between flushes.
+const flushEvery = 100
+
+// stream writes the results of l to w as newline-delimited JSON, a result to
+// a line, as they're read from the DataSource, so that whole tables can be
+// listed without dbd holding them in memory.  Streams aren't paged; r's
+// limit and cursor params only say where they end and start.
+//
+// Once the first result is written the status can't change, so an error
+// after that ends the stream with a line holding the error's apiError.
+func (a *appDB) stream(w http.ResponseWriter, r *http.Request, l db.ListOp) (int, error) {
+	limit, err := limitParam(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	l.Limit = limit
+	l.Cursor = r.URL.Query().Get("cursor")
+
+	w.Header().Set("Content-Type", ndjson)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	err = a.ds.Stream(l, func(v interface{}) error {
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		if n++; flusher != nil && n%flushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && n == 0 {
+		return errStatus(err), err
+	}
+	if err != nil {
+		status := errStatus(err)
+		enc.Encode(apiError{
+			Code:      errorCode(status),
+			Message:   http.StatusText(status),
+			RequestID: requestIDFrom(r),
+		})
+		return http.StatusOK, err
+	}
+	if n == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	return http.StatusOK, nil
+}
+
+// parseDue parses the due param of a list request, which is either "now" or
+// an RFC 3339 timestamp.
+func parseDue(s string) (time.Time, error) {
+	if s == "now" {
+		return time.Now(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("appDB.list(): Invalid due param.")
+	}
+	return t, nil
+}
+
+func (a *appDB) store(w http.ResponseWriter, r *http.Request) (int, error) {
+	t := r.URL.Query().Get("type")
+	u := userFrom(r)
 
 	var ls db.ListStorer
 	switch t {
 	case "users":
-		if u != "admin" {
-			return http.StatusUnauthorized, errors.New("appDB.store(users): only works for admins.")
+		if !isAdmin(r) {
+			return http.StatusForbidden, errors.New("appDB.store(users): only works for admins.")
 		}
 		ul := db.UserList{}
-		if err := d.Decode(&ul); err != nil {
-			return http.StatusInternalServerError, err
+		if err := decode(r, &ul); err != nil {
+			return http.StatusBadRequest, err
 		}
 		ls = ul
 	case "cards":
 		ul := db.CardList{}
-		if err := d.Decode(&ul); err != nil {
-			return http.StatusInternalServerError, err
+		if err := decode(r, &ul); err != nil {
+			return http.StatusBadRequest, err
 		}
 		ls = ul
 	case "decks":
 		ul := db.DeckList{}
-		if err := d.Decode(&ul); err != nil {
-			return http.StatusInternalServerError, err
+		if err := decode(r, &ul); err != nil {
+			return http.StatusBadRequest, err
 		}
 		ls = ul
+	case "groups":
+		gl := db.GroupList{}
+		if err := decode(r, &gl); err != nil {
+			return http.StatusBadRequest, err
+		}
+		ls = gl
+	case "shares":
+		sl := db.ShareList{}
+		if err := decode(r, &sl); err != nil {
+			return http.StatusBadRequest, err
+		}
+		ls = sl
 	default:
-		return http.StatusInternalServerError, errors.New("appDB.store(): Invalid type param.")
+		return http.StatusBadRequest, errors.New("appDB.store(): Invalid type param.")
+	}
+
+	if err := validate(r, ls); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if !isAdmin(r) {
+		if roleFrom(r) == db.RoleLearner {
+			return http.StatusForbidden, errors.New("appDB.store(): Learners can't store anything.")
+		}
+		ok, err := a.owns(u, ls)
+		if err != nil {
+			return errStatus(err), err
+		}
+		if !ok {
+			return http.StatusForbidden, errors.New("appDB.store(): Can only store into your own decks, or decks shared with you to edit.")
+		}
 	}
 
 	if err := a.ds.Store(ls); err != nil {
-		return http.StatusInternalServerError, err
+		return errStatus(err), err
 	}
 
 	fmt.Fprintf(w, `{"message": "stored data"}`)
@@ -165,17 +452,132 @@ func (a *appDB) store(w http.ResponseWriter, r *http.Request) (int, error) {
 	return http.StatusOK, nil
 }
 
+// owns reports whether the user with email u may store everything in ls:
+// groups and shares of decks they own, and cards in decks they own or that
+// have been shared with them to edit.  validate has already checked that
+// decks are their own.
+func (a *appDB) owns(u string, ls db.ListStorer) (bool, error) {
+	u = strings.ToLower(u)
+	switch ls := ls.(type) {
+	case db.GroupList:
+		for _, g := range ls {
+			if strings.ToLower(g.Owner) != u {
+				return false, nil
+			}
+		}
+	case db.ShareList:
+		decks, err := a.ds.List(db.ListOp{What: "decks", User: u, Query: u + ":*"})
+		if err != nil {
+			return false, err
+		}
+		mine := map[int]bool{}
+		for _, d := range decks.(db.DeckList) {
+			mine[d.ID] = d.Owner == u
+		}
+		for _, s := range ls {
+			if !mine[s.DeckID] {
+				return false, nil
+			}
+		}
+	case db.CardList:
+		decks, err := a.ds.List(db.ListOp{What: "decks", User: u, Query: "*"})
+		if err != nil {
+			return false, err
+		}
+		// Cards name their deck by id or by 'email:deck'.
+		mine := map[string]bool{}
+		for _, d := range decks.(db.DeckList) {
+			if d.Access == db.AccessRead {
+				continue
+			}
+			mine[strconv.Itoa(d.ID)] = true
+			mine[d.Owner+":"+d.Name] = true
+		}
+		for _, c := range ls {
+			deck := strings.ToLower(c.Owner)
+			if c.DeckID != 0 {
+				deck = strconv.Itoa(c.DeckID)
+			}
+			if !mine[deck] {
+				return false, nil
+			}
+			// Cards stored with an ID replace that card, which has to be
+			// in one of the user's decks too.
+			if c.ID != 0 {
+				cards, err := a.ds.List(db.ListOp{What: "cards", User: u, Query: "*", ID: c.ID})
+				if err != nil {
+					return false, err
+				}
+				cl := cards.(db.CardList)
+				if len(cl) == 0 || !mine[strconv.Itoa(cl[0].DeckID)] {
+					return false, nil
+				}
+			}
+		}
+	}
+	return true, nil
+}
+
+// review grades a single card, given as {"id": 1, "grade": "good"}, and
+// replies with the card's new due time.  Grades may be numbers from 0 to 5
+// or one of again, hard, good and easy, and must be given: a missing grade
+// isn't taken to be 0, which would reset the card.  An optional
+// "response_ms" records how long the user took to answer in the review log.
+func (a *appDB) review(w http.ResponseWriter, r *http.Request) (int, error) {
+	u := userFrom(r)
+
+	var req struct {
+		ID         int       `json:"id"`
+		Grade      *db.Grade `json:"grade"`
+		ResponseMS int       `json:"response_ms"`
+	}
+	if err := decode(r, &req); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if req.ID == 0 {
+		return http.StatusBadRequest, errors.New("appDB.review(): Missing card id.")
+	}
+	if req.Grade == nil {
+		return http.StatusBadRequest, errors.New("appDB.review(): Missing grade.")
+	}
+
+	c, err := a.ds.Review(db.ReviewOp{
+		CardID:       req.ID,
+		User:         u,
+		Grade:        *req.Grade,
+		At:           time.Now(),
+		ResponseTime: time.Duration(req.ResponseMS) * time.Millisecond,
+	})
+	if err != nil {
+		return errStatus(err), err
+	}
+
+	resp := struct {
+		ID  int       `json:"id"`
+		Due time.Time `json:"due"`
+	}{c.ID, c.Due}
+	b, err := json.MarshalIndent(resp, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Write(b)
+
+	return http.StatusOK, nil
+}
+
 // appHandler server all of this applications web traffic, handling
 // error reporting and any setup that might be needed for our requests.
+// Errors are replied to with a JSON body; see writeError.
 type appHandler func(http.ResponseWriter, *http.Request) (int, error)
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	status, err := fn(w, r)
-	if err != nil {
-		log.Println(err)
-	}
 	if status >= 400 {
-		http.Error(w, http.StatusText(status), status)
+		writeError(w, r, status, err)
+		return
+	}
+	if err != nil {
+		log.Printf("[%s] %v", requestIDFrom(r), err)
 	}
 }
 
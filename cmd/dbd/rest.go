@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/askcarter/spacerep/lib/db"
+	"github.com/gorilla/mux"
+)
+
+// The resource routes do what /list and /store do, one user's decks, deck or
+// card at a time, and can also change and delete them:
+//
+//	PUT, DELETE      /users/{email}
+//	GET, POST        /users/{email}/decks
+//	GET, PUT, DELETE /decks/{id}
+//	GET, POST        /decks/{id}/cards
+//	GET, PUT, DELETE /cards/{id}
+//
+// They follow the same rules about who can see and change what.
+
+// scope returns the user whose view r lists from: everyone's for admins, and
+// otherwise only what the user who made r can see.
+func scope(r *http.Request) string {
+	if isAdmin(r) {
+		return ""
+	}
+	return userFrom(r)
+}
+
+// reply writes v to w as JSON, with the given status.
+func reply(w http.ResponseWriter, status int, v interface{}) (int, error) {
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.WriteHeader(status)
+	w.Write(b)
+	return status, nil
+}
+
+// ownsDeck reports whether the user who made r can change or delete the deck
+// d, as listed for them.
+func ownsDeck(r *http.Request, d db.Deck) bool {
+	return isAdmin(r) || roleFrom(r) != db.RoleLearner && d.Access == ""
+}
+
+// canEdit reports whether the user who made r can change the cards in the
+// deck d, as listed for them.
+func canEdit(r *http.Request, d db.Deck) bool {
+	return isAdmin(r) || roleFrom(r) != db.RoleLearner && d.Access != db.AccessRead
+}
+
+// idVar returns the {id} in r's path.
+func idVar(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		return 0, errors.New("appDB: Invalid id.")
+	}
+	return id, nil
+}
+
+// deck returns the deck named by r's {id}, if the user who made r can see it.
+func (a *appDB) deck(r *http.Request) (db.Deck, int, error) {
+	id, err := idVar(r)
+	if err != nil {
+		return db.Deck{}, http.StatusBadRequest, err
+	}
+	ls, err := a.ds.List(db.ListOp{What: "decks", User: scope(r), Query: "*", ID: id})
+	if err != nil {
+		return db.Deck{}, errStatus(err), err
+	}
+	decks := ls.(db.DeckList)
+	if len(decks) == 0 {
+		return db.Deck{}, http.StatusNotFound, db.ErrNotFound
+	}
+	return decks[0], http.StatusOK, nil
+}
+
+// card returns the card named by r's {id}, and its deck, if the user who made
+// r can see them.
+func (a *appDB) card(r *http.Request) (db.Card, db.Deck, int, error) {
+	id, err := idVar(r)
+	if err != nil {
+		return db.Card{}, db.Deck{}, http.StatusBadRequest, err
+	}
+	ls, err := a.ds.List(db.ListOp{What: "cards", User: scope(r), Query: "*", ID: id})
+	if err != nil {
+		return db.Card{}, db.Deck{}, errStatus(err), err
+	}
+	cards := ls.(db.CardList)
+	if len(cards) == 0 {
+		return db.Card{}, db.Deck{}, http.StatusNotFound, db.ErrNotFound
+	}
+	ls, err = a.ds.List(db.ListOp{What: "decks", User: scope(r), Query: "*", ID: cards[0].DeckID})
+	if err != nil {
+		return db.Card{}, db.Deck{}, errStatus(err), err
+	}
+	decks := ls.(db.DeckList)
+	if len(decks) == 0 {
+		return db.Card{}, db.Deck{}, http.StatusNotFound, db.ErrNotFound
+	}
+	return cards[0], decks[0], http.StatusOK, nil
+}
+
+// updateUser changes the name, and for admins the role, of the user named in
+// the path, given as {"name": "Bill", "role": "editor"}, and replies with
+// them.
+func (a *appDB) updateUser(w http.ResponseWriter, r *http.Request) (int, error) {
+	email := strings.ToLower(mux.Vars(r)["email"])
+	if !isAdmin(r) && email != userFrom(r) {
+		return http.StatusForbidden, errors.New("appDB.updateUser(): Can only change yourself.")
+	}
+
+	var u db.User
+	if err := decode(r, &u); err != nil {
+		return http.StatusBadRequest, err
+	}
+	var v validator
+	if v.user(0, u); v.err() != nil {
+		return http.StatusBadRequest, v.err()
+	}
+	if u.Role != "" && !isAdmin(r) {
+		return http.StatusForbidden, errors.New("appDB.updateUser(): Only admins can change roles.")
+	}
+	u.Email = email
+
+	err := a.ds.Update(db.UserList{u})
+	if err != nil {
+		return errStatus(err), err
+	}
+	ls, err := a.ds.List(db.ListOp{What: "users", Query: email})
+	if err != nil {
+		return errStatus(err), err
+	}
+	users := ls.(db.UserList)
+	if len(users) == 0 {
+		return http.StatusNotFound, db.ErrNotFound
+	}
+	return reply(w, http.StatusOK, users[0])
+}
+
+// deleteUser deletes the user named in the path, and everything they own.
+func (a *appDB) deleteUser(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !isAdmin(r) {
+		return http.StatusForbidden, errors.New("appDB.deleteUser(): Only admins can delete users.")
+	}
+	email := strings.ToLower(mux.Vars(r)["email"])
+	err := a.ds.Delete(db.UserList{{Email: email}})
+	if err != nil {
+		return errStatus(err), err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// userDecks lists the decks of the user named in the path, a page at a time
+// as /list does.
+func (a *appDB) userDecks(w http.ResponseWriter, r *http.Request) (int, error) {
+	email := strings.ToLower(mux.Vars(r)["email"])
+	ls, status, err := a.page(w, r, db.ListOp{What: "decks", User: scope(r), Query: email + ":*"})
+	if err != nil {
+		return status, err
+	}
+	return reply(w, http.StatusOK, ls.(db.DeckList))
+}
+
+// createDeck creates a deck for the user named in the path, from a deck
+// given as {"name": "spanish", "desc": "Words to learn."}, and replies with
+// it.
+func (a *appDB) createDeck(w http.ResponseWriter, r *http.Request) (int, error) {
+	email := strings.ToLower(mux.Vars(r)["email"])
+	if !isAdmin(r) && (email != userFrom(r) || roleFrom(r) == db.RoleLearner) {
+		return http.StatusForbidden, errors.New("appDB.createDeck(): Can only create your own decks.")
+	}
+
+	var d db.Deck
+	if err := decode(r, &d); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if d.Owner != "" && !strings.EqualFold(d.Owner, email) {
+		return http.StatusBadRequest, fmt.Errorf("appDB.createDeck(): Deck owner %q isn't %q.", d.Owner, email)
+	}
+	d.Owner = email
+	d = d.Normalize()
+	if err := validate(r, db.DeckList{d}); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if _, err := a.ds.Role(email); err != nil {
+		return errStatus(err), err
+	}
+	d, err := a.ds.CreateDeck(d)
+	if err != nil {
+		return errStatus(err), err
+	}
+	w.Header().Set("Location", fmt.Sprintf("/decks/%d", d.ID))
+	return reply(w, http.StatusCreated, d)
+}
+
+// getDeck replies with the deck named in the path.
+func (a *appDB) getDeck(w http.ResponseWriter, r *http.Request) (int, error) {
+	d, status, err := a.deck(r)
+	if err != nil {
+		return status, err
+	}
+	return reply(w, http.StatusOK, d)
+}
+
+// updateDeck changes the name, description or scheduler of the deck named in
+// the path, given as a deck, and replies with it.
+func (a *appDB) updateDeck(w http.ResponseWriter, r *http.Request) (int, error) {
+	d, status, err := a.deck(r)
+	if err != nil {
+		return status, err
+	}
+	if !ownsDeck(r, d) {
+		return http.StatusForbidden, errors.New("appDB.updateDeck(): Can only change your own decks.")
+	}
+
+	var nd db.Deck
+	if err := decode(r, &nd); err != nil {
+		return http.StatusBadRequest, err
+	}
+	var v validator
+	if v.deck(0, nd); v.err() != nil {
+		return http.StatusBadRequest, v.err()
+	}
+	if nd.ID != 0 && nd.ID != d.ID {
+		return http.StatusBadRequest, fmt.Errorf("appDB.updateDeck(): Deck %d isn't %d.", nd.ID, d.ID)
+	}
+	if nd.Owner != "" && !strings.EqualFold(nd.Owner, d.Owner) {
+		return http.StatusBadRequest, errors.New("appDB.updateDeck(): A deck's owner can't be changed.")
+	}
+	nd.ID = d.ID
+
+	err = a.ds.Update(db.DeckList{nd})
+	if err != nil {
+		return errStatus(err), err
+	}
+	if d, status, err = a.deck(r); err != nil {
+		return status, err
+	}
+	return reply(w, http.StatusOK, d)
+}
+
+// deleteDeck deletes the deck named in the path, and its cards.
+func (a *appDB) deleteDeck(w http.ResponseWriter, r *http.Request) (int, error) {
+	d, status, err := a.deck(r)
+	if err != nil {
+		return status, err
+	}
+	if !ownsDeck(r, d) {
+		return http.StatusForbidden, errors.New("appDB.deleteDeck(): Can only delete your own decks.")
+	}
+	err = a.ds.Delete(db.DeckList{{ID: d.ID}})
+	if err != nil {
+		return errStatus(err), err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// deckCards lists the cards in the deck named in the path that pass the
+// filter param, a page at a time as /list does.
+func (a *appDB) deckCards(w http.ResponseWriter, r *http.Request) (int, error) {
+	d, status, err := a.deck(r)
+	if err != nil {
+		return status, err
+	}
+	l := db.ListOp{What: "cards", User: scope(r), Query: d.Owner + ":" + d.Name,
+		Filter: r.URL.Query().Get("filter")}
+	ls, status, err := a.page(w, r, l)
+	if err != nil {
+		return status, err
+	}
+	return reply(w, http.StatusOK, ls.(db.CardList))
+}
+
+// createCard adds a card, given as {"front": "adonde", "back": "where"}, to
+// the deck named in the path, and replies with it.
+func (a *appDB) createCard(w http.ResponseWriter, r *http.Request) (int, error) {
+	d, status, err := a.deck(r)
+	if err != nil {
+		return status, err
+	}
+	if !canEdit(r, d) {
+		return http.StatusForbidden, errors.New("appDB.createCard(): Can only add cards to your own decks, or decks shared with you to edit.")
+	}
+
+	var c db.Card
+	if err := decode(r, &c); err != nil {
+		return http.StatusBadRequest, err
+	}
+	if c.DeckID != 0 && c.DeckID != d.ID {
+		return http.StatusBadRequest, fmt.Errorf("appDB.createCard(): Card is for deck %d, not %d.", c.DeckID, d.ID)
+	}
+	c.ID, c.DeckID, c.Owner = 0, d.ID, ""
+	if err := validate(r, db.CardList{c}); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	cl := db.CardList{c}
+	if err := a.ds.Store(cl); err != nil {
+		return errStatus(err), err
+	}
+	ls, err := a.ds.List(db.ListOp{What: "cards", Query: "*", ID: cl[0].ID})
+	if err != nil {
+		return errStatus(err), err
+	}
+	cards := ls.(db.CardList)
+	if len(cards) == 0 {
+		return http.StatusInternalServerError, fmt.Errorf("appDB.createCard(): Card %d went missing.", cl[0].ID)
+	}
+	w.Header().Set("Location", fmt.Sprintf("/cards/%d", cards[0].ID))
+	return reply(w, http.StatusCreated, cards[0])
+}
+
+// getCard replies with the card named in the path.
+func (a *appDB) getCard(w http.ResponseWriter, r *http.Request) (int, error) {
+	c, _, status, err := a.card(r)
+	if err != nil {
+		return status, err
+	}
+	return reply(w, http.StatusOK, c)
+}
+
+// updateCard changes the front and back of the card named in the path, given
+// as {"front": "adonde", "back": "where"}, and replies with it.  Adding a
+// "deck_id" moves the card to that deck.  The card keeps its schedule.
+func (a *appDB) updateCard(w http.ResponseWriter, r *http.Request) (int, error) {
+	c, d, status, err := a.card(r)
+	if err != nil {
+		return status, err
+	}
+	if !canEdit(r, d) {
+		return http.StatusForbidden, errors.New("appDB.updateCard(): Can only change cards in your own decks, or decks shared with you to edit.")
+	}
+
+	var nc db.Card
+	if err := decode(r, &nc); err != nil {
+		return http.StatusBadRequest, err
+	}
+	var v validator
+	if v.card(0, nc); v.err() != nil {
+		return http.StatusBadRequest, v.err()
+	}
+	if nc.ID != 0 && nc.ID != c.ID {
+		return http.StatusBadRequest, fmt.Errorf("appDB.updateCard(): Card %d isn't %d.", nc.ID, c.ID)
+	}
+	if nc.DeckID != 0 && nc.DeckID != c.DeckID {
+		ls, err := a.ds.List(db.ListOp{What: "decks", User: scope(r), Query: "*", ID: nc.DeckID})
+		if err != nil {
+			return errStatus(err), err
+		}
+		decks := ls.(db.DeckList)
+		if len(decks) == 0 || !canEdit(r, decks[0]) {
+			return http.StatusForbidden, errors.New("appDB.updateCard(): Can only move cards to your own decks, or decks shared with you to edit.")
+		}
+	}
+	nc.ID = c.ID
+
+	err = a.ds.Update(db.CardList{nc})
+	if err != nil {
+		return errStatus(err), err
+	}
+	if c, _, status, err = a.card(r); err != nil {
+		return status, err
+	}
+	return reply(w, http.StatusOK, c)
+}
+
+// deleteCard deletes the card named in the path.
+func (a *appDB) deleteCard(w http.ResponseWriter, r *http.Request) (int, error) {
+	c, d, status, err := a.card(r)
+	if err != nil {
+		return status, err
+	}
+	if !canEdit(r, d) {
+		return http.StatusForbidden, errors.New("appDB.deleteCard(): Can only delete cards in your own decks, or decks shared with you to edit.")
+	}
+	err = a.ds.Delete(db.CardList{{ID: c.ID}})
+	if err != nil {
+		return errStatus(err), err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// deleteGroup deletes the group named in the path, and the shares made to it.
+// Only its owner and admins can delete a group; its members can only see it.
+func (a *appDB) deleteGroup(w http.ResponseWriter, r *http.Request) (int, error) {
+	name := strings.ToLower(mux.Vars(r)["name"])
+	ls, err := a.ds.List(db.ListOp{What: "groups", User: scope(r), Query: name})
+	if err != nil {
+		return errStatus(err), err
+	}
+	var g *db.Group
+	for _, lg := range ls.(db.GroupList) {
+		if lg.Name == name {
+			g = &lg
+		}
+	}
+	if g == nil {
+		return http.StatusNotFound, db.ErrNotFound
+	}
+	if !isAdmin(r) {
+		ok, err := a.owns(userFrom(r), db.GroupList{*g})
+		if err != nil {
+			return errStatus(err), err
+		}
+		if !ok {
+			return http.StatusForbidden, errors.New("appDB.deleteGroup(): Can only delete your own groups.")
+		}
+	}
+	err = a.ds.Delete(db.GroupList{{Name: g.Name}})
+	if err != nil {
+		return errStatus(err), err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// deleteShare stops sharing the deck named in the path with the user or the
+// group in its user or group param.  Only the deck's owner and admins can
+// stop sharing it.
+func (a *appDB) deleteShare(w http.ResponseWriter, r *http.Request) (int, error) {
+	d, status, err := a.deck(r)
+	if err != nil {
+		return status, err
+	}
+	q := r.URL.Query()
+	s := db.Share{DeckID: d.ID, User: q.Get("user"), Group: q.Get("group")}
+	if (s.User == "") == (s.Group == "") {
+		return http.StatusBadRequest, errors.New("appDB.deleteShare(): Need either a user or a group param.")
+	}
+	if !isAdmin(r) {
+		ok, err := a.owns(userFrom(r), db.ShareList{s})
+		if err != nil {
+			return errStatus(err), err
+		}
+		if !ok || roleFrom(r) == db.RoleLearner {
+			return http.StatusForbidden, errors.New("appDB.deleteShare(): Can only stop sharing your own decks.")
+		}
+	}
+	err = a.ds.Delete(db.ShareList{s})
+	if err != nil {
+		return errStatus(err), err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"unicode"
+
+	"github.com/askcarter/spacerep/lib/db"
+)
+
+// The longest that the text fields of users, decks and cards can be, in
+// bytes.
+const (
+	maxName = 200
+	maxDesc = 2000
+	maxSide = 10000
+	maxTag  = 50
+)
+
+// maxTags is the most tags a card can have.
+const maxTags = 20
+
+// decode decodes the JSON body of r into v, refusing fields v doesn't have,
+// so that typos aren't silently dropped.
+func decode(r *http.Request, v interface{}) error {
+	d := json.NewDecoder(r.Body)
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+// fieldError says what's wrong with one field of the element at Index of a
+// payload.  Single users, decks and cards are at index 0.
+type fieldError struct {
+	Index   int    `json:"index"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// invalidError lists everything that's wrong with a payload.  writeError
+// replies with the list, so that clients can fix every element at once.
+type invalidError []fieldError
+
+func (e invalidError) Error() string {
+	msgs := make([]string, len(e))
+	for i, fe := range e {
+		msgs[i] = fmt.Sprintf("%d.%s %s", fe.Index, fe.Field, fe.Message)
+	}
+	return "appDB.validate(): Invalid payload: " + strings.Join(msgs, "; ") + "."
+}
+
+// A rule checks the value of a field, and returns what's wrong with it, if
+// anything.
+type rule func(v string) string
+
+func required(v string) string {
+	if strings.TrimSpace(v) == "" {
+		return "is required"
+	}
+	return ""
+}
+
+func maxLen(n int) rule {
+	return func(v string) string {
+		if len(v) > n {
+			return fmt.Sprintf("must be at most %d bytes", n)
+		}
+		return ""
+	}
+}
+
+// oneOf allows the given values, or no value at all.
+func oneOf(vals ...string) rule {
+	return func(v string) string {
+		if v == "" {
+			return ""
+		}
+		for _, ok := range vals {
+			if v == ok {
+				return ""
+			}
+		}
+		return fmt.Sprintf("must be one of %s", strings.Join(vals, ", "))
+	}
+}
+
+func email(v string) string {
+	a, err := mail.ParseAddress(v)
+	if err != nil || a.Address != v {
+		return "must be an email address"
+	}
+	return ""
+}
+
+// tag allows the tags lib/db stores: letters, digits and "-_.:/".
+func tag(v string) string {
+	for _, c := range v {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) && !strings.ContainsRune("-_.:/", c) {
+			return "must only have letters, digits and -_.:/"
+		}
+	}
+	return ""
+}
+
+// validator collects the fieldErrors of a payload.
+type validator struct {
+	errs invalidError
+}
+
+// check checks value against rules in turn, and records what the first
+// one that fails says about field of the element at i.
+func (v *validator) check(i int, field, value string, rules ...rule) {
+	for _, r := range rules {
+		if msg := r(value); msg != "" {
+			v.fail(i, field, msg)
+			return
+		}
+	}
+}
+
+func (v *validator) fail(i int, field, msg string) {
+	v.errs = append(v.errs, fieldError{i, field, msg})
+}
+
+// err returns the invalidError of everything recorded, or nil.
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return v.errs
+}
+
+// user checks the fields of u that can be changed once it's stored.
+func (v *validator) user(i int, u db.User) {
+	v.check(i, "name", u.Name, maxLen(maxName))
+	v.check(i, "role", u.Role, oneOf(db.RoleAdmin, db.RoleEditor, db.RoleLearner))
+	if u.Password != "" {
+		v.fail(i, "password", "can't be stored; use /password")
+	}
+}
+
+// deck checks the fields of d that can be changed once it's stored.
+func (v *validator) deck(i int, d db.Deck) {
+	d = d.Normalize()
+	v.check(i, "name", d.Name, required, maxLen(maxName))
+	v.check(i, "desc", d.Desc, maxLen(maxDesc))
+	if _, err := db.NewScheduler(d.Scheduler, d.Params); err != nil {
+		v.fail(i, "scheduler", err.Error())
+	}
+}
+
+// card checks the fields of c that can be changed once it's stored.
+func (v *validator) card(i int, c db.Card) {
+	v.check(i, "front", c.Front, required, maxLen(maxSide))
+	v.check(i, "back", c.Back, required, maxLen(maxSide))
+	if len(c.Tags) > maxTags {
+		v.fail(i, "tags", fmt.Sprintf("can't be more than %d", maxTags))
+	} else {
+		for _, t := range c.Tags {
+			v.check(i, "tags", t, required, maxLen(maxTag), tag)
+		}
+	}
+	if c.DeckID < 0 {
+		v.fail(i, "deck_id", "must be positive")
+	}
+	if c.Ease < 0 || c.Interval < 0 || c.Reps < 0 || c.Box < 0 {
+		v.fail(i, "schedule", "can't be negative")
+	}
+}
+
+// validate checks every user, deck or card in ls, as stored by the user that
+// made r, and returns an invalidError listing every field that's wrong.
+// Nothing should be stored unless it returns nil.
+func validate(r *http.Request, ls db.ListStorer) error {
+	var v validator
+	switch ls := ls.(type) {
+	case db.UserList:
+		for i, u := range ls {
+			v.check(i, "email", u.Email, required, email, maxLen(maxName))
+			v.user(i, u)
+		}
+	case db.DeckList:
+		for i, d := range ls {
+			v.deck(i, d)
+			owner := d.Normalize().Owner
+			v.check(i, "owner", owner, required)
+			if owner != "" && !isAdmin(r) && owner != strings.ToLower(userFrom(r)) {
+				v.fail(i, "owner", fmt.Sprintf("must be %q", userFrom(r)))
+			}
+		}
+	case db.CardList:
+		for i, c := range ls {
+			v.card(i, c)
+			if c.DeckID == 0 {
+				if j := strings.Index(c.Owner, ":"); j < 1 || j == len(c.Owner)-1 {
+					v.fail(i, "owner", "must be 'email:deck' when there's no deck_id")
+				}
+			}
+		}
+	}
+	return v.err()
+}
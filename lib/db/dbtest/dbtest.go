@@ -0,0 +1,1513 @@
+// Package dbtest checks that a db.DataSource behaves the way dbd expects
+// every backend to.
+package dbtest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/askcarter/spacerep/lib/db"
+	"github.com/askcarter/test"
+)
+
+// RunConformance runs the DataSource conformance suite, as subtests of t.
+// Each test gets a new, empty, open DataSource from newDataSource, which
+// should arrange for it to be cleaned up when the test is done.
+//
+// The Init test reads ./testdata, so it must be run from lib/db (or a
+// directory with the same test data).
+func RunConformance(t *testing.T, newDataSource func(t *testing.T) db.DataSource) {
+	for _, tt := range cases {
+		tt := tt
+		t.Run(tt.desc, func(t *testing.T) {
+			tt.fn(t, newDataSource(t))
+		})
+	}
+}
+
+var cases = []struct {
+	desc string
+	fn   func(t *testing.T, ds db.DataSource)
+}{
+	{"User List/Store",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			want := db.UserList{
+				{Email: "user1@test.com", Name: "Bill", Password: "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"},
+				{Email: "user2@test.com", Name: "Jill", Password: "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"},
+			}
+			err := ds.Store(want)
+			c.Expect(test.EQ, nil, err)
+
+			// Listed users never have a password.
+			got, err := ds.List(db.ListOp{What: "users", Query: "user1@test.com"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.UserList{{Email: "user1@test.com", Name: "Bill", Role: db.RoleEditor}}, got)
+
+			want = append(want, db.User{Email: "user3@test.com", Name: "John", Password: "$2a$10$KgFhp4HAaBCRAYbFp5XYUOKrbO90yrpUQte4eyafk4Tu6mnZcNWiK"})
+			err = ds.Store(want)
+			c.Expect(test.EQ, nil, err)
+
+			got, err = ds.List(db.ListOp{What: "users", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.UserList{
+				{Email: "user1@test.com", Name: "Bill", Role: db.RoleEditor},
+				{Email: "user2@test.com", Name: "Jill", Role: db.RoleEditor},
+				{Email: "user3@test.com", Name: "John", Role: db.RoleEditor},
+			}, got)
+
+			// Their hashes are only available through Credentials.
+			hash, err := ds.Credentials("User3@test.com")
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, want[2].Password, hash)
+
+			_, err = ds.Credentials("nobody@test.com")
+			c.Expect(test.EQ, db.ErrNotFound, err)
+
+			// Storing a user without a password keeps the one they had.
+			err = ds.Store(db.UserList{{Email: "user3@test.com", Name: "Johnny"}})
+			c.Expect(test.EQ, nil, err)
+			hash, err = ds.Credentials("user3@test.com")
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, want[2].Password, hash)
+
+			err = ds.SetCredentials("USER3@test.com", "new hash")
+			c.Expect(test.EQ, nil, err)
+			hash, err = ds.Credentials("user3@test.com")
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, "new hash", hash)
+
+			err = ds.SetCredentials("nobody@test.com", "new hash")
+			c.Expect(test.EQ, db.ErrNotFound, err)
+		}},
+
+	{"CreateUser never replaces a user",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			err := ds.CreateUser(db.User{Email: "User1@test.com", Name: "Bill", Password: "first hash"})
+			c.Expect(test.EQ, nil, err)
+
+			err = ds.CreateUser(db.User{Email: "user1@test.com", Name: "Mallory", Password: "second hash"})
+			c.Expect(test.EQ, true, errors.Is(err, db.ErrConflict))
+
+			hash, err := ds.Credentials("user1@test.com")
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, "first hash", hash)
+			got, err := ds.List(db.ListOp{What: "users", Query: "user1@test.com"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.UserList{
+				{Email: "user1@test.com", Name: "Bill", Role: db.RoleEditor},
+			}, got)
+
+			err = ds.CreateUser(db.User{Email: "user2@test.com", Role: "root"})
+			c.Expect(test.EQ, true, errors.Is(err, db.ErrInvalid))
+		}},
+
+	{"CreateDeck never replaces a deck",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:")
+			d, err := ds.CreateDeck(db.Deck{Owner: "User1", Name: "Spanish", Desc: "First."})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.NE, 0, d.ID)
+			c.Expect(test.EQ, "user1", d.Owner)
+
+			_, err = ds.CreateDeck(db.Deck{Owner: "user1", Name: "spanish", Desc: "Second."})
+			c.Expect(test.EQ, true, errors.Is(err, db.ErrConflict))
+			got, err := ds.List(db.ListOp{What: "decks", Query: "user1:spanish"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{d}, got)
+
+			// Decks created at once are each created, or conflict, once.
+			errs := make(chan error, 8)
+			for i := 0; i < cap(errs); i++ {
+				go func() {
+					_, err := ds.CreateDeck(db.Deck{Owner: "user1", Name: "french"})
+					errs <- err
+				}()
+			}
+			created := 0
+			for i := 0; i < cap(errs); i++ {
+				err := <-errs
+				if err == nil {
+					created++
+				} else if !errors.Is(err, db.ErrConflict) {
+					t.Errorf("CreateDeck: got %v, want nil or %v", err, db.ErrConflict)
+				}
+			}
+			c.Expect(test.EQ, 1, created)
+
+			_, err = ds.CreateDeck(db.Deck{Owner: "nobody", Name: "spanish"})
+			c.Expect(test.EQ, true, errors.Is(err, db.ErrInvalid))
+			_, err = ds.CreateDeck(db.Deck{Owner: "user1", Name: "x", Scheduler: "anki"})
+			c.Expect(test.EQ, true, errors.Is(err, db.ErrInvalid))
+		}},
+
+	{"Deck List/Store",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "test1:", "test2:")
+
+			want := db.DeckList{
+				{Owner: "test1", Name: "deck1", Desc: "The meaning of life."},
+				{Owner: "test1", Name: "deck2", Desc: "Essential Camus quotes."},
+			}
+			err := ds.Store(want)
+			c.Expect(test.EQ, nil, err)
+
+			got, err := ds.List(db.ListOp{What: "decks", Query: "test1:deck1"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, ignoreDeckIDs(want[:1]), ignoreDeckIDs(got))
+
+			// Legacy 'owner:name' decks are split up.
+			err = ds.Store(db.DeckList{{Name: "Test2:Deck2", Desc: "Kayne updates."}})
+			c.Expect(test.EQ, nil, err)
+			want = append(want, db.Deck{Owner: "test2", Name: "deck2", Desc: "Kayne updates."})
+
+			got, err = ds.List(db.ListOp{What: "decks", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, ignoreDeckIDs(want), ignoreDeckIDs(got))
+
+			// Storing a deck again replaces it.
+			want[0].Desc = "42"
+			err = ds.Store(want[:1])
+			c.Expect(test.EQ, nil, err)
+
+			got, err = ds.List(db.ListOp{What: "decks", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, ignoreDeckIDs(want), ignoreDeckIDs(got))
+
+			// Decks need an owner.
+			err = ds.Store(db.DeckList{{Owner: "nobody", Name: "deck1"}})
+			c.Expect(test.NE, nil, err)
+		}},
+
+	{"Card List/Store",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			want := db.CardList{
+				{Owner: "user1:deck1", Front: "big", Back: "small"},
+				{Owner: "user1:deck1", Front: "tall", Back: "short"},
+				{Owner: "user1:deck1", Front: "ugly", Back: "pretty"},
+				{Owner: "user1:deck2", Front: "sky", Back: "blue"},
+				{Owner: "user1:deck2", Front: "grass", Back: "green"},
+				{Owner: "user2:deck1", Front: "peanut butter", Back: "jelly"},
+				{Owner: "user2:deck1", Front: "sausage", Back: "egg"},
+				{Owner: "user2:deck1", Front: "burger", Back: "fries"},
+			}
+			storeOwners(t, ds, "user1:deck1", "user1:deck2", "user2:deck1")
+			err := ds.Store(want)
+			c.Expect(test.EQ, nil, err)
+
+			got, err := ds.List(db.ListOp{What: "cards", Query: "user1:*"})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, want[:5], got.(db.CardList))
+
+			// Cards can name their deck by id instead of owner.
+			deckID := got.(db.CardList)[0].DeckID
+			c.Expect(test.NE, 0, deckID)
+			card := db.Card{DeckID: deckID, Front: "chicken", Back: "waffles"}
+			err = ds.Store(db.CardList{card})
+			c.Expect(test.EQ, nil, err)
+			card.Owner = "user1:deck1"
+			want = append(want[:3], append(db.CardList{card}, want[3:]...)...)
+
+			got, err = ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, want, got.(db.CardList))
+
+			// Cards need a deck.
+			err = ds.Store(db.CardList{{Owner: "user1:nodeck", Front: "x", Back: "y"}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Store(db.CardList{{DeckID: 1000, Front: "x", Back: "y"}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Store(db.CardList{{Front: "x", Back: "y"}})
+			c.Expect(test.NE, nil, err)
+		}},
+
+	{"Deleting a user deletes their decks and cards",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:deck1", "user2:deck1")
+			err := ds.Store(db.CardList{
+				{Owner: "user1:deck1", Front: "big", Back: "small"},
+				{Owner: "user2:deck1", Front: "sky", Back: "blue"},
+			})
+			c.Expect(test.EQ, nil, err)
+
+			err = ds.Delete(db.UserList{{Email: "user1"}})
+			c.Expect(test.EQ, nil, err)
+
+			got, err := ds.List(db.ListOp{What: "decks", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{{Owner: "user2", Name: "deck1"}}, ignoreDeckIDs(got))
+
+			got, err = ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, db.CardList{{Owner: "user2:deck1", Front: "sky", Back: "blue"}}, got.(db.CardList))
+		}},
+
+	{"Card schedule round trip",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:deck1", "user1:deck2")
+
+			due := time.Date(2016, 6, 8, 20, 24, 47, 0, time.UTC)
+			want := db.CardList{
+				{Owner: "user1:deck1", Front: "big", Back: "small", Due: due, Ease: 2.36, Interval: 15, Reps: 3},
+			}
+			err := ds.Store(want)
+			c.Expect(test.EQ, nil, err)
+
+			// Cards stored without a schedule are new, and due right away.
+			before := time.Now().Add(-time.Second)
+			err = ds.Store(db.CardList{{Owner: "user1:deck2", Front: "sky", Back: "blue"}})
+			c.Expect(test.EQ, nil, err)
+
+			got, err := ds.List(db.ListOp{What: "cards", Query: "user1:*"})
+			c.Expect(test.EQ, nil, err)
+			cl := got.(db.CardList)
+			if len(cl) != 2 {
+				t.Fatalf("Expected 2 cards, got %v", cl)
+			}
+
+			c.Expect(test.EQ, true, want[0].Due.Equal(cl[0].Due))
+			c.Expect(test.EQ, want[0].Ease, cl[0].Ease)
+			c.Expect(test.EQ, want[0].Interval, cl[0].Interval)
+			c.Expect(test.EQ, want[0].Reps, cl[0].Reps)
+
+			c.Expect(test.EQ, true, cl[1].Due.After(before))
+			c.Expect(test.EQ, db.DefaultEase, cl[1].Ease)
+			c.Expect(test.EQ, 0, cl[1].Interval)
+			c.Expect(test.EQ, 0, cl[1].Reps)
+		}},
+
+	{"Card Review",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1@test.com:deck1")
+			err := ds.Store(db.CardList{{Owner: "user1@test.com:deck1", Front: "big", Back: "small"}})
+			c.Expect(test.EQ, nil, err)
+
+			got, err := ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			id := got.(db.CardList)[0].ID
+
+			now := time.Date(2016, 6, 8, 20, 24, 47, 0, time.UTC)
+			card, err := ds.Review(db.ReviewOp{CardID: id, User: "User1@test.com", Grade: db.Good, At: now, ResponseTime: 1500 * time.Millisecond})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, id, card.ID)
+			c.Expect(test.EQ, 1, card.Interval)
+			c.Expect(test.EQ, true, now.Add(db.Day).Equal(card.Due))
+
+			got, err = ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			stored := got.(db.CardList)[0]
+			c.Expect(test.EQ, card.Reps, stored.Reps)
+			c.Expect(test.EQ, card.Ease, stored.Ease)
+			c.Expect(test.EQ, true, card.Due.Equal(stored.Due))
+
+			_, err = ds.Review(db.ReviewOp{CardID: id + 100, Grade: db.Good, At: now})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+
+			_, err = ds.Review(db.ReviewOp{CardID: id, User: "user1@test.com", Grade: db.Again, At: now.Add(db.Day)})
+			c.Expect(test.EQ, nil, err)
+
+			got, err = ds.List(db.ListOp{What: "reviews", Query: "user1@test.com"})
+			c.Expect(test.EQ, nil, err)
+			want := db.ReviewList{
+				{CardID: id, User: "user1@test.com", Grade: db.Good, At: now, PrevInterval: 0, NextInterval: 1, ResponseMS: 1500},
+				{CardID: id, User: "user1@test.com", Grade: db.Again, At: now.Add(db.Day), PrevInterval: 1, NextInterval: 1},
+			}
+			log := got.(db.ReviewList)
+			if len(log) != len(want) {
+				t.Fatalf("Length mismatch.  \nExpect: %v  \nActual: %v", want, log)
+			}
+			for i := range want {
+				c.Expect(test.EQ, true, want[i].At.Equal(log[i].At))
+				want[i].ID, want[i].At = log[i].ID, log[i].At
+				c.Expect(test.EQ, want[i], log[i])
+			}
+		}},
+
+	{"Due Card List",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:deck1", "user1:deck2", "user2:deck1")
+
+			now := time.Date(2016, 6, 8, 20, 24, 47, 0, time.UTC)
+			cards := db.CardList{
+				{Owner: "user1:deck1", Front: "later", Back: "due tomorrow", Due: now.Add(db.Day)},
+				{Owner: "user1:deck1", Front: "second", Back: "due an hour ago", Due: now.Add(-time.Hour)},
+				{Owner: "user1:deck2", Front: "first", Back: "due yesterday", Due: now.Add(-db.Day)},
+				{Owner: "user1:deck2", Front: "third", Back: "due now", Due: now},
+				{Owner: "user2:deck1", Front: "other", Back: "someone else's", Due: now.Add(-db.Day)},
+			}
+			err := ds.Store(cards)
+			c.Expect(test.EQ, nil, err)
+
+			got, err := ds.List(db.ListOp{What: "cards", User: "user1", Query: "*", Due: now})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, db.CardList{cards[2], cards[1], cards[3]}, got.(db.CardList))
+
+			got, err = ds.List(db.ListOp{What: "cards", User: "user1", Query: "*", Due: now, Limit: 2})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, db.CardList{cards[2], cards[1]}, got.(db.CardList))
+
+			got, err = ds.List(db.ListOp{What: "cards", User: "user1", Query: "user1:deck1", Due: now})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, db.CardList{cards[1]}, got.(db.CardList))
+		}},
+
+	{"Page through lists",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:deck1", "user1:deck2", "user2:deck1", "user3:", "user4:")
+			now := time.Date(2016, 6, 8, 20, 24, 47, 0, time.UTC)
+			var cards db.CardList
+			for i := 0; i < 7; i++ {
+				cards = append(cards, db.Card{
+					Owner: []string{"user1:deck1", "user1:deck2", "user2:deck1"}[i%3],
+					Front: fmt.Sprint("front", i), Back: "back",
+					// Some cards are due at the same time, so that the
+					// due queue needs their IDs to page through them.
+					Due: now.Add(time.Duration(i/2) * time.Hour),
+				})
+			}
+			err := ds.Store(cards)
+			c.Expect(test.EQ, nil, err)
+			err = ds.Store(db.ShareList{
+				{DeckID: 1, User: "user2", Access: db.AccessRead},
+				{DeckID: 1, User: "user3", Access: db.AccessRead},
+				{DeckID: 2, User: "user3", Access: db.AccessEdit},
+			})
+			c.Expect(test.EQ, nil, err)
+
+			// Every page but the last is full, and together they list
+			// the same as List does.
+			for _, l := range []db.ListOp{
+				{What: "users", Query: "*"},
+				{What: "decks", Query: "*"},
+				{What: "cards", Query: "*"},
+				{What: "cards", User: "user2", Query: "*"},
+				{What: "cards", Query: "*", Due: now.Add(db.Day)},
+				{What: "shares", Query: "*"},
+			} {
+				want, err := ds.List(l)
+				c.Expect(test.EQ, nil, err)
+
+				// Results are compared as JSON, so that pages of any type
+				// can be joined.
+				var all []json.RawMessage
+				l.Limit = 2
+				for {
+					got, next, err := db.Page(ds, l)
+					c.Expect(test.EQ, nil, err)
+					var page []json.RawMessage
+					b, _ := json.Marshal(got)
+					json.Unmarshal(b, &page)
+					c.Expect(test.EQ, true, len(page) <= l.Limit)
+					all = append(all, page...)
+					if next == "" {
+						break
+					}
+					l.Cursor = next
+				}
+				var w []json.RawMessage
+				b, _ := json.Marshal(want)
+				json.Unmarshal(b, &w)
+				c.Expect(test.EQ, w, all)
+			}
+
+			// A page's cursor still works once its last result is gone.
+			l := db.ListOp{What: "cards", Query: "*", Limit: 3}
+			first, next, err := db.Page(ds, l)
+			c.Expect(test.EQ, nil, err)
+			err = ds.Delete(db.CardList{{ID: first.(db.CardList)[2].ID}})
+			c.Expect(test.EQ, nil, err)
+			l.Cursor = next
+			got, _, err := db.Page(ds, l)
+			c.Expect(test.EQ, nil, err)
+			all, err := ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, all.(db.CardList)[2:5], got.(db.CardList))
+
+			for _, cursor := range []string{"nonsense", "WyJ1c2VyMSJd", "WzFd"} {
+				_, err = ds.List(db.ListOp{What: "cards", Query: "*", Cursor: cursor})
+				if !errors.Is(err, db.ErrInvalid) {
+					t.Errorf("List with cursor %q: got %v, want %v", cursor, err, db.ErrInvalid)
+				}
+			}
+		}},
+
+	{"Text is listed in byte order",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			// Orders that follow a locale would put "ab" first, since
+			// they skip punctuation.
+			storeOwners(t, ds, "user1:ab", "user1:a_d", "user1:a.b", "user1:a-c")
+			want := []string{"a-c", "a.b", "a_d", "ab"}
+
+			got, err := ds.List(db.ListOp{What: "decks", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			var names []string
+			for _, d := range got.(db.DeckList) {
+				names = append(names, d.Name)
+			}
+			c.Expect(test.EQ, want, names)
+
+			// Cursors follow the same order.
+			names = nil
+			l := db.ListOp{What: "decks", Query: "*", Limit: 1}
+			for {
+				got, next, err := db.Page(ds, l)
+				c.Expect(test.EQ, nil, err)
+				for _, d := range got.(db.DeckList) {
+					names = append(names, d.Name)
+				}
+				if next == "" || len(names) > len(want) {
+					break
+				}
+				l.Cursor = next
+			}
+			c.Expect(test.EQ, want, names)
+		}},
+
+	{"Stream lists what List does",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:deck1", "user2:deck1")
+			err := ds.Store(db.CardList{
+				{Owner: "user1:deck1", Front: "a", Back: "b"},
+				{Owner: "user1:deck1", Front: "c", Back: "d"},
+				{Owner: "user2:deck1", Front: "e", Back: "f"},
+			})
+			c.Expect(test.EQ, nil, err)
+
+			for _, l := range []db.ListOp{
+				{What: "users", Query: "*"},
+				{What: "decks", Query: "*"},
+				{What: "cards", Query: "*"},
+				{What: "cards", User: "user1", Query: "*", Limit: 1},
+			} {
+				want, err := ds.List(l)
+				c.Expect(test.EQ, nil, err)
+				var got []interface{}
+				err = ds.Stream(l, func(v interface{}) error {
+					got = append(got, v)
+					return nil
+				})
+				c.Expect(test.EQ, nil, err)
+				b, _ := json.Marshal(got)
+				w, _ := json.Marshal(want)
+				c.Expect(test.EQ, string(w), string(b))
+			}
+
+			// Streaming stops at fn's first error.
+			stop := errors.New("stop")
+			n := 0
+			err = ds.Stream(db.ListOp{What: "cards", Query: "*"}, func(v interface{}) error {
+				n++
+				return stop
+			})
+			c.Expect(test.EQ, stop, err)
+			c.Expect(test.EQ, 1, n)
+
+			err = ds.Stream(db.ListOp{What: "unknown", Query: "*"}, func(interface{}) error { return nil })
+			c.Expect(test.EQ, true, errors.Is(err, db.ErrInvalid))
+		}},
+
+	{"Stores can be made while a stream is open",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			// Streams are read as slowly as their clients read them, which
+			// mustn't hold up everyone else's writes.
+			storeOwners(t, ds, "user1:deck1")
+			err := ds.Store(db.CardList{
+				{Owner: "user1:deck1", Front: "a", Back: "b"},
+				{Owner: "user1:deck1", Front: "c", Back: "d"},
+			})
+			c.Expect(test.EQ, nil, err)
+
+			n := 0
+			err = ds.Stream(db.ListOp{What: "cards", Query: "*"}, func(v interface{}) error {
+				n++
+				done := make(chan error, 1)
+				go func() {
+					done <- ds.Store(db.CardList{{Owner: "user1:deck1", Front: fmt.Sprint(n), Back: "x"}})
+				}()
+				select {
+				case err := <-done:
+					return err
+				case <-time.After(2 * time.Second):
+					return errors.New("store blocked by the open stream")
+				}
+			})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, true, n >= 2)
+
+			got, err := ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 2+n, len(got.(db.CardList)))
+		}},
+
+	{"Search finds cards by their front and back",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:deck1", "user1:deck2", "user2:deck1")
+			cards := db.CardList{
+				{Owner: "user1:deck1", Front: "the capital of France", Back: "Paris"},
+				{Owner: "user1:deck1", Front: "Paris in the spring", Back: "Paris is lovely in the spring, Paris!"},
+				{Owner: "user1:deck2", Front: "hola", Back: "hello"},
+				{Owner: "user2:deck1", Front: "Paris, Texas", Back: "a film"},
+				{Owner: "user1:deck1", Front: "comparison", Back: "unparisian"},
+			}
+			err := ds.Store(cards)
+			c.Expect(test.EQ, nil, err)
+
+			// search returns the ids of the cards l finds, and checks
+			// their snippets set off what was searched for.
+			search := func(l db.ListOp, marked string) []int {
+				l.What = "search"
+				if l.Query == "" {
+					l.Query = "*"
+				}
+				got, err := ds.List(l)
+				c.Expect(test.EQ, nil, err)
+				var ids []int
+				for _, h := range got.(db.HitList) {
+					ids = append(ids, h.ID)
+					if !strings.Contains(h.Snippet, marked) {
+						t.Errorf("Snippet of card %d for %q is %q, which doesn't mark %q.", h.ID, l.Search, h.Snippet, marked)
+					}
+				}
+				return ids
+			}
+			// sorted returns ids, but for the first, in order.
+			sorted := func(ids []int) []int {
+				if len(ids) > 1 {
+					sort.Ints(ids[1:])
+				}
+				return ids
+			}
+
+			// Whole words are matched, ignoring case, and the card with
+			// the most of them comes first.
+			got := search(db.ListOp{Search: "paris"}, "**Paris**")
+			c.Expect(test.EQ, []int{cards[1].ID, cards[0].ID, cards[3].ID}, sorted(got))
+			got = search(db.ListOp{Search: "PARIS spring"}, "**spring**")
+			c.Expect(test.EQ, []int{cards[1].ID}, got)
+			got = search(db.ListOp{Search: "paris", Limit: 1}, "**Paris**")
+			c.Expect(test.EQ, []int{cards[1].ID}, got)
+
+			// Searches are scoped like lists of cards.
+			got = search(db.ListOp{Search: "paris", User: "user2"}, "**Paris**")
+			c.Expect(test.EQ, []int{cards[3].ID}, got)
+			got = search(db.ListOp{Search: "hola", Query: "user1:deck1"}, "**hola**")
+			c.Expect(test.EQ, 0, len(got))
+			got = search(db.ListOp{Search: "hola", Query: "user1:deck2"}, "**hola**")
+			c.Expect(test.EQ, []int{cards[2].ID}, got)
+
+			hits, err := ds.List(db.ListOp{What: "search", Query: "*", Search: "hola"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, "user1:deck2", hits.(db.HitList)[0].Owner)
+			c.Expect(test.EQ, "hello", hits.(db.HitList)[0].Back)
+
+			// Changed and deleted cards are searched as they are now.
+			err = ds.Update(db.CardList{{ID: cards[0].ID, DeckID: cards[0].DeckID, Front: "the capital of France", Back: "Lyon? No."}})
+			c.Expect(test.EQ, nil, err)
+			err = ds.Delete(db.CardList{{ID: cards[3].ID}})
+			c.Expect(test.EQ, nil, err)
+			got = search(db.ListOp{Search: "paris"}, "**Paris**")
+			c.Expect(test.EQ, []int{cards[1].ID}, got)
+			got = search(db.ListOp{Search: "lyon"}, "**Lyon**")
+			c.Expect(test.EQ, []int{cards[0].ID}, got)
+
+			// There has to be something to search for, and searches
+			// can't be paged.
+			_, err = ds.List(db.ListOp{What: "search", Query: "*", Search: " ?! "})
+			c.Expect(test.EQ, true, errors.Is(err, db.ErrInvalid))
+			_, err = ds.List(db.ListOp{What: "search", Query: "*", Search: "paris", Cursor: "WzFd"})
+			c.Expect(test.EQ, true, errors.Is(err, db.ErrInvalid))
+		}},
+
+	{"Filter cards",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:spanish", "user1:french", "user2:spanish")
+			now := time.Now()
+			cards := db.CardList{
+				{Owner: "user1:spanish", Front: "hablar", Back: "to speak", Tags: []string{"Verbs", "a1"}, Due: now.Add(-time.Hour)},
+				{Owner: "user1:spanish", Front: "comer", Back: "to eat", Tags: []string{"verbs", "verbs"}, Due: now.AddDate(0, 0, 3), Reps: 4},
+				{Owner: "user1:spanish", Front: "la casa", Back: "the house", Tags: []string{"nouns"}, Due: now.AddDate(0, 0, 30)},
+				{Owner: "user1:french", Front: "parler", Back: "to speak", Tags: []string{"verbs"}, Due: now.AddDate(0, 0, 1), Ease: 1.8},
+				{Owner: "user2:spanish", Front: "vivir", Back: "to live", Tags: []string{"verbs"}, Due: now},
+			}
+			err := ds.Store(cards)
+			c.Expect(test.EQ, nil, err)
+
+			// Tags are listed in lower case, in order and only once.
+			got, err := ds.List(db.ListOp{What: "cards", Query: "*", ID: cards[0].ID})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, []string{"a1", "verbs"}, got.(db.CardList)[0].Tags)
+			got, err = ds.List(db.ListOp{What: "cards", Query: "*", ID: cards[1].ID})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, []string{"verbs"}, got.(db.CardList)[0].Tags)
+
+			// filter returns the fronts of the cards l lists with the
+			// given filter.
+			filter := func(l db.ListOp, f string) []string {
+				if l.What == "" {
+					l.What, l.Query = "cards", "*"
+				}
+				l.Filter = f
+				got, err := ds.List(l)
+				if err != nil {
+					t.Errorf("Filter %q: %v", f, err)
+					return nil
+				}
+				var fronts []string
+				switch got := got.(type) {
+				case db.CardList:
+					for _, c := range got {
+						fronts = append(fronts, c.Front)
+					}
+				case db.HitList:
+					for _, h := range got {
+						fronts = append(fronts, h.Front)
+					}
+				}
+				sort.Strings(fronts)
+				return fronts
+			}
+			for _, tt := range []struct {
+				filter string
+				fronts []string
+			}{
+				{`deck = "user1:spanish" AND tag = verbs AND due < now+7d`, []string{"comer", "hablar"}},
+				{`deck = User1:Spanish tag = verbs due < now+7d`, []string{"comer", "hablar"}},
+				{`tag = verbs AND NOT deck ~ spanish`, []string{"parler"}},
+				{`tag != verbs`, []string{"la casa"}},
+				{`tag = VERBS and (front ~ AR or back ~ LIVE)`, []string{"hablar", "parler", "vivir"}},
+				{`back = "to speak" OR reps >= 4`, []string{"comer", "hablar", "parler"}},
+				{`ease < 2.5`, []string{"parler"}},
+				{`due <= today+1d AND due > now-1d`, []string{"hablar", "vivir"}},
+				{`created > now-1h AND created <= now+1h AND box = 0 AND interval = 0`, []string{"comer", "hablar", "la casa", "parler", "vivir"}},
+				{`created < 2016-06-01 OR front = "comer "`, nil},
+				{`front ~ "%" OR front ~ _`, nil},
+			} {
+				c.Expect(test.EQ, tt.fronts, filter(db.ListOp{}, tt.filter))
+			}
+
+			// Filters narrow lists that are scoped, due or paged, and
+			// searches.
+			c.Expect(test.EQ, []string{"vivir"}, filter(db.ListOp{What: "cards", User: "user2", Query: "*"}, "tag = verbs"))
+			c.Expect(test.EQ, []string{"hablar", "vivir"}, filter(db.ListOp{What: "cards", Query: "*", Due: now}, "tag = verbs"))
+			c.Expect(test.EQ, []string{"hablar", "parler"}, filter(db.ListOp{What: "search", Query: "*", Search: "speak"}, "tag = verbs"))
+			l := db.ListOp{What: "cards", Query: "*", Limit: 1, Filter: "tag = verbs AND deck ~ user1"}
+			var paged []string
+			for {
+				ls, next, err := db.Page(ds, l)
+				c.Expect(test.EQ, nil, err)
+				for _, c := range ls.(db.CardList) {
+					paged = append(paged, c.Front)
+				}
+				if next == "" {
+					break
+				}
+				l.Cursor = next
+			}
+			c.Expect(test.EQ, []string{"parler", "hablar", "comer"}, paged)
+
+			// Updating a card replaces its tags.
+			err = ds.Update(db.CardList{{ID: cards[2].ID, Front: "la casa", Back: "the house", Tags: []string{"places"}}})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, []string{"la casa"}, filter(db.ListOp{}, "tag = places"))
+			c.Expect(test.EQ, 0, len(filter(db.ListOp{}, "tag = nouns")))
+
+			// Bad tags and filters are ErrInvalid.
+			err = ds.Store(db.CardList{{Owner: "user1:spanish", Front: "a", Back: "b", Tags: []string{"two words"}}})
+			c.Expect(test.EQ, true, errors.Is(err, db.ErrInvalid))
+			for _, f := range []string{
+				"tag", "tag =", "tag < verbs", "color = red", "(tag = verbs", "tag = verbs)",
+				"reps > 1.5", "due < tomorrow", "due < now+1y", "due = now", "front ~ \"hola",
+				"tag = verbs OR", "NOT", "front ! hola", "tag = (verbs)", strings.Repeat("tag = a AND ", 100),
+			} {
+				_, err = ds.List(db.ListOp{What: "cards", Query: "*", Filter: f})
+				if !errors.Is(err, db.ErrInvalid) {
+					t.Errorf("Filter %q: got %v, want ErrInvalid.", f, err)
+				}
+			}
+			_, err = ds.List(db.ListOp{What: "decks", Query: "*", Filter: "tag = verbs"})
+			c.Expect(test.EQ, true, errors.Is(err, db.ErrInvalid))
+		}},
+
+	{"Deck Scheduler",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:")
+
+			decks := db.DeckList{
+				{Name: "user1:sm2"},
+				{Name: "user1:fsrs", Scheduler: "fsrs", Params: json.RawMessage(`{"retention":0.8}`)},
+				{Name: "user1:leitner", Scheduler: "leitner", Params: json.RawMessage(`{"intervals":[1,3]}`)},
+			}
+			err := ds.Store(decks)
+			c.Expect(test.EQ, nil, err)
+
+			got, err := ds.List(db.ListOp{What: "decks", Query: "user1:fsrs"})
+			c.Expect(test.EQ, nil, err)
+			want := db.DeckList{{Owner: "user1", Name: "fsrs", Scheduler: "fsrs", Params: decks[1].Params}}
+			c.Expect(test.EQ, want, ignoreDeckIDs(got))
+
+			err = ds.Store(db.DeckList{{Name: "user1:bad", Scheduler: "unknown"}})
+			c.Expect(test.NE, nil, err)
+
+			err = ds.Store(db.CardList{
+				{Owner: "user1:fsrs", Front: "big", Back: "small"},
+				{Owner: "user1:sm2", Front: "tall", Back: "short"},
+				{Owner: "user1:leitner", Front: "ugly", Back: "pretty"},
+			})
+			c.Expect(test.EQ, nil, err)
+
+			got, err = ds.List(db.ListOp{What: "cards", Query: "user1:*"})
+			c.Expect(test.EQ, nil, err)
+			cards := got.(db.CardList)
+
+			now := time.Now()
+			for _, card := range cards {
+				card, err := ds.Review(db.ReviewOp{CardID: card.ID, Grade: db.Good, At: now})
+				c.Expect(test.EQ, nil, err)
+				switch card.Owner {
+				case "user1:fsrs":
+					c.Expect(test.NE, 0.0, card.Stability)
+				case "user1:leitner":
+					c.Expect(test.EQ, 2, card.Box)
+					c.Expect(test.EQ, 3, card.Interval)
+				default:
+					c.Expect(test.EQ, 0.0, card.Stability)
+					c.Expect(test.EQ, 0, card.Box)
+				}
+			}
+
+			got, err = ds.List(db.ListOp{What: "cards", Query: "user1:fsrs"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.NE, 0.0, got.(db.CardList)[0].Stability)
+			c.Expect(test.NE, 0.0, got.(db.CardList)[0].Difficulty)
+
+			got, err = ds.List(db.ListOp{What: "cards", Query: "user1:leitner"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 2, got.(db.CardList)[0].Box)
+		}},
+
+	{"Init DB from disk",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			err := ds.Init("./testdata")
+			c.Expect(test.EQ, nil, err)
+
+			wantUsers := db.UserList{
+				{Email: "ai.ngau@gmail.com", Name: "Ai Ngau", Role: db.RoleEditor},
+				{Email: "askcarter@google.com", Name: "Carter", Role: db.RoleEditor},
+			}
+
+			got, err := ds.List(db.ListOp{What: "users", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, wantUsers, got.(db.UserList))
+
+			wantDecks := db.DeckList{
+				{Owner: "ai.ngau@gmail.com", Name: "spanish"},
+				{Owner: "askcarter@google.com", Name: "algebra"},
+				{Owner: "askcarter@google.com", Name: "programming"},
+			}
+
+			got, err = ds.List(db.ListOp{What: "decks", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, wantDecks, ignoreDeckIDs(got))
+
+			wantCards := db.CardList{
+				{Owner: "ai.ngau@gmail.com:spanish", Front: "feugo", Back: "pretty"},
+				{Owner: "ai.ngau@gmail.com:spanish", Front: "futbol", Back: "soccer"},
+				{Owner: "ai.ngau@gmail.com:spanish", Front: "que?", Back: "what?"},
+				{Owner: "ai.ngau@gmail.com:spanish", Front: "a donde es?", Back: "where is?"},
+				{Owner: "ai.ngau@gmail.com:spanish", Front: "hola", Back: "hello"},
+				{Owner: "askcarter@google.com:algebra", Front: "x*0", Back: "0"},
+				{Owner: "askcarter@google.com:algebra", Front: "x+0", Back: "x"},
+				{Owner: "askcarter@google.com:algebra", Front: "x+x", Back: "2x"},
+				{Owner: "askcarter@google.com:programming", Front: "favorite programming language", Back: "Go"},
+				{Owner: "askcarter@google.com:programming", Front: "public interface", Back: "API"},
+			}
+
+			got, err = ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, wantCards, got.(db.CardList))
+		}},
+	{"Emails and deck names are case-insensitive",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			err := ds.Store(db.UserList{{Email: "User1@Test.com", Name: "Bill"}})
+			c.Expect(test.EQ, nil, err)
+			err = ds.Store(db.DeckList{{Owner: "USER1@test.com", Name: "Deck1"}})
+			c.Expect(test.EQ, nil, err)
+			err = ds.Store(db.CardList{{Owner: "user1@TEST.com:DECK1", Front: "big", Back: "small"}})
+			c.Expect(test.EQ, nil, err)
+
+			got, err := ds.List(db.ListOp{What: "users", Query: "USER1@test.com"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.UserList{{Email: "user1@test.com", Name: "Bill", Role: db.RoleEditor}}, got)
+
+			got, err = ds.List(db.ListOp{What: "decks", Query: "User1@Test.com:Deck1"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{{Owner: "user1@test.com", Name: "deck1"}}, ignoreDeckIDs(got))
+
+			got, err = ds.List(db.ListOp{What: "cards", Query: "User1@Test.com:*"})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, db.CardList{{Owner: "user1@test.com:deck1", Front: "big", Back: "small"}}, got.(db.CardList))
+
+			// Storing a user again under another case replaces them.
+			err = ds.Store(db.UserList{{Email: "USER1@TEST.COM", Name: "William"}})
+			c.Expect(test.EQ, nil, err)
+			got, err = ds.List(db.ListOp{What: "users", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.UserList{{Email: "user1@test.com", Name: "William", Role: db.RoleEditor}}, got)
+		}},
+
+	{"Wildcard queries",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:deck1", "user1:deck2", "user10:deck1", "user2:deck1")
+
+			got, err := ds.List(db.ListOp{What: "decks", Query: "user1:*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{
+				{Owner: "user1", Name: "deck1"},
+				{Owner: "user1", Name: "deck2"},
+			}, ignoreDeckIDs(got))
+
+			got, err = ds.List(db.ListOp{What: "decks", Query: "user1*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{
+				{Owner: "user1", Name: "deck1"},
+				{Owner: "user1", Name: "deck2"},
+				{Owner: "user10", Name: "deck1"},
+			}, ignoreDeckIDs(got))
+
+			got, err = ds.List(db.ListOp{What: "users", Query: "user1"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.UserList{{Email: "user1", Role: db.RoleEditor}}, got)
+
+			got, err = ds.List(db.ListOp{What: "users", Query: "*", Limit: 2})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.UserList{{Email: "user1", Role: db.RoleEditor}, {Email: "user10", Role: db.RoleEditor}}, got)
+
+			// Without a '*', queries match exactly.
+			got, err = ds.List(db.ListOp{What: "decks", Query: "user1:deck"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(ignoreDeckIDs(got)))
+		}},
+
+	{"Lists are scoped to their user",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:deck1", "user2:deck1")
+			err := ds.Store(db.CardList{
+				{Owner: "user1:deck1", Front: "big", Back: "small"},
+				{Owner: "user2:deck1", Front: "sky", Back: "blue"},
+			})
+			c.Expect(test.EQ, nil, err)
+
+			got, err := ds.List(db.ListOp{What: "users", User: "User1", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.UserList{{Email: "user1", Role: db.RoleEditor}}, got)
+
+			got, err = ds.List(db.ListOp{What: "decks", User: "user1", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{{Owner: "user1", Name: "deck1"}}, ignoreDeckIDs(got))
+
+			got, err = ds.List(db.ListOp{What: "decks", User: "user1", Query: "user2:*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(ignoreDeckIDs(got)))
+
+			got, err = ds.List(db.ListOp{What: "cards", User: "user2", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			cards := got.(db.CardList)
+			checkIgnoreIDs(t, db.CardList{{Owner: "user2:deck1", Front: "sky", Back: "blue"}}, cards)
+
+			// Users can only review their own cards.
+			now := time.Now()
+			_, err = ds.Review(db.ReviewOp{CardID: cards[0].ID, User: "user1", Grade: db.Good, At: now})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+			_, err = ds.Review(db.ReviewOp{CardID: cards[0].ID, User: "user2", Grade: db.Good, At: now})
+			c.Expect(test.EQ, nil, err)
+
+			got, err = ds.List(db.ListOp{What: "reviews", User: "user1", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.ReviewList)))
+			got, err = ds.List(db.ListOp{What: "reviews", User: "user2", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 1, len(got.(db.ReviewList)))
+
+			// Without a user, everything is listed.
+			got, err = ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 2, len(got.(db.CardList)))
+		}},
+
+	{"API keys",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:", "user2:")
+			err := ds.Store(db.APIKeyList{
+				{Name: "app", Owner: "User1", Scope: db.ScopeRead, Hash: "hash1"},
+				{Name: "ops", Owner: "user2", Scope: db.ScopeAdmin, Hash: "hash2"},
+			})
+			c.Expect(test.EQ, nil, err)
+
+			k, err := ds.APIKey("hash1")
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.NE, 0, k.ID)
+			c.Expect(test.EQ, "app", k.Name)
+			c.Expect(test.EQ, "user1", k.Owner)
+			c.Expect(test.EQ, db.ScopeRead, k.Scope)
+			c.Expect(test.EQ, false, k.Created.IsZero())
+
+			_, err = ds.APIKey("hash3")
+			c.Expect(test.EQ, db.ErrNotFound, err)
+
+			// Listed keys never have their hash.
+			got, err := ds.List(db.ListOp{What: "keys", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			keys := got.(db.APIKeyList)
+			if len(keys) != 2 {
+				t.Fatalf("Expected 2 keys, got %v", keys)
+			}
+			c.Expect(test.EQ, k.ID, keys[0].ID)
+			c.Expect(test.EQ, "ops", keys[1].Name)
+			for _, k := range keys {
+				c.Expect(test.EQ, "", k.Hash)
+				c.Expect(test.EQ, true, k.Revoked == nil)
+			}
+
+			got, err = ds.List(db.ListOp{What: "keys", User: "user2", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 1, len(got.(db.APIKeyList)))
+
+			// Revoked keys are listed, but can't be used.
+			err = ds.RevokeAPIKey(k.ID)
+			c.Expect(test.EQ, nil, err)
+			_, err = ds.APIKey("hash1")
+			c.Expect(test.EQ, db.ErrNotFound, err)
+			got, err = ds.List(db.ListOp{What: "keys", User: "user1", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, false, got.(db.APIKeyList)[0].Revoked == nil)
+
+			err = ds.RevokeAPIKey(1000)
+			c.Expect(test.EQ, db.ErrNotFound, err)
+
+			// Keys need a valid scope, an owner and a unique hash.
+			err = ds.Store(db.APIKeyList{{Name: "x", Owner: "user1", Scope: "root", Hash: "hash4"}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Store(db.APIKeyList{{Name: "x", Owner: "nobody", Scope: db.ScopeRead, Hash: "hash4"}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Store(db.APIKeyList{{Name: "x", Owner: "user1", Scope: db.ScopeRead, Hash: "hash2"}})
+			c.Expect(test.NE, nil, err)
+		}},
+
+	{"Roles",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			err := ds.Store(db.UserList{
+				{Email: "user1", Role: db.RoleAdmin},
+				{Email: "user2", Role: db.RoleLearner},
+				{Email: "user3"},
+			})
+			c.Expect(test.EQ, nil, err)
+
+			// Storing a user without a role keeps the one they had.
+			err = ds.Store(db.UserList{{Email: "user2", Name: "Jill"}})
+			c.Expect(test.EQ, nil, err)
+
+			got, err := ds.List(db.ListOp{What: "users", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.UserList{
+				{Email: "user1", Role: db.RoleAdmin},
+				{Email: "user2", Name: "Jill", Role: db.RoleLearner},
+				{Email: "user3", Role: db.RoleEditor},
+			}, got)
+
+			err = ds.Store(db.UserList{{Email: "user4", Role: "root"}})
+			c.Expect(test.NE, nil, err)
+		}},
+
+	{"Decks can be shared",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:deck1", "user1:deck2", "user2:deck1", "user3:", "user4:")
+			err := ds.Store(db.CardList{
+				{Owner: "user1:deck1", Front: "big", Back: "small"},
+				{Owner: "user1:deck2", Front: "sky", Back: "blue"},
+				{Owner: "user2:deck1", Front: "hot", Back: "cold"},
+			})
+			c.Expect(test.EQ, nil, err)
+			got, err := ds.List(db.ListOp{What: "decks", User: "user1", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			decks := got.(db.DeckList)
+			if len(decks) != 2 {
+				t.Fatalf("Expected 2 decks, got %v", decks)
+			}
+
+			err = ds.Store(db.GroupList{{Name: "Class", Owner: "user1", Members: []string{"User3", "user2", "user3"}}})
+			c.Expect(test.EQ, nil, err)
+			err = ds.Store(db.ShareList{
+				{DeckID: decks[0].ID, User: "user2", Access: db.AccessRead},
+				{DeckID: decks[1].ID, Group: "class", Access: db.AccessRead},
+			})
+			c.Expect(test.EQ, nil, err)
+
+			got, err = ds.List(db.ListOp{What: "groups", User: "user3", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.GroupList{{Name: "class", Owner: "user1", Members: []string{"user2", "user3"}}}, got)
+			got, err = ds.List(db.ListOp{What: "groups", User: "user4", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.GroupList)))
+
+			// Users see their own decks and the decks shared with them,
+			// directly or through a group.
+			got, err = ds.List(db.ListOp{What: "decks", User: "user2", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{
+				{Owner: "user1", Name: "deck1", Access: db.AccessRead},
+				{Owner: "user1", Name: "deck2", Access: db.AccessRead},
+				{Owner: "user2", Name: "deck1"},
+			}, ignoreDeckIDs(got))
+
+			got, err = ds.List(db.ListOp{What: "cards", User: "user3", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			cards := got.(db.CardList)
+			checkIgnoreIDs(t, db.CardList{{Owner: "user1:deck2", Front: "sky", Back: "blue"}}, cards)
+
+			got, err = ds.List(db.ListOp{What: "decks", User: "user4", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(ignoreDeckIDs(got)))
+
+			// Sharing again replaces the share, and the most access wins.
+			err = ds.Store(db.ShareList{{DeckID: decks[1].ID, User: "user2", Access: db.AccessEdit}})
+			c.Expect(test.EQ, nil, err)
+			err = ds.Store(db.ShareList{{DeckID: decks[0].ID, User: "USER2", Access: db.AccessEdit}})
+			c.Expect(test.EQ, nil, err)
+			got, err = ds.List(db.ListOp{What: "decks", User: "user2", Query: "user1:*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{
+				{Owner: "user1", Name: "deck1", Access: db.AccessEdit},
+				{Owner: "user1", Name: "deck2", Access: db.AccessEdit},
+			}, ignoreDeckIDs(got))
+
+			// Shares are listed for their deck's owner.
+			got, err = ds.List(db.ListOp{What: "shares", User: "user1", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.ShareList{
+				{DeckID: decks[0].ID, User: "user2", Access: db.AccessEdit},
+				{DeckID: decks[1].ID, Group: "class", Access: db.AccessRead},
+				{DeckID: decks[1].ID, User: "user2", Access: db.AccessEdit},
+			}, got)
+			got, err = ds.List(db.ListOp{What: "shares", User: "user2", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.ShareList)))
+
+			// Shared cards can be reviewed; others' cards still can't.
+			now := time.Now()
+			_, err = ds.Review(db.ReviewOp{CardID: cards[0].ID, User: "user3", Grade: db.Good, At: now})
+			c.Expect(test.EQ, nil, err)
+			_, err = ds.Review(db.ReviewOp{CardID: cards[0].ID, User: "user4", Grade: db.Good, At: now})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+
+			// Groups belong to their owner, and shares need a deck, a known
+			// user or group, and an access level.
+			err = ds.Store(db.GroupList{{Name: "class", Owner: "user2"}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Store(db.GroupList{{Name: "other", Owner: "user1", Members: []string{"nobody"}}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Store(db.ShareList{{DeckID: 1000, User: "user2", Access: db.AccessRead}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Store(db.ShareList{{DeckID: decks[0].ID, User: "nobody", Access: db.AccessRead}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Store(db.ShareList{{DeckID: decks[0].ID, User: "user2", Group: "class", Access: db.AccessRead}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Store(db.ShareList{{DeckID: decks[0].ID, User: "user2", Access: "own"}})
+			c.Expect(test.NE, nil, err)
+		}},
+
+	{"Store sets IDs, which List can look up",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:", "user2:deck1")
+			decks := db.DeckList{{Owner: "user1", Name: "deck1"}, {Owner: "user1", Name: "deck2"}}
+			err := ds.Store(decks)
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.NE, 0, decks[0].ID)
+			c.Expect(test.NE, decks[0].ID, decks[1].ID)
+
+			// Storing a deck again keeps its ID.
+			again := db.DeckList{{Owner: "user1", Name: "deck2", Desc: "Again."}}
+			err = ds.Store(again)
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, decks[1].ID, again[0].ID)
+
+			cards := db.CardList{
+				{DeckID: decks[1].ID, Front: "big", Back: "small"},
+				{DeckID: decks[1].ID, Front: "sky", Back: "blue"},
+			}
+			err = ds.Store(cards)
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.NE, 0, cards[0].ID)
+			c.Expect(test.NE, cards[0].ID, cards[1].ID)
+
+			got, err := ds.List(db.ListOp{What: "decks", Query: "*", ID: decks[1].ID})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{{ID: decks[1].ID, Owner: "user1", Name: "deck2", Desc: "Again."}}, got)
+
+			got, err = ds.List(db.ListOp{What: "cards", Query: "*", ID: cards[1].ID})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, db.CardList{{Owner: "user1:deck2", Front: "sky", Back: "blue"}}, got.(db.CardList))
+
+			// IDs are still scoped to their user.
+			got, err = ds.List(db.ListOp{What: "cards", User: "user2", Query: "*", ID: cards[1].ID})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.CardList)))
+		}},
+
+	{"Update",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:", "user2:")
+			err := ds.Store(db.UserList{{Email: "user1", Name: "Bill", Role: db.RoleLearner}})
+			c.Expect(test.EQ, nil, err)
+			decks := db.DeckList{{Owner: "user1", Name: "deck1"}, {Owner: "user1", Name: "deck2"}}
+			err = ds.Store(decks)
+			c.Expect(test.EQ, nil, err)
+			cards := db.CardList{{DeckID: decks[0].ID, Front: "big", Back: "small", Reps: 3}}
+			err = ds.Store(cards)
+			c.Expect(test.EQ, nil, err)
+
+			// Users keep their role unless given one.
+			err = ds.Update(db.UserList{{Email: "User1", Name: "William"}})
+			c.Expect(test.EQ, nil, err)
+			got, err := ds.List(db.ListOp{What: "users", Query: "user1"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.UserList{{Email: "user1", Name: "William", Role: db.RoleLearner}}, got)
+
+			// Decks keep their owner, and can be renamed.
+			err = ds.Update(db.DeckList{{ID: decks[0].ID, Owner: "user2", Name: "Words", Desc: "Renamed."}})
+			c.Expect(test.EQ, nil, err)
+			got, err = ds.List(db.ListOp{What: "decks", Query: "*", ID: decks[0].ID})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{{Owner: "user1", Name: "words", Desc: "Renamed."}}, ignoreDeckIDs(got))
+
+			// Cards keep their schedule, and can be moved.
+			err = ds.Update(db.CardList{{ID: cards[0].ID, DeckID: decks[1].ID, Front: "large", Back: "tiny"}})
+			c.Expect(test.EQ, nil, err)
+			got, err = ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			updated := got.(db.CardList)
+			checkIgnoreIDs(t, db.CardList{{Owner: "user1:deck2", Front: "large", Back: "tiny"}}, updated)
+			c.Expect(test.EQ, 3, updated[0].Reps)
+
+			// Storing a card with its ID replaces it rather than adding
+			// another.
+			updated[0].Front, updated[0].Reps = "huge", 0
+			err = ds.Store(db.CardList{updated[0]})
+			c.Expect(test.EQ, nil, err)
+			got, err = ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, db.CardList{{Owner: "user1:deck2", Front: "huge", Back: "tiny"}}, got.(db.CardList))
+			c.Expect(test.EQ, 0, got.(db.CardList)[0].Reps)
+
+			err = ds.Store(db.CardList{{ID: 1000, DeckID: decks[1].ID, Front: "x"}})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+
+			// Missing things aren't found, and nothing is updated.
+			err = ds.Update(db.UserList{{Email: "user2", Name: "Jill"}, {Email: "nobody"}})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+			got, err = ds.List(db.ListOp{What: "users", Query: "user2"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, "", got.(db.UserList)[0].Name)
+			err = ds.Update(db.DeckList{{ID: 1000, Name: "x"}})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+			err = ds.Update(db.CardList{{ID: 1000, Front: "x"}})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+
+			// Updates still have to make sense.
+			err = ds.Update(db.DeckList{{ID: decks[0].ID, Name: "deck2"}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Update(db.DeckList{{ID: decks[0].ID, Name: ""}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Update(db.CardList{{ID: cards[0].ID, DeckID: 1000}})
+			c.Expect(test.NE, nil, err)
+			err = ds.Update(db.ReviewList{})
+			c.Expect(test.NE, nil, err)
+		}},
+
+	{"Delete",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			storeOwners(t, ds, "user1:deck1", "user1:deck2", "user2:deck1")
+			err := ds.Store(db.CardList{
+				{Owner: "user1:deck1", Front: "big", Back: "small"},
+				{Owner: "user1:deck2", Front: "sky", Back: "blue"},
+				{Owner: "user2:deck1", Front: "hot", Back: "cold"},
+			})
+			c.Expect(test.EQ, nil, err)
+			got, err := ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			cards := got.(db.CardList)
+			err = ds.Store(db.GroupList{{Name: "class", Owner: "user2", Members: []string{"user1"}}})
+			c.Expect(test.EQ, nil, err)
+			err = ds.Store(db.ShareList{
+				{DeckID: cards[2].DeckID, User: "user1", Access: db.AccessRead},
+				{DeckID: cards[1].DeckID, Group: "class", Access: db.AccessRead},
+			})
+			c.Expect(test.EQ, nil, err)
+
+			err = ds.Delete(db.CardList{{ID: cards[0].ID}})
+			c.Expect(test.EQ, nil, err)
+			got, err = ds.List(db.ListOp{What: "cards", Query: "user1:*"})
+			c.Expect(test.EQ, nil, err)
+			checkIgnoreIDs(t, db.CardList{{Owner: "user1:deck2", Front: "sky", Back: "blue"}}, got.(db.CardList))
+
+			err = ds.Delete(db.ShareList{{DeckID: cards[2].DeckID, User: "User1"}})
+			c.Expect(test.EQ, nil, err)
+			got, err = ds.List(db.ListOp{What: "decks", User: "user1", Query: "user2:*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.DeckList)))
+
+			// Deleting a deck deletes its cards and shares.
+			err = ds.Delete(db.DeckList{{ID: cards[1].DeckID}})
+			c.Expect(test.EQ, nil, err)
+			got, err = ds.List(db.ListOp{What: "cards", Query: "user1:*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.CardList)))
+			got, err = ds.List(db.ListOp{What: "shares", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.ShareList)))
+
+			// Deleting a user deletes everything they own.
+			err = ds.Delete(db.UserList{{Email: "USER2"}})
+			c.Expect(test.EQ, nil, err)
+			got, err = ds.List(db.ListOp{What: "decks", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, db.DeckList{{Owner: "user1", Name: "deck1"}}, ignoreDeckIDs(got))
+			got, err = ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.CardList)))
+			got, err = ds.List(db.ListOp{What: "groups", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.GroupList)))
+
+			// Missing things aren't found, and nothing is deleted.
+			err = ds.Delete(db.UserList{{Email: "user1"}, {Email: "nobody"}})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+			got, err = ds.List(db.ListOp{What: "users", Query: "user1"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 1, len(got.(db.UserList)))
+			err = ds.Delete(db.DeckList{{ID: 1000}})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+			err = ds.Delete(db.CardList{{ID: cards[0].ID}})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+			err = ds.Delete(db.GroupList{{Name: "class"}})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+			err = ds.Delete(db.ShareList{{DeckID: cards[1].DeckID, Group: "class"}})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+			err = ds.Delete(db.ReviewList{})
+			c.Expect(test.NE, nil, err)
+		}},
+
+	{"Errors can be told apart with errors.Is",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+			storeOwners(t, ds, "user1:deck1", "user1:deck2", "user2:")
+			dl, err := ds.List(db.ListOp{What: "decks", User: "user1", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			deck1 := dl.(db.DeckList)[0]
+
+			for _, tc := range []struct {
+				desc string
+				err  error
+				want error
+			}{
+				{"unknown list type", func() error {
+					_, err := ds.List(db.ListOp{What: "unknown", Query: "*"})
+					return err
+				}(), db.ErrInvalid},
+				{"bad type", ds.Store(nil), db.ErrInvalid},
+				{"bad role", ds.Store(db.UserList{{Email: "user3", Role: "king"}}), db.ErrInvalid},
+				{"deck with no owner",
+					ds.Store(db.DeckList{{Owner: "nobody", Name: "deck"}}), db.ErrInvalid},
+				{"bad scheduler",
+					ds.Store(db.DeckList{{Owner: "user1", Name: "deck3", Scheduler: "coin"}}), db.ErrInvalid},
+				{"card with no deck",
+					ds.Store(db.CardList{{Owner: "user1:nodeck", Front: "x", Back: "y"}}), db.ErrInvalid},
+				{"key with no owner",
+					ds.Store(db.APIKeyList{{Name: "k", Hash: "h", Owner: "nobody", Scope: db.ScopeRead}}), db.ErrInvalid},
+				{"duplicate key", func() error {
+					k := db.APIKeyList{{Name: "k", Hash: "h", Owner: "user1", Scope: db.ScopeRead}}
+					if err := ds.Store(k); err != nil {
+						return err
+					}
+					return ds.Store(k)
+				}(), db.ErrConflict},
+				{"someone else's group", func() error {
+					if err := ds.Store(db.GroupList{{Name: "g", Owner: "user1"}}); err != nil {
+						return err
+					}
+					return ds.Store(db.GroupList{{Name: "g", Owner: "user2"}})
+				}(), db.ErrConflict},
+				{"deck renamed over another",
+					ds.Update(db.DeckList{{ID: deck1.ID, Name: "deck2"}}), db.ErrConflict},
+				{"missing deck", ds.Update(db.DeckList{{ID: 1000, Name: "deck"}}), db.ErrNotFound},
+				{"missing user", ds.Delete(db.UserList{{Email: "nobody"}}), db.ErrNotFound},
+			} {
+				if !errors.Is(tc.err, tc.want) {
+					t.Errorf("%s: got %v, want %v", tc.desc, tc.err, tc.want)
+				}
+			}
+		}},
+	{"Errors",
+		func(t *testing.T, ds db.DataSource) {
+			c := test.Checker(t)
+
+			_, err := ds.List(db.ListOp{What: "unknown", Query: "*"})
+			c.Expect(test.NE, nil, err)
+
+			err = ds.Store(nil)
+			c.Expect(test.NE, nil, err)
+
+			_, err = ds.Review(db.ReviewOp{CardID: 1, Grade: db.Good, At: time.Now()})
+			c.Expect(test.EQ, db.ErrNotFound, err)
+
+			// A failed Store stores nothing.
+			storeOwners(t, ds, "user1:deck1")
+			err = ds.Store(db.CardList{
+				{Owner: "user1:deck1", Front: "big", Back: "small"},
+				{Owner: "user1:nodeck", Front: "x", Back: "y"},
+			})
+			c.Expect(test.NE, nil, err)
+			got, err := ds.List(db.ListOp{What: "cards", Query: "*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.CardList)))
+
+			err = ds.Init("./does-not-exist")
+			c.Expect(test.NE, nil, err)
+
+			// Init stores nothing unless it can store everything.
+			dir, err := ioutil.TempDir("", "dbtest_")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			for _, f := range []string{"users.json", "decks.json"} {
+				b, err := ioutil.ReadFile(filepath.Join("./testdata", f))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(filepath.Join(dir, f), b, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = ds.Init(dir)
+			c.Expect(test.NE, nil, err)
+			got, err = ds.List(db.ListOp{What: "users", Query: "askcarter@google.com"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.UserList)))
+
+			// Nor when a file is read but can't be stored, as with a card
+			// in a deck that doesn't exist.
+			cards := `[{"owner": "askcarter@google.com:nodeck", "front": "x", "back": "y"}]`
+			if err := ioutil.WriteFile(filepath.Join(dir, "cards.json"), []byte(cards), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err = ds.Init(dir)
+			c.Expect(test.NE, nil, err)
+			got, err = ds.List(db.ListOp{What: "users", Query: "askcarter@google.com"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.UserList)))
+			got, err = ds.List(db.ListOp{What: "decks", Query: "askcarter@google.com:*"})
+			c.Expect(test.EQ, nil, err)
+			c.Expect(test.EQ, 0, len(got.(db.DeckList)))
+		}},
+}
+
+// storeOwners stores the users and decks named by owners, which are either
+// 'email:deck' or just 'email:' for a user with no decks.
+func storeOwners(t *testing.T, ds db.DataSource, owners ...string) {
+	for _, o := range owners {
+		i := strings.Index(o, ":")
+		email, deck := o[:i], o[i+1:]
+		if err := ds.Store(db.UserList{{Email: email}}); err != nil {
+			t.Fatal(err)
+		}
+		if deck == "" {
+			continue
+		}
+		if err := ds.Store(db.DeckList{{Owner: email, Name: deck}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// ignoreDeckIDs returns the decks in ls with their IDs zeroed.
+func ignoreDeckIDs(ls db.ListStorer) db.DeckList {
+	var dl db.DeckList
+	for _, d := range ls.(db.DeckList) {
+		d.ID = 0
+		dl = append(dl, d)
+	}
+	return dl
+}
+
+func checkIgnoreIDs(t *testing.T, expected, actual db.CardList) {
+	if len(expected) != len(actual) {
+		t.Fatalf("Length mismatch.  \nExpect: %v  \nActual: %v", expected, actual)
+	}
+
+	for i, exp := range expected {
+		// Ignore ID field.
+		act := actual[i]
+		if exp.Owner != act.Owner || exp.Front != act.Front || exp.Back != act.Back {
+			t.Errorf("Card mismatch.  Expect: %v  Actual: %v", exp, act)
+		}
+	}
+}
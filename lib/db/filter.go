@@ -0,0 +1,525 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filters narrow lists of cards, and searches, by what's on and known about
+// each card.  A filter compares fields with values, and combines comparisons
+// with AND, OR, NOT and parentheses:
+//
+//	deck = "user1@test.com:spanish" AND tag = verbs AND due < now+7d
+//	(front ~ hola OR back ~ hello) AND NOT tag = easy
+//	created > 2016-06-01 AND reps >= 3
+//
+// AND can be left out, so "tag = verbs due < now" is the same as "tag = verbs
+// AND due < now".  NOT binds tightest, then AND, then OR.  Keywords are
+// matched ignoring case, and values with spaces or any of ()=!<>~" in them
+// are quoted, as in Go.
+//
+// The fields are:
+//
+//	deck             the card's 'email:deck' owner
+//	front, back      the card's front and back
+//	tag              one of the card's tags
+//	due, created     when the card is due and when it was stored
+//	reps, interval   the card's schedule, as whole numbers
+//	box
+//	ease             the card's ease, which can be a fraction
+//
+// Text fields take = and != to match exactly, or ~ to match text containing
+// the value, ignoring case.  tag takes = and != to ask whether a card has a
+// tag.  Numbers take =, !=, <, <=, > and >=, and times all but = and !=.
+// Times are RFC 3339 times, dates such as 2016-06-01 (midnight, UTC), or
+// "now" or "today" (midnight), optionally moved by a number of hours, days or
+// weeks, as in now-12h, today+1d or now+2w.
+//
+// Filters are parsed into a tree, which DB compiles into a WHERE clause with
+// the values as parameters, and which Mem evaluates card by card.
+
+// maxFilter is the longest a filter can be, in bytes.
+const maxFilter = 1000
+
+// A filter is a parsed filter, or part of one.
+type filter interface {
+	// where returns the SQL condition for the filter, for cards aliased c in
+	// decks aliased d, with args and the filter's values appended to them.
+	where(args []interface{}) (string, []interface{})
+
+	// matches reports whether the card c, stored at created, passes the
+	// filter.  c's Owner is 'email:deck'.
+	matches(c Card, created time.Time) bool
+}
+
+type andFilter struct{ a, b filter }
+type orFilter struct{ a, b filter }
+type notFilter struct{ f filter }
+
+func (f andFilter) where(args []interface{}) (string, []interface{}) {
+	a, args := f.a.where(args)
+	b, args := f.b.where(args)
+	return "(" + a + " AND " + b + ")", args
+}
+
+func (f andFilter) matches(c Card, created time.Time) bool {
+	return f.a.matches(c, created) && f.b.matches(c, created)
+}
+
+func (f orFilter) where(args []interface{}) (string, []interface{}) {
+	a, args := f.a.where(args)
+	b, args := f.b.where(args)
+	return "(" + a + " OR " + b + ")", args
+}
+
+func (f orFilter) matches(c Card, created time.Time) bool {
+	return f.a.matches(c, created) || f.b.matches(c, created)
+}
+
+func (f notFilter) where(args []interface{}) (string, []interface{}) {
+	w, args := f.f.where(args)
+	return "NOT " + w, args
+}
+
+func (f notFilter) matches(c Card, created time.Time) bool {
+	return !f.f.matches(c, created)
+}
+
+// The kinds of value fields have.
+type fieldKind int
+
+const (
+	textField fieldKind = iota
+	tagField
+	timeField
+	intField
+	numField
+)
+
+// filterFields are the fields filters can compare, with their kinds and
+// their columns.
+var filterFields = map[string]struct {
+	kind fieldKind
+	col  string
+}{
+	"deck":     {textField, "d.OwnerEmail || ':' || d.Name"},
+	"front":    {textField, "c.Front"},
+	"back":     {textField, "c.Back"},
+	"tag":      {tagField, ""},
+	"due":      {timeField, "c.Due"},
+	"created":  {timeField, "c.InsertedDatetime"},
+	"reps":     {intField, "c.Reps"},
+	"interval": {intField, `c."Interval"`},
+	"box":      {intField, "c.Box"},
+	"ease":     {numField, "c.Ease"},
+}
+
+// filterOps are the operators each kind of field takes.
+var filterOps = map[fieldKind][]string{
+	textField: {"=", "!=", "~"},
+	tagField:  {"=", "!="},
+	timeField: {"<", "<=", ">", ">="},
+	intField:  {"=", "!=", "<", "<=", ">", ">="},
+	numField:  {"=", "!=", "<", "<=", ">", ">="},
+}
+
+// A cmpFilter compares field with a value, which is a string, int, float64
+// or time.Time as the field's kind calls for.
+type cmpFilter struct {
+	field, op string
+	value     interface{}
+}
+
+func (f cmpFilter) where(args []interface{}) (string, []interface{}) {
+	col := filterFields[f.field].col
+	switch v := f.value.(type) {
+	case string:
+		switch {
+		case f.field == "tag":
+			in := "IN"
+			if f.op == "!=" {
+				in = "NOT IN"
+			}
+			return "c.ID " + in + " (SELECT CardID FROM card_tags WHERE Tag = ?)", append(args, v)
+		case f.op == "~":
+			like := "%" + escapeLike(strings.ToLower(v)) + "%"
+			return "LOWER(" + col + `) LIKE ? ESCAPE '\'`, append(args, like)
+		}
+	case time.Time:
+		return col + " " + f.op + " ?", append(args, dbTime(v))
+	}
+	op := f.op
+	if op == "!=" {
+		op = "<>"
+	}
+	return col + " " + op + " ?", append(args, f.value)
+}
+
+func (f cmpFilter) matches(c Card, created time.Time) bool {
+	var got interface{}
+	switch f.field {
+	case "deck":
+		got = c.Owner
+	case "front":
+		got = c.Front
+	case "back":
+		got = c.Back
+	case "tag":
+		has := false
+		for _, t := range c.Tags {
+			has = has || t == f.value
+		}
+		return has == (f.op == "=")
+	case "due":
+		got = c.Due
+	case "created":
+		got = created
+	case "reps":
+		got = c.Reps
+	case "interval":
+		got = c.Interval
+	case "box":
+		got = c.Box
+	case "ease":
+		got = c.Ease
+	}
+
+	// cmp is -1, 0 or 1 as got comes before, is, or comes after the value.
+	var cmp int
+	switch v := f.value.(type) {
+	case string:
+		s := got.(string)
+		if f.op == "~" {
+			return strings.Contains(strings.ToLower(s), strings.ToLower(v))
+		}
+		cmp = strings.Compare(s, v)
+	case time.Time:
+		cmp = compareKeys([]interface{}{dbTime(got.(time.Time))}, []interface{}{dbTime(v)})
+	case int:
+		cmp = compareKeys([]interface{}{got.(int)}, []interface{}{v})
+	case float64:
+		x := got.(float64)
+		if x < v {
+			cmp = -1
+		} else if x > v {
+			cmp = 1
+		}
+	}
+	switch f.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// escapeLike escapes the wildcards of LIKE in s, with '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// listFilter parses l's Filter, with times relative to now, and returns nil
+// if it doesn't have one.
+func listFilter(l ListOp, now time.Time) (filter, error) {
+	if l.Filter == "" {
+		return nil, nil
+	}
+	if l.What != "cards" && l.What != "search" {
+		return nil, errorf(ErrInvalid, "db.List(): only cards can be filtered, not %s.", l.What)
+	}
+	if len(l.Filter) > maxFilter {
+		return nil, errorf(ErrInvalid, "db.List(): filter is longer than %d bytes.", maxFilter)
+	}
+	toks, err := lexFilter(l.Filter)
+	if err != nil {
+		return nil, errorf(ErrInvalid, "db.List(): bad filter %q: %v.", l.Filter, err)
+	}
+	p := &filterParser{toks: toks, now: now}
+	f, err := p.or()
+	if err == nil && p.pos < len(p.toks) {
+		err = fmt.Errorf("unexpected %s", p.toks[p.pos])
+	}
+	if err != nil {
+		return nil, errorf(ErrInvalid, "db.List(): bad filter %q: %v.", l.Filter, err)
+	}
+	return f, nil
+}
+
+// A filterToken is a word, a quoted value, an operator or a parenthesis.
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+func (t filterToken) String() string {
+	if t.quoted {
+		return strconv.Quote(t.text)
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// isOp reports whether t is the unquoted operator or parenthesis op.
+func (t filterToken) isOp(op string) bool {
+	return !t.quoted && t.text == op
+}
+
+// isKeyword reports whether t is the unquoted keyword kw, in any case.
+func (t filterToken) isKeyword(kw string) bool {
+	return !t.quoted && strings.EqualFold(t.text, kw)
+}
+
+// filterSpecial are the runes that end an unquoted word.
+const filterSpecial = `()=!<>~"`
+
+// lexFilter splits s into tokens.
+func lexFilter(s string) ([]filterToken, error) {
+	var toks []filterToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == '~' || c == '=':
+			toks = append(toks, filterToken{text: s[i : i+1]})
+			i++
+		case c == '!' || c == '<' || c == '>':
+			n := 1
+			if i+1 < len(s) && s[i+1] == '=' {
+				n = 2
+			}
+			if s[i:i+n] == "!" {
+				return nil, fmt.Errorf("'!' must be followed by '='")
+			}
+			toks = append(toks, filterToken{text: s[i : i+n]})
+			i += n
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated quote")
+			}
+			v, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("bad quoted value %s", s[i:j+1])
+			}
+			toks = append(toks, filterToken{text: v, quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(filterSpecial+" \t\n\r", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, filterToken{text: s[i:j]})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// A filterParser parses a filter's tokens by recursive descent.
+type filterParser struct {
+	toks []filterToken
+	pos  int
+	now  time.Time
+}
+
+// peek returns the next token, and whether there is one.
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos >= len(p.toks) {
+		return filterToken{}, false
+	}
+	return p.toks[p.pos], true
+}
+
+// next returns the next token and moves past it, or fails with what was
+// expected instead of the end of the filter.
+func (p *filterParser) next(expected string) (filterToken, error) {
+	t, ok := p.peek()
+	if !ok {
+		return t, fmt.Errorf("expected %s at end of filter", expected)
+	}
+	p.pos++
+	return t, nil
+}
+
+// or parses comparisons joined by OR.
+func (p *filterParser) or() (filter, error) {
+	f, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || !t.isKeyword("OR") {
+			return f, nil
+		}
+		p.pos++
+		g, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		f = orFilter{f, g}
+	}
+}
+
+// and parses comparisons joined by AND, or by nothing at all.
+func (p *filterParser) and() (filter, error) {
+	f, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, ok := p.peek()
+		if !ok || t.isKeyword("OR") || t.isOp(")") {
+			return f, nil
+		}
+		if t.isKeyword("AND") {
+			p.pos++
+		}
+		g, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		f = andFilter{f, g}
+	}
+}
+
+// not parses a comparison or parenthesized filter, possibly negated.
+func (p *filterParser) not() (filter, error) {
+	t, err := p.next("a comparison")
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t.isKeyword("NOT"):
+		f, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notFilter{f}, nil
+	case t.isOp("("):
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t, err := p.next("')'"); err != nil {
+			return nil, err
+		} else if !t.isOp(")") {
+			return nil, fmt.Errorf("expected ')', not %s", t)
+		}
+		return f, nil
+	}
+	return p.cmp(t)
+}
+
+// cmp parses the comparison that starts with the field named by t.
+func (p *filterParser) cmp(t filterToken) (filter, error) {
+	name := strings.ToLower(t.text)
+	field, ok := filterFields[name]
+	if !ok || t.quoted {
+		return nil, fmt.Errorf("unknown field %s", t)
+	}
+	op, err := p.next("an operator")
+	if err != nil {
+		return nil, err
+	}
+	allowed := false
+	for _, o := range filterOps[field.kind] {
+		allowed = allowed || op.isOp(o)
+	}
+	if !allowed {
+		return nil, fmt.Errorf("%s takes %s, not %s", name, strings.Join(filterOps[field.kind], " "), op)
+	}
+	v, err := p.next("a value")
+	if err != nil {
+		return nil, err
+	}
+	if !v.quoted && strings.ContainsAny(v.text, filterSpecial) {
+		return nil, fmt.Errorf("expected a value, not %s", v)
+	}
+
+	f := cmpFilter{field: name, op: op.text}
+	switch field.kind {
+	case textField:
+		f.value = v.text
+		if name == "deck" && op.text != "~" {
+			// Emails and deck names are stored in lower case.
+			f.value = strings.ToLower(v.text)
+		}
+	case tagField:
+		f.value = strings.ToLower(v.text)
+	case timeField:
+		f.value, err = filterTime(v.text, p.now)
+	case intField:
+		f.value, err = strconv.Atoi(v.text)
+		if err != nil {
+			err = fmt.Errorf("%s must be a whole number, not %s", name, v)
+		}
+	case numField:
+		f.value, err = strconv.ParseFloat(v.text, 64)
+		if err != nil {
+			err = fmt.Errorf("%s must be a number, not %s", name, v)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// filterTime parses the time s, relative to now.
+func filterTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	bad := fmt.Errorf("bad time %q", s)
+	base, offset := s, ""
+	if i := strings.IndexAny(s, "+-"); i >= 0 {
+		base, offset = s[:i], s[i:]
+	}
+	var t time.Time
+	switch strings.ToLower(base) {
+	case "now":
+		t = now
+	case "today":
+		t = now.UTC().Truncate(24 * time.Hour)
+	default:
+		return time.Time{}, bad
+	}
+	if offset == "" {
+		return t, nil
+	}
+	if len(offset) < 3 {
+		return time.Time{}, bad
+	}
+	n, err := strconv.Atoi(offset[:len(offset)-1])
+	if err != nil {
+		return time.Time{}, bad
+	}
+	switch offset[len(offset)-1] {
+	case 'h':
+		return t.Add(time.Duration(n) * time.Hour), nil
+	case 'd':
+		return t.AddDate(0, 0, n), nil
+	case 'w':
+		return t.AddDate(0, 0, 7*n), nil
+	}
+	return time.Time{}, bad
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/askcarter/test"
+)
+
+// TestFilterSQL checks that filters compile to SQL that keeps their values
+// out of the query, and nests the way the filter does.
+func TestFilterSQL(t *testing.T) {
+	c := test.Checker(t)
+
+	now := time.Date(2016, 6, 8, 20, 24, 47, 0, time.UTC)
+	for _, tt := range []struct {
+		filter string
+		where  string
+		args   []interface{}
+	}{
+		{`tag = Verbs`,
+			`c.ID IN (SELECT CardID FROM card_tags WHERE Tag = ?)`,
+			[]interface{}{"verbs"}},
+		{`deck = A:B box > 1 OR NOT ease <= 2`,
+			`((d.OwnerEmail || ':' || d.Name = ? AND c.Box > ?) OR NOT c.Ease <= ?)`,
+			[]interface{}{"a:b", 1, 2.0}},
+		{`tag != easy AND (front ~ "50%" OR reps != 3)`,
+			`(c.ID NOT IN (SELECT CardID FROM card_tags WHERE Tag = ?) AND (LOWER(c.Front) LIKE ? ESCAPE '\' OR c.Reps <> ?))`,
+			[]interface{}{"easy", `%50\%%`, 3}},
+		{`front = "'; DROP TABLE cards; --"`,
+			`c.Front = ?`,
+			[]interface{}{"'; DROP TABLE cards; --"}},
+		{`due < today+1w and created >= 2016-06-01T12:00:00+02:00`,
+			`(c.Due < ? AND c.InsertedDatetime >= ?)`,
+			[]interface{}{
+				time.Date(2016, 6, 15, 0, 0, 0, 0, time.UTC),
+				time.Date(2016, 6, 1, 10, 0, 0, 0, time.UTC),
+			}},
+	} {
+		f, err := listFilter(ListOp{What: "cards", Filter: tt.filter}, now)
+		c.Expect(test.EQ, nil, err)
+		where, args := f.where(nil)
+		c.Expect(test.EQ, tt.where, where)
+		c.Expect(test.EQ, tt.args, args)
+	}
+}
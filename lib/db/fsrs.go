@@ -0,0 +1,136 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+// FSRS schedules Cards with the Free Spaced Repetition Scheduler (v4.5),
+// which models each card's memory Stability, in days, and its Difficulty, from
+// 1 to 10.  See https://github.com/open-spaced-repetition/fsrs4anki/wiki for
+// details.
+//
+// Cards that were scheduled by SM-2 are carried over using their current
+// interval as their stability, so a deck can switch to FSRS at any time.
+type FSRS struct {
+	// Retention is the probability of recall that reviews are scheduled
+	// for.  Higher retention means more frequent reviews.
+	Retention float64 `json:"retention"`
+
+	// Weights are the 17 parameters of the FSRS model.
+	Weights []float64 `json:"weights"`
+}
+
+const (
+	fsrsDecay  = -0.5
+	fsrsFactor = 19.0 / 81.0
+
+	// maxInterval caps how far into the future any scheduler schedules a
+	// card, well short of where a Duration of that many days overflows.
+	maxInterval = 36500
+)
+
+// DefaultFSRS returns an FSRS scheduler using the model's published default
+// weights and a retention of 90%.
+func DefaultFSRS() FSRS {
+	return FSRS{
+		Retention: 0.9,
+		Weights: []float64{
+			0.4872, 1.4003, 3.7145, 13.8206, 5.1618, 1.2298, 0.8975, 0.031, 1.6474,
+			0.1367, 1.0461, 2.1072, 0.0793, 0.3246, 1.587, 0.2272, 2.8755,
+		},
+	}
+}
+
+func (f FSRS) validate() error {
+	if len(f.Weights) != 17 {
+		return errors.New("db.FSRS: weights must have 17 values.")
+	}
+	if f.Retention <= 0 || f.Retention >= 1 {
+		return errors.New("db.FSRS: retention must be between 0 and 1.")
+	}
+	return nil
+}
+
+// rating maps an SM-2 style grade onto FSRS's four ratings: 1 (again),
+// 2 (hard), 3 (good) and 4 (easy).
+func rating(g Grade) int {
+	switch {
+	case g < 3:
+		return 1
+	case g == 3:
+		return 2
+	case g == 4:
+		return 3
+	}
+	return 4
+}
+
+// Schedule returns a copy of c rescheduled for an answer graded g at now.
+func (f FSRS) Schedule(c Card, g Grade, now time.Time) Card {
+	w := f.Weights
+	r := rating(g)
+
+	if c.Stability == 0 && c.Reps == 0 && c.Interval == 0 {
+		// A card's first review.
+		c.Stability = w[r-1]
+		c.Difficulty = f.initDifficulty(r)
+	} else {
+		if c.Stability == 0 {
+			c.Stability = math.Max(float64(c.Interval), w[2])
+			c.Difficulty = f.initDifficulty(3)
+		}
+
+		// Time since the last review, which is when c was last scheduled.
+		last := c.Due.Add(-time.Duration(c.Interval) * Day)
+		elapsed := math.Max(now.Sub(last).Hours()/24, 0)
+		rec := math.Pow(1+fsrsFactor*elapsed/c.Stability, fsrsDecay)
+
+		if r == 1 {
+			c.Stability = math.Min(c.Stability, w[11]*
+				math.Pow(c.Difficulty, -w[12])*
+				(math.Pow(c.Stability+1, w[13])-1)*
+				math.Exp(w[14]*(1-rec)))
+		} else {
+			bonus := 1.0
+			if r == 2 {
+				bonus = w[15]
+			} else if r == 4 {
+				bonus = w[16]
+			}
+			c.Stability *= 1 + math.Exp(w[8])*
+				(11-c.Difficulty)*
+				math.Pow(c.Stability, -w[9])*
+				(math.Exp(w[10]*(1-rec))-1)*
+				bonus
+		}
+		c.Difficulty = f.nextDifficulty(c.Difficulty, r)
+	}
+
+	if r == 1 {
+		c.Reps = 0
+	} else {
+		c.Reps++
+	}
+
+	i := c.Stability / fsrsFactor * (math.Pow(f.Retention, 1/fsrsDecay) - 1)
+	c.Interval = int(math.Min(math.Max(math.Round(i), 1), maxInterval))
+	c.Due = now.Add(time.Duration(c.Interval) * Day)
+	return c
+}
+
+func (f FSRS) initDifficulty(r int) float64 {
+	return clampDifficulty(f.Weights[4] - float64(r-3)*f.Weights[5])
+}
+
+func (f FSRS) nextDifficulty(d float64, r int) float64 {
+	w := f.Weights
+	d -= w[6] * float64(r-3)
+	// Mean reversion toward the difficulty of a card first rated good.
+	return clampDifficulty(w[7]*f.initDifficulty(3) + (1-w[7])*d)
+}
+
+func clampDifficulty(d float64) float64 {
+	return math.Min(math.Max(d, 1), 10)
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Leitner schedules Cards with a Leitner box system.  Every card sits in a
+// numbered box, starting at box 1.  A correct answer promotes a card to the
+// next box, and a wrong one demotes it.  Cards in box n are reviewed every
+// Intervals[n-1] days.
+type Leitner struct {
+	// Intervals holds each box's review interval in days.  There are as
+	// many boxes as intervals.
+	Intervals []int `json:"intervals"`
+
+	// Demote decides where a wrongly answered card goes: "first" (the
+	// default) sends it back to box 1 and "down" moves it down one box.
+	Demote string `json:"demote,omitempty"`
+}
+
+// DefaultLeitner returns a five box Leitner system, with intervals doubling
+// from one day, that sends forgotten cards back to the first box.
+func DefaultLeitner() Leitner {
+	return Leitner{Intervals: []int{1, 2, 4, 8, 16}, Demote: "first"}
+}
+
+func (l Leitner) validate() error {
+	if len(l.Intervals) == 0 {
+		return errors.New("db.Leitner: there must be at least one box.")
+	}
+	for _, i := range l.Intervals {
+		if i < 1 {
+			return errors.New("db.Leitner: box intervals must be at least a day.")
+		}
+		if i > maxInterval {
+			return fmt.Errorf("db.Leitner: box intervals must be at most %d days.", maxInterval)
+		}
+	}
+	switch l.Demote {
+	case "", "first", "down":
+		return nil
+	}
+	return errors.New(`db.Leitner: demote must be "first" or "down".`)
+}
+
+// Schedule returns a copy of c rescheduled for an answer graded g at now.
+func (l Leitner) Schedule(c Card, g Grade, now time.Time) Card {
+	if c.Box < 1 {
+		c.Box = 1
+	}
+
+	if g >= 3 {
+		if c.Box < len(l.Intervals) {
+			c.Box++
+		}
+		c.Reps++
+	} else {
+		if l.Demote == "down" && c.Box > 1 {
+			c.Box--
+		} else {
+			c.Box = 1
+		}
+		c.Reps = 0
+	}
+	// Boxes may have been removed since the card was last reviewed.
+	if c.Box > len(l.Intervals) {
+		c.Box = len(l.Intervals)
+	}
+
+	// Leitners made without NewScheduler haven't had their intervals
+	// checked.
+	c.Interval = l.Intervals[c.Box-1]
+	if c.Interval > maxInterval {
+		c.Interval = maxInterval
+	}
+	c.Due = now.Add(time.Duration(c.Interval) * Day)
+	return c
+}
@@ -0,0 +1,966 @@
+package db
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mem is a DataSource that keeps its data in memory, for tests and demos
+// that shouldn't need an SQLite file (or cgo).  It follows the same rules as
+// DB: the same queries match the same things, in the same order.  A Mem is
+// safe for concurrent use, and forgets everything when it's closed.
+type Mem struct {
+	mu sync.RWMutex
+
+	users   map[string]User
+	decks   map[int]Deck
+	cards   map[int]Card
+	created map[int]time.Time // when each card was first stored
+	reviews []Review
+	keys    map[int]APIKey
+	groups  map[string]Group
+	shares  []Share
+
+	// lastID holds the last id handed out for decks, cards, reviews and keys.
+	lastID map[string]int
+}
+
+// Open readies m for use.  The name it's given is ignored.
+func (m *Mem) Open(string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.users = map[string]User{}
+	m.decks = map[int]Deck{}
+	m.cards = map[int]Card{}
+	m.created = map[int]time.Time{}
+	m.reviews = nil
+	m.keys = map[int]APIKey{}
+	m.groups = map[string]Group{}
+	m.shares = nil
+	m.lastID = map[string]int{}
+	return nil
+}
+
+// Close empties m.
+func (m *Mem) Close() error {
+	return m.Open("")
+}
+
+// Init reads [users|decks|cards].json files from the given directory, and
+// then stores them in m.  As with DB, nothing is stored unless everything
+// can be: the files are stored in a copy of m, which only replaces m once
+// they all are.
+func (m *Mem) Init(dir string) error {
+	var lss []ListStorer
+	files := []string{"users.json", "decks.json", "cards.json"}
+	for _, f := range files {
+		ls, err := readFromDisk(filepath.Join(dir, f))
+		if err != nil {
+			return err
+		}
+		lss = append(lss, ls)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	staged := m.clone()
+	for _, ls := range lss {
+		if err := staged.Store(ls); err != nil {
+			return err
+		}
+	}
+	m.users, m.decks, m.cards, m.created = staged.users, staged.decks, staged.cards, staged.created
+	m.reviews, m.keys, m.groups, m.shares = staged.reviews, staged.keys, staged.groups, staged.shares
+	m.lastID = staged.lastID
+	return nil
+}
+
+// clone returns a copy of m, which can be changed without changing m.  The
+// caller must hold m.mu.
+func (m *Mem) clone() *Mem {
+	c := &Mem{}
+	c.Open("")
+	for k, v := range m.users {
+		c.users[k] = v
+	}
+	for k, v := range m.decks {
+		c.decks[k] = v
+	}
+	for k, v := range m.cards {
+		v.Tags = append([]string(nil), v.Tags...)
+		c.cards[k] = v
+	}
+	for k, v := range m.created {
+		c.created[k] = v
+	}
+	for k, v := range m.keys {
+		c.keys[k] = v
+	}
+	for k, v := range m.groups {
+		v.Members = append([]string(nil), v.Members...)
+		c.groups[k] = v
+	}
+	for k, v := range m.lastID {
+		c.lastID[k] = v
+	}
+	c.reviews = append([]Review(nil), m.reviews...)
+	c.shares = append([]Share(nil), m.shares...)
+	return c
+}
+
+func (m *Mem) nextID(table string) int {
+	m.lastID[table]++
+	return m.lastID[table]
+}
+
+// deckKey returns the 'email:deck' name of the deck with the given id.
+func (m *Mem) deckKey(id int) string {
+	d := m.decks[id]
+	return d.Owner + ":" + d.Name
+}
+
+// findDeck returns the id of the deck owner has called name.
+func (m *Mem) findDeck(owner, name string) (int, bool) {
+	for id, d := range m.decks {
+		if d.Owner == owner && d.Name == name {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// cardDeck returns the ID of the deck c belongs to, named either by its
+// DeckID or by its legacy 'email:deck' Owner.
+func (m *Mem) cardDeck(c Card) (int, error) {
+	if c.DeckID != 0 {
+		if _, ok := m.decks[c.DeckID]; !ok {
+			return 0, errorf(ErrInvalid, "db.Store(): card %q has no deck %d.", c.Front, c.DeckID)
+		}
+		return c.DeckID, nil
+	}
+
+	email, name, ok := splitOwner(strings.ToLower(c.Owner))
+	if !ok {
+		return 0, errorf(ErrInvalid, "db.Store(): card %q has no deck.", c.Front)
+	}
+	id, ok := m.findDeck(email, name)
+	if !ok {
+		return 0, errorf(ErrInvalid, "db.Store(): card %q has no deck %q.", c.Front, c.Owner)
+	}
+	return id, nil
+}
+
+// Store inserts the elements of ls into m, replacing any users or decks
+// that already exist.  Decks must belong to a stored user, and cards to a
+// stored deck.  Cards stored with an ID replace that card, or fail with
+// ErrNotFound if there isn't one.  Nothing is stored unless everything can
+// be.  The IDs of stored decks and cards are set in ls.
+func (m *Mem) Store(ls ListStorer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch ls := ls.(type) {
+	case DeckList:
+		decks := make(DeckList, len(ls))
+		for i, d := range ls {
+			d = d.Normalize()
+			if _, err := NewScheduler(d.Scheduler, d.Params); err != nil {
+				return err
+			}
+			if _, ok := m.users[d.Owner]; !ok {
+				return errorf(ErrInvalid, "db.Store(): deck %q has no owner %q.", d.Name, d.Owner)
+			}
+			decks[i] = d
+		}
+		for i, d := range decks {
+			id, ok := m.findDeck(d.Owner, d.Name)
+			if !ok {
+				id = m.nextID("decks")
+			}
+			d.ID = id
+			m.decks[id] = d
+			ls[i].ID = id
+		}
+	case UserList:
+		for _, u := range ls {
+			if err := u.validate(); err != nil {
+				return err
+			}
+		}
+		for _, u := range ls {
+			u.Email = strings.ToLower(u.Email)
+			old, ok := m.users[u.Email]
+			if u.Password == "" {
+				u.Password = old.Password
+			}
+			if u.Role == "" {
+				u.Role = old.Role
+			}
+			if !ok && u.Role == "" {
+				u.Role = RoleEditor
+			}
+			m.users[u.Email] = u
+		}
+	case CardList:
+		now := time.Now()
+		cards := make(CardList, len(ls))
+		for i, c := range ls {
+			if _, ok := m.cards[c.ID]; c.ID != 0 && !ok {
+				return ErrNotFound
+			}
+			id, err := m.cardDeck(c)
+			if err != nil {
+				return err
+			}
+			c.DeckID, c.Owner = id, ""
+			if c.Due.IsZero() {
+				c.Due = now
+			}
+			c.Due = dbTime(c.Due)
+			if c.Ease == 0 {
+				c.Ease = DefaultEase
+			}
+			if c.Tags, err = c.normalTags(); err != nil {
+				return err
+			}
+			cards[i] = c
+		}
+		for i, c := range cards {
+			if c.ID == 0 {
+				c.ID = m.nextID("cards")
+				m.created[c.ID] = dbTime(now)
+			}
+			m.cards[c.ID] = c
+			ls[i].ID = c.ID
+		}
+	case ReviewList:
+		for _, r := range ls {
+			r.ID = m.nextID("reviews")
+			r.User = strings.ToLower(r.User)
+			r.At = dbTime(r.At)
+			m.reviews = append(m.reviews, r)
+		}
+	case APIKeyList:
+		now := dbTime(time.Now())
+		hashes := map[string]bool{}
+		for _, k := range m.keys {
+			hashes[k.Hash] = true
+		}
+		for _, k := range ls {
+			if err := k.validate(); err != nil {
+				return err
+			}
+			if _, ok := m.users[strings.ToLower(k.Owner)]; !ok {
+				return errorf(ErrInvalid, "db.Store(): key %q has no owner %q.", k.Name, k.Owner)
+			}
+			if hashes[k.Hash] {
+				return errorf(ErrConflict, "db.Store(): key %q already exists.", k.Name)
+			}
+			hashes[k.Hash] = true
+		}
+		for _, k := range ls {
+			k.ID = m.nextID("keys")
+			k.Owner = strings.ToLower(k.Owner)
+			k.Created, k.Revoked = now, nil
+			m.keys[k.ID] = k
+		}
+	case GroupList:
+		groups := make(GroupList, len(ls))
+		for i, g := range ls {
+			g.Name, g.Owner = strings.ToLower(g.Name), strings.ToLower(g.Owner)
+			if g.Name == "" {
+				return errorf(ErrInvalid, "db.Store(): group has no name.")
+			}
+			if _, ok := m.users[g.Owner]; !ok {
+				return errorf(ErrInvalid, "db.Store(): group %q has no owner %q.", g.Name, g.Owner)
+			}
+			if old, ok := m.groups[g.Name]; ok && old.Owner != g.Owner {
+				return errorf(ErrConflict, "db.Store(): group %q belongs to someone else.", g.Name)
+			}
+			seen := map[string]bool{}
+			var members []string
+			for _, e := range g.Members {
+				e = strings.ToLower(e)
+				if _, ok := m.users[e]; !ok {
+					return errorf(ErrInvalid, "db.Store(): group %q has no member %q.", g.Name, e)
+				}
+				if !seen[e] {
+					seen[e] = true
+					members = append(members, e)
+				}
+			}
+			sort.Strings(members)
+			g.Members = members
+			groups[i] = g
+		}
+		for _, g := range groups {
+			m.groups[g.Name] = g
+		}
+	case ShareList:
+		shares := make(ShareList, len(ls))
+		for i, sh := range ls {
+			if err := sh.validate(); err != nil {
+				return err
+			}
+			sh.User, sh.Group = strings.ToLower(sh.User), strings.ToLower(sh.Group)
+			if _, ok := m.decks[sh.DeckID]; !ok {
+				return errorf(ErrInvalid, "db.Store(): share has no deck %d.", sh.DeckID)
+			}
+			_, user := m.users[sh.User]
+			_, group := m.groups[sh.Group]
+			if !user && !group {
+				return errorf(ErrInvalid, "db.Store(): deck %d can't be shared with unknown %q.", sh.DeckID, sh.User+sh.Group)
+			}
+			shares[i] = sh
+		}
+		for _, sh := range shares {
+			m.deleteShares(func(s Share) bool { return sameGrant(s, sh) })
+			m.shares = append(m.shares, sh)
+		}
+	default:
+		return errorf(ErrInvalid, "db.Store: bad typed (%T) passed in.", ls)
+	}
+	return nil
+}
+
+// Update changes the users, decks or cards in ls, named by their email or
+// ID, and returns ErrNotFound if any of them don't exist.  Nothing is updated
+// unless everything can be.
+func (m *Mem) Update(ls ListStorer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch ls := ls.(type) {
+	case UserList:
+		users := make(UserList, len(ls))
+		for i, u := range ls {
+			if err := u.validate(); err != nil {
+				return err
+			}
+			old, ok := m.users[strings.ToLower(u.Email)]
+			if !ok {
+				return ErrNotFound
+			}
+			old.Name = u.Name
+			if u.Role != "" {
+				old.Role = u.Role
+			}
+			users[i] = old
+		}
+		for _, u := range users {
+			m.users[u.Email] = u
+		}
+	case DeckList:
+		decks := make(DeckList, len(ls))
+		for i, d := range ls {
+			old, ok := m.decks[d.ID]
+			if !ok {
+				return ErrNotFound
+			}
+			d.Name, d.Scheduler = strings.ToLower(d.Name), strings.ToLower(d.Scheduler)
+			if d.Name == "" {
+				return errorf(ErrInvalid, "db.Update(): deck %d has no name.", d.ID)
+			}
+			if _, err := NewScheduler(d.Scheduler, d.Params); err != nil {
+				return err
+			}
+			if id, ok := m.findDeck(old.Owner, d.Name); ok && id != d.ID {
+				return errorf(ErrConflict, "db.Update(): %q already has a deck %q.", old.Owner, d.Name)
+			}
+			old.Name, old.Desc, old.Scheduler, old.Params = d.Name, d.Desc, d.Scheduler, d.Params
+			decks[i] = old
+		}
+		for _, d := range decks {
+			m.decks[d.ID] = d
+		}
+	case CardList:
+		cards := make(CardList, len(ls))
+		for i, c := range ls {
+			old, ok := m.cards[c.ID]
+			if !ok {
+				return ErrNotFound
+			}
+			if c.DeckID != 0 {
+				if _, ok := m.decks[c.DeckID]; !ok {
+					return errorf(ErrInvalid, "db.Update(): card %d has no deck %d.", c.ID, c.DeckID)
+				}
+				old.DeckID = c.DeckID
+			}
+			tags, err := c.normalTags()
+			if err != nil {
+				return err
+			}
+			old.Front, old.Back, old.Tags = c.Front, c.Back, tags
+			cards[i] = old
+		}
+		for _, c := range cards {
+			m.cards[c.ID] = c
+		}
+	default:
+		return errorf(ErrInvalid, "db.Update: bad typed (%T) passed in.", ls)
+	}
+	return nil
+}
+
+// Delete deletes the users, decks, cards, groups or shares in ls, and
+// returns ErrNotFound if any of them don't exist.  Deleting something
+// deletes whatever it owned, as DB's foreign keys do.
+func (m *Mem) Delete(ls ListStorer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch ls := ls.(type) {
+	case UserList:
+		for _, u := range ls {
+			if _, ok := m.users[strings.ToLower(u.Email)]; !ok {
+				return ErrNotFound
+			}
+		}
+		for _, u := range ls {
+			m.deleteUser(strings.ToLower(u.Email))
+		}
+	case DeckList:
+		for _, d := range ls {
+			if _, ok := m.decks[d.ID]; !ok {
+				return ErrNotFound
+			}
+		}
+		for _, d := range ls {
+			m.deleteDeck(d.ID)
+		}
+	case CardList:
+		for _, c := range ls {
+			if _, ok := m.cards[c.ID]; !ok {
+				return ErrNotFound
+			}
+		}
+		for _, c := range ls {
+			delete(m.cards, c.ID)
+			delete(m.created, c.ID)
+		}
+	case GroupList:
+		for _, g := range ls {
+			if _, ok := m.groups[strings.ToLower(g.Name)]; !ok {
+				return ErrNotFound
+			}
+		}
+		for _, g := range ls {
+			m.deleteGroup(strings.ToLower(g.Name))
+		}
+	case ShareList:
+		for _, sh := range ls {
+			found := false
+			for _, s := range m.shares {
+				found = found || sameGrant(s, sh)
+			}
+			if !found {
+				return ErrNotFound
+			}
+		}
+		for _, sh := range ls {
+			m.deleteShares(func(s Share) bool { return sameGrant(s, sh) })
+		}
+	default:
+		return errorf(ErrInvalid, "db.Delete: bad typed (%T) passed in.", ls)
+	}
+	return nil
+}
+
+// deleteUser deletes the user with the given email, and everything they own.
+func (m *Mem) deleteUser(email string) {
+	delete(m.users, email)
+	for id, d := range m.decks {
+		if d.Owner == email {
+			m.deleteDeck(id)
+		}
+	}
+	for id, k := range m.keys {
+		if k.Owner == email {
+			delete(m.keys, id)
+		}
+	}
+	for name, g := range m.groups {
+		if g.Owner == email {
+			m.deleteGroup(name)
+			continue
+		}
+		var members []string
+		for _, e := range g.Members {
+			if e != email {
+				members = append(members, e)
+			}
+		}
+		g.Members = members
+		m.groups[name] = g
+	}
+	m.deleteShares(func(s Share) bool { return s.User == email })
+}
+
+// deleteDeck deletes the deck with the given id, and its cards and shares.
+func (m *Mem) deleteDeck(id int) {
+	delete(m.decks, id)
+	for cid, c := range m.cards {
+		if c.DeckID == id {
+			delete(m.cards, cid)
+			delete(m.created, cid)
+		}
+	}
+	m.deleteShares(func(s Share) bool { return s.DeckID == id })
+}
+
+// deleteGroup deletes the named group, and the shares made with it.
+func (m *Mem) deleteGroup(name string) {
+	delete(m.groups, name)
+	m.deleteShares(func(s Share) bool { return s.Group == name })
+}
+
+// sameGrant reports whether the stored share s shares the same deck with the
+// same user or group as sh.
+func sameGrant(s, sh Share) bool {
+	return s.DeckID == sh.DeckID &&
+		(s.User != "" && s.User == strings.ToLower(sh.User) ||
+			s.Group != "" && s.Group == strings.ToLower(sh.Group))
+}
+
+// deleteShares deletes the shares that del reports true for.
+func (m *Mem) deleteShares(del func(Share) bool) {
+	kept := m.shares[:0]
+	for _, s := range m.shares {
+		if !del(s) {
+			kept = append(kept, s)
+		}
+	}
+	m.shares = kept
+}
+
+// access returns the most user can do with the deck with the given id when
+// it isn't theirs: AccessEdit, AccessRead, or "" if it isn't shared with
+// them.
+func (m *Mem) access(user string, id int) string {
+	a := ""
+	for _, sh := range m.shares {
+		if sh.DeckID != id || a == AccessEdit {
+			continue
+		}
+		if sh.User == user || sh.Group != "" && m.inGroup(user, sh.Group) {
+			a = sh.Access
+		}
+	}
+	return a
+}
+
+// inGroup reports whether user is a member of the named group.
+func (m *Mem) inGroup(user, group string) bool {
+	for _, e := range m.groups[group].Members {
+		if e == user {
+			return true
+		}
+	}
+	return false
+}
+
+// Review grades the card named by r and stores its new schedule.  It returns
+// ErrNotFound if there is no such card.
+func (m *Mem) Review(r ReviewOp) (Card, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.cards[r.CardID]
+	if !ok {
+		return Card{}, ErrNotFound
+	}
+	d := m.decks[c.DeckID]
+	// Other users' cards may as well not exist, unless they're shared.
+	if user := strings.ToLower(r.User); user != "" && user != d.Owner &&
+		m.access(user, d.ID) == "" {
+		return Card{}, ErrNotFound
+	}
+	s, err := NewScheduler(d.Scheduler, d.Params)
+	if err != nil {
+		return Card{}, err
+	}
+
+	prev := c.Interval
+	c = s.Schedule(c, r.Grade, r.At)
+	c.Due = dbTime(c.Due)
+	m.cards[c.ID] = c
+
+	m.reviews = append(m.reviews, Review{
+		ID:           m.nextID("reviews"),
+		CardID:       c.ID,
+		User:         strings.ToLower(r.User),
+		Grade:        r.Grade,
+		At:           dbTime(r.At),
+		PrevInterval: prev,
+		NextInterval: c.Interval,
+		ResponseMS:   int(r.ResponseTime / time.Millisecond),
+	})
+
+	c.Owner = m.deckKey(c.DeckID)
+	return c, nil
+}
+
+// Credentials returns the password hash of the user with the given email, or
+// ErrNotFound if there's no such user.
+func (m *Mem) Credentials(email string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[strings.ToLower(email)]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return u.Password, nil
+}
+
+// Role returns the role of the user with the given email, or ErrNotFound if
+// there's no such user.
+func (m *Mem) Role(email string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[strings.ToLower(email)]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return u.Role, nil
+}
+
+// SetCredentials replaces the password hash of the user with the given email,
+// or returns ErrNotFound if there's no such user.
+func (m *Mem) SetCredentials(email, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u, ok := m.users[strings.ToLower(email)]
+	if !ok {
+		return ErrNotFound
+	}
+	u.Password = hash
+	m.users[u.Email] = u
+	return nil
+}
+
+// CreateDeck stores d, a deck its owner doesn't have yet, and returns it as
+// stored, or returns ErrConflict if its owner already has a deck with its
+// name.
+func (m *Mem) CreateDeck(d Deck) (Deck, error) {
+	d = d.Normalize()
+	if _, err := NewScheduler(d.Scheduler, d.Params); err != nil {
+		return Deck{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[d.Owner]; !ok {
+		return Deck{}, errorf(ErrInvalid, "db.CreateDeck(): deck %q has no owner %q.", d.Name, d.Owner)
+	}
+	if _, ok := m.findDeck(d.Owner, d.Name); ok {
+		return Deck{}, errorf(ErrConflict, "db.CreateDeck(): %q already has a deck %q.", d.Owner, d.Name)
+	}
+	d.ID = m.nextID("decks")
+	m.decks[d.ID] = d
+	return d, nil
+}
+
+// CreateUser stores u, a user who doesn't exist yet, with their password
+// hash, or returns ErrConflict if the email is taken.  Users created without a
+// role are editors.
+func (m *Mem) CreateUser(u User) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	u.Email = strings.ToLower(u.Email)
+	if _, ok := m.users[u.Email]; ok {
+		return errorf(ErrConflict, "db.CreateUser(): %q already exists.", u.Email)
+	}
+	if u.Role == "" {
+		u.Role = RoleEditor
+	}
+	m.users[u.Email] = u
+	return nil
+}
+
+// APIKey returns the unrevoked API key with the given hash, or ErrNotFound if
+// there isn't one.
+func (m *Mem) APIKey(hash string) (APIKey, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, k := range m.keys {
+		if k.Hash == hash && k.Revoked == nil {
+			return k, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+// RevokeAPIKey revokes the API key with the given id, or returns ErrNotFound
+// if there's no such key.  Revoking a key again changes nothing.
+func (m *Mem) RevokeAPIKey(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	k, ok := m.keys[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if k.Revoked == nil {
+		now := dbTime(time.Now())
+		k.Revoked = &now
+		m.keys[id] = k
+	}
+	return nil
+}
+
+// match reports whether s matches query q: exactly or, if q ends in '*', as
+// a prefix.
+func match(q, s string) bool {
+	if strings.HasSuffix(q, "*") {
+		return strings.HasPrefix(s, strings.TrimRight(q, "*"))
+	}
+	return s == q
+}
+
+// Stream calls fn with each result that List would return for l.  m's data
+// is in memory anyway, so the results are listed first, and fn is called
+// without m locked.
+func (m *Mem) Stream(l ListOp, fn func(interface{}) error) error {
+	ls, err := m.List(l)
+	if err != nil {
+		return err
+	}
+	return each(ls, fn)
+}
+
+// List retrieves ListStorers from m as specified by a ListOp.
+func (m *Mem) List(l ListOp) (ListStorer, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Emails and deck names are stored in lower case.
+	q := strings.ToLower(l.Query)
+	user := strings.ToLower(l.User)
+	// owned reports whether something owned by the given email is in scope.
+	owned := func(email string) bool {
+		return user == "" || email == user
+	}
+	// visible reports whether d is in scope, and how it was shared if it
+	// isn't l.User's own.
+	visible := func(d Deck) (string, bool) {
+		if owned(d.Owner) {
+			return "", true
+		}
+		a := m.access(user, d.ID)
+		return a, a != ""
+	}
+	key, err := cursorKey(l)
+	if err != nil {
+		return nil, err
+	}
+	f, err := listFilter(l, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// card returns c as it's listed, if l lists it.
+	card := func(c Card) (Card, bool) {
+		d := m.decks[c.DeckID]
+		if _, ok := visible(d); !match(q, d.Owner+":"+d.Name) || !ok {
+			return c, false
+		}
+		if l.ID != 0 && l.ID != c.ID {
+			return c, false
+		}
+		c.Owner = d.Owner + ":" + d.Name
+		c.Tags = append([]string(nil), c.Tags...)
+		return c, f == nil || f.matches(c, m.created[c.ID])
+	}
+	// after returns the index of the first of n sorted results that comes
+	// after l's cursor, where at returns the i'th result.
+	after := func(n int, at func(i int) interface{}) int {
+		if key == nil {
+			return 0
+		}
+		return sort.Search(n, func(i int) bool {
+			return compareKeys(sortKey(l, at(i)), key) > 0
+		})
+	}
+
+	switch l.What {
+	case "users":
+		var result UserList
+		for _, u := range m.users {
+			if match(q, u.Email) && owned(u.Email) {
+				u.Password = ""
+				result = append(result, u)
+			}
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].Email < result[j].Email
+		})
+		result = result[after(len(result), func(i int) interface{} { return result[i] }):]
+		if l.Limit > 0 && len(result) > l.Limit {
+			result = result[:l.Limit]
+		}
+		return result, nil
+	case "decks":
+		var result DeckList
+		for _, d := range m.decks {
+			a, ok := visible(d)
+			if match(q, d.Owner+":"+d.Name) && ok && (l.ID == 0 || l.ID == d.ID) {
+				d.Access = a
+				result = append(result, d)
+			}
+		}
+		sort.Slice(result, func(i, j int) bool {
+			a, b := result[i], result[j]
+			if a.Owner != b.Owner {
+				return a.Owner < b.Owner
+			}
+			return a.Name < b.Name
+		})
+		result = result[after(len(result), func(i int) interface{} { return result[i] }):]
+		if l.Limit > 0 && len(result) > l.Limit {
+			result = result[:l.Limit]
+		}
+		return result, nil
+	case "cards":
+		var result CardList
+		for _, c := range m.cards {
+			c, ok := card(c)
+			if !ok || !l.Due.IsZero() && c.Due.After(l.Due) {
+				continue
+			}
+			result = append(result, c)
+		}
+		sort.Slice(result, func(i, j int) bool {
+			a, b := result[i], result[j]
+			if !l.Due.IsZero() && !a.Due.Equal(b.Due) {
+				return a.Due.Before(b.Due)
+			}
+			if l.Due.IsZero() && a.Owner != b.Owner {
+				return ownerLess(a.Owner, b.Owner)
+			}
+			return a.ID < b.ID
+		})
+		result = result[after(len(result), func(i int) interface{} { return result[i] }):]
+		if l.Limit > 0 && len(result) > l.Limit {
+			result = result[:l.Limit]
+		}
+		return result, nil
+	case "search":
+		terms := searchTerms(l.Search)
+		if len(terms) == 0 {
+			return nil, errorf(ErrInvalid, "db.List(): nothing to search for in %q.", l.Search)
+		}
+		var result HitList
+		for _, c := range m.cards {
+			c, ok := card(c)
+			if !ok {
+				continue
+			}
+			if h, ok := matchCard(c, terms); ok {
+				result = append(result, h)
+			}
+		}
+		sortHits(result)
+		if l.Limit > 0 && len(result) > l.Limit {
+			result = result[:l.Limit]
+		}
+		return result, nil
+	case "reviews":
+		var result ReviewList
+		for _, r := range m.reviews {
+			if match(q, r.User) && owned(r.User) {
+				result = append(result, r)
+			}
+		}
+		sort.SliceStable(result, func(i, j int) bool {
+			a, b := result[i], result[j]
+			if !a.At.Equal(b.At) {
+				return a.At.Before(b.At)
+			}
+			return a.ID < b.ID
+		})
+		result = result[after(len(result), func(i int) interface{} { return result[i] }):]
+		if l.Limit > 0 && len(result) > l.Limit {
+			result = result[:l.Limit]
+		}
+		return result, nil
+	case "keys":
+		var result APIKeyList
+		for _, k := range m.keys {
+			if match(q, k.Owner) && owned(k.Owner) {
+				k.Hash = ""
+				result = append(result, k)
+			}
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].ID < result[j].ID
+		})
+		result = result[after(len(result), func(i int) interface{} { return result[i] }):]
+		if l.Limit > 0 && len(result) > l.Limit {
+			result = result[:l.Limit]
+		}
+		return result, nil
+	case "groups":
+		var result GroupList
+		for _, g := range m.groups {
+			if match(q, g.Name) && (owned(g.Owner) || m.inGroup(user, g.Name)) {
+				g.Members = append([]string(nil), g.Members...)
+				result = append(result, g)
+			}
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].Name < result[j].Name
+		})
+		result = result[after(len(result), func(i int) interface{} { return result[i] }):]
+		if l.Limit > 0 && len(result) > l.Limit {
+			result = result[:l.Limit]
+		}
+		return result, nil
+	case "shares":
+		var result ShareList
+		for _, sh := range m.shares {
+			d := m.decks[sh.DeckID]
+			if match(q, d.Owner+":"+d.Name) && owned(d.Owner) {
+				result = append(result, sh)
+			}
+		}
+		sort.Slice(result, func(i, j int) bool {
+			a, b := result[i], result[j]
+			if a.DeckID != b.DeckID {
+				return a.DeckID < b.DeckID
+			}
+			if a.User != b.User {
+				return a.User < b.User
+			}
+			return a.Group < b.Group
+		})
+		result = result[after(len(result), func(i int) interface{} { return result[i] }):]
+		if l.Limit > 0 && len(result) > l.Limit {
+			result = result[:l.Limit]
+		}
+		return result, nil
+	}
+
+	return nil, errorf(ErrInvalid, "db.List(): unknown type passed in: %s", l.What)
+}
+
+// ownerLess orders 'email:deck' owners by email, then deck, as DB does.
+func ownerLess(a, b string) bool {
+	ae, an, _ := splitOwner(a)
+	be, bn, _ := splitOwner(b)
+	if ae != be {
+		return ae < be
+	}
+	return an < bn
+}
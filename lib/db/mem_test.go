@@ -0,0 +1,59 @@
+package db_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/askcarter/spacerep/lib/db"
+	"github.com/askcarter/test"
+)
+
+func TestMemConcurrency(t *testing.T) {
+	c := test.Checker(t)
+
+	m := &db.Mem{}
+	err := m.Open("")
+	c.Expect(test.EQ, nil, err)
+	err = m.Store(db.UserList{{Email: "user1"}})
+	c.Expect(test.EQ, nil, err)
+	err = m.Store(db.DeckList{{Owner: "user1", Name: "deck1"}})
+	c.Expect(test.EQ, nil, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			card := db.Card{Owner: "user1:deck1", Front: fmt.Sprint(i), Back: "x"}
+			if err := m.Store(db.CardList{card}); err != nil {
+				t.Error(err)
+			}
+			if _, err := m.List(db.ListOp{What: "cards", Query: "*"}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	got, err := m.List(db.ListOp{What: "cards", Query: "user1:*"})
+	c.Expect(test.EQ, nil, err)
+	cards := got.(db.CardList)
+	c.Expect(test.EQ, 10, len(cards))
+
+	for _, card := range cards {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			if _, err := m.Review(db.ReviewOp{CardID: id, User: "user1", Grade: db.Good, At: time.Now()}); err != nil {
+				t.Error(err)
+			}
+		}(card.ID)
+	}
+	wg.Wait()
+
+	got, err = m.List(db.ListOp{What: "reviews", Query: "user1"})
+	c.Expect(test.EQ, nil, err)
+	c.Expect(test.EQ, 10, len(got.(db.ReviewList)))
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations are SQL files named NNNN_name.sql, where NNNN is the schema
+// version they bring a database up to.  They are applied in order and never
+// edited once released; schema changes go in a new migration.
+//
+// Each database has its own migrations.  PostgreSQL support was added at
+// schema version 6, so its migrations start there.  Versions mean the same
+// schema for both, so a migration only one of them needs leaves a gap in the
+// other's: SQLite has no 0009, since its search index isn't made by a
+// migration (see search.go), and PostgreSQL no 0011, since it has always
+// stored times as timestamps rather than text.
+//
+//go:embed migrations/sqlite3/*.sql migrations/postgres/*.sql
+var migrationFiles embed.FS
+
+// A Migration is one step in the history of the database schema.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// migrations returns the migrations in dir, in version order.
+func migrations(dir string) ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, path.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []Migration
+	for _, f := range files {
+		name := strings.TrimSuffix(path.Base(f), ".sql")
+		i := strings.Index(name, "_")
+		if i < 0 {
+			return nil, fmt.Errorf("db.migrations(): bad migration name %q.", f)
+		}
+		v, err := strconv.Atoi(name[:i])
+		if err != nil {
+			return nil, fmt.Errorf("db.migrations(): bad migration name %q.", f)
+		}
+		b, err := migrationFiles.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, Migration{Version: v, Name: name[i+1:], SQL: string(b)})
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+// queryer is the part of sql.DB and sql.Tx that version needs.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// version returns the schema version of db, read through q, creating the
+// table that records it if need be.  A database that has never been migrated
+// is at version 0.
+func (db *DB) version(q queryer) (int, error) {
+	cmd := `
+    CREATE TABLE IF NOT EXISTS schema_version(
+        Version INTEGER PRIMARY KEY,
+        Name TEXT,
+        AppliedDatetime TIMESTAMP
+    )`
+	if _, err := q.Exec(cmd); err != nil {
+		return 0, err
+	}
+
+	var v int
+	err := q.QueryRow(`SELECT COALESCE(MAX(Version), 0) FROM schema_version`).Scan(&v)
+	return v, err
+}
+
+// MigrationStatus returns the schema version of db, and the migrations that
+// Migrate would apply to it.
+func (db *DB) MigrationStatus() (int, []Migration, error) {
+	ms, err := migrations(db.migrationDir())
+	if err != nil {
+		return 0, nil, err
+	}
+	v, err := db.version(db)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var pending []Migration
+	for _, m := range ms {
+		if m.Version > v {
+			pending = append(pending, m)
+		}
+	}
+	return v, pending, nil
+}
+
+// Migrate brings db's schema up to date, and returns the migrations it
+// applied.  All of them are applied in a single transaction, so if one fails
+// db is left as it was.  SQLite's search index, which isn't made by a
+// migration (see search.go), is made or dropped in the same transaction.
+func (db *DB) Migrate() ([]Migration, error) {
+	ms, err := migrations(db.migrationDir())
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	v, err := db.version(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	for _, m := range ms {
+		if m.Version <= v {
+			continue
+		}
+		if _, err := tx.Exec(m.SQL); err != nil {
+			return nil, fmt.Errorf("db.Migrate(): %v: %v", m, err)
+		}
+		cmd := `
+        INSERT INTO schema_version(
+            Version, Name, AppliedDatetime
+        ) values(?, ?, CURRENT_TIMESTAMP)`
+		if _, err := tx.Exec(db.bind(cmd), m.Version, m.Name); err != nil {
+			return nil, err
+		}
+		applied = append(applied, m)
+	}
+	if !db.postgres {
+		if err := ftsIndex(tx); err != nil {
+			return nil, fmt.Errorf("db.Migrate(): search index: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
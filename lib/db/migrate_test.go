@@ -0,0 +1,166 @@
+package db
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/askcarter/test"
+)
+
+// legacy is a database as dbd created it before migrations existed.
+var legacy = []string{
+	`CREATE TABLE decks(
+        Name TEXT PRIMARY KEY,
+        Desc TEXT,
+        InsertedDatetime DATETIME
+    )`,
+	`CREATE TABLE users(
+        Email TEXT PRIMARY KEY,
+        Name TEXT,
+        Password TEXT,
+        InsertedDatetime DATETIME
+    )`,
+	`CREATE TABLE cards(
+        ID INTEGER PRIMARY KEY,
+        Front TEXT,
+        Back  TEXT,
+        Owner TEXT,
+        InsertedDatetime DATETIME
+    )`,
+	`INSERT INTO users VALUES('askcarter@google.com', 'Carter', 'hash', '2016-06-08 20:24:47')`,
+	`INSERT INTO decks VALUES('askcarter@google.com:algebra', 'Math', '2016-06-08 20:24:47')`,
+	`INSERT INTO decks VALUES('ai.ngau@gmail.com:spanish', '', '2016-06-08 20:24:47')`,
+	`INSERT INTO cards VALUES(1, 'x+x', '2x', 'askcarter@google.com:algebra', '2016-06-08 20:24:47')`,
+	`INSERT INTO cards VALUES(2, 'hola', 'hello', 'ai.ngau@gmail.com:spanish', '2016-06-08 20:24:47')`,
+	`INSERT INTO cards VALUES(5, 'Go', 'gopher', 'Askcarter@google.com:Programming', '2016-06-08 20:24:47')`,
+}
+
+func TestMigrate(t *testing.T) {
+	c := test.Checker(t)
+
+	f, err := ioutil.TempFile("", "db_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name() + "-shm")
+	defer os.Remove(f.Name() + "-wal")
+	defer os.Remove(f.Name())
+
+	old, err := sql.Open("sqlite3", f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range legacy {
+		if _, err := old.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	ms, err := migrations("migrations/sqlite3")
+	c.Expect(test.EQ, nil, err)
+
+	db := &DB{}
+	err = db.Connect(f.Name())
+	c.Expect(test.EQ, nil, err)
+
+	v, pending, err := db.MigrationStatus()
+	c.Expect(test.EQ, nil, err)
+	c.Expect(test.EQ, 0, v)
+	c.Expect(test.EQ, ms, pending)
+	db.Close()
+
+	err = db.Open(f.Name())
+	c.Expect(test.EQ, nil, err)
+	defer db.Close()
+
+	v, pending, err = db.MigrationStatus()
+	c.Expect(test.EQ, nil, err)
+	c.Expect(test.EQ, ms[len(ms)-1].Version, v)
+	c.Expect(test.EQ, 0, len(pending))
+
+	applied, err := db.Migrate()
+	c.Expect(test.EQ, nil, err)
+	c.Expect(test.EQ, 0, len(applied))
+
+	// Owners that were only named by decks or cards are created.
+	got, err := db.List(ListOp{What: "users", Query: "*"})
+	c.Expect(test.EQ, nil, err)
+	c.Expect(test.EQ, UserList{
+		{Email: "ai.ngau@gmail.com", Name: "", Role: RoleEditor},
+		{Email: "askcarter@google.com", Name: "Carter", Role: RoleEditor},
+	}, got)
+	hash, err := db.Credentials("askcarter@google.com")
+	c.Expect(test.EQ, nil, err)
+	c.Expect(test.EQ, "hash", hash)
+
+	got, err = db.List(ListOp{What: "decks", Query: "*"})
+	c.Expect(test.EQ, nil, err)
+	c.Expect(test.EQ, DeckList{
+		{Owner: "ai.ngau@gmail.com", Name: "spanish"},
+		{Owner: "askcarter@google.com", Name: "algebra", Desc: "Math"},
+		{Owner: "askcarter@google.com", Name: "programming"},
+	}, ignoreDeckIDs(got))
+
+	got, err = db.List(ListOp{What: "cards", Query: "*"})
+	c.Expect(test.EQ, nil, err)
+	cards := got.(CardList)
+	checkIgnoreIDs(t, CardList{
+		{Owner: "ai.ngau@gmail.com:spanish", Front: "hola", Back: "hello"},
+		{Owner: "askcarter@google.com:algebra", Front: "x+x", Back: "2x"},
+		{Owner: "askcarter@google.com:programming", Front: "Go", Back: "gopher"},
+	}, cards)
+
+	// Existing cards keep their ids, and are ready to be reviewed.
+	c.Expect(test.EQ, 5, cards[2].ID)
+	c.Expect(test.EQ, DefaultEase, cards[2].Ease)
+	c.Expect(test.EQ, false, cards[2].Due.IsZero())
+	_, err = db.Review(ReviewOp{CardID: 5, Grade: Good, At: cards[2].Due})
+	c.Expect(test.EQ, nil, err)
+
+	// Cards stored at CURRENT_TIMESTAMP are found by when they were created.
+	for _, tt := range []struct {
+		filter string
+		n      int
+	}{
+		{"created >= 2016-06-08T20:24:47Z", 3},
+		{"created <= 2016-06-08T20:24:47Z", 3},
+		{"created > 2016-06-08T20:24:47Z", 0},
+	} {
+		got, err = db.List(ListOp{What: "cards", Query: "*", Filter: tt.filter})
+		c.Expect(test.EQ, nil, err)
+		c.Expect(test.EQ, tt.n, len(got.(CardList)))
+	}
+
+	// Foreign keys survive the tables being rebuilt.
+	err = db.Store(CardList{{DeckID: 1000, Front: "x", Back: "y"}})
+	c.Expect(test.NE, nil, err)
+	_, err = db.Exec(`INSERT INTO cards(DeckID, Front, Back) VALUES(1000, 'x', 'y')`)
+	c.Expect(test.NE, nil, err)
+}
+
+// ignoreDeckIDs returns the decks in ls with their IDs zeroed.
+func ignoreDeckIDs(ls ListStorer) DeckList {
+	var dl DeckList
+	for _, d := range ls.(DeckList) {
+		d.ID = 0
+		dl = append(dl, d)
+	}
+	return dl
+}
+
+func checkIgnoreIDs(t *testing.T, expected, actual CardList) {
+	if len(expected) != len(actual) {
+		t.Fatalf("Length mismatch.  \nExpect: %v  \nActual: %v", expected, actual)
+	}
+
+	for i, exp := range expected {
+		// Ignore ID field.
+		act := actual[i]
+		if exp.Owner != act.Owner || exp.Front != act.Front || exp.Back != act.Back {
+			t.Errorf("Card mismatch.  Expect: %v  Actual: %v", exp, act)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+-- The schema as of version 6, when PostgreSQL support was added.
+--
+-- Desc, Interval and User are keywords in PostgreSQL, so they are always
+-- quoted.
+CREATE TABLE users(
+    Email TEXT PRIMARY KEY,
+    Name TEXT NOT NULL DEFAULT '',
+    Password TEXT NOT NULL DEFAULT '',
+    InsertedDatetime TIMESTAMPTZ
+);
+
+CREATE TABLE decks(
+    ID SERIAL PRIMARY KEY,
+    OwnerEmail TEXT NOT NULL
+        REFERENCES users(Email) ON DELETE CASCADE ON UPDATE CASCADE,
+    Name TEXT NOT NULL,
+    "Desc" TEXT NOT NULL DEFAULT '',
+    Scheduler TEXT NOT NULL DEFAULT '',
+    Params TEXT NOT NULL DEFAULT '',
+    InsertedDatetime TIMESTAMPTZ,
+    UNIQUE(OwnerEmail, Name)
+);
+
+CREATE TABLE cards(
+    ID SERIAL PRIMARY KEY,
+    DeckID INTEGER NOT NULL
+        REFERENCES decks(ID) ON DELETE CASCADE,
+    Front TEXT NOT NULL DEFAULT '',
+    Back  TEXT NOT NULL DEFAULT '',
+    Due TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    Ease DOUBLE PRECISION NOT NULL DEFAULT 2.5,
+    "Interval" INTEGER NOT NULL DEFAULT 0,
+    Reps INTEGER NOT NULL DEFAULT 0,
+    Stability DOUBLE PRECISION NOT NULL DEFAULT 0,
+    Difficulty DOUBLE PRECISION NOT NULL DEFAULT 0,
+    Box INTEGER NOT NULL DEFAULT 0,
+    InsertedDatetime TIMESTAMPTZ
+);
+CREATE INDEX cards_deck ON cards(DeckID);
+
+CREATE TABLE reviews(
+    ID SERIAL PRIMARY KEY,
+    CardID INTEGER,
+    "User" TEXT,
+    Grade INTEGER,
+    ReviewedAt TIMESTAMPTZ,
+    PrevInterval INTEGER,
+    NextInterval INTEGER,
+    ResponseMS INTEGER
+);
+CREATE INDEX reviews_card ON reviews(CardID);
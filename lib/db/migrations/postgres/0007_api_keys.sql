@@ -0,0 +1,12 @@
+-- API keys let services act as a user without logging in.  Only a hash of
+-- each key is kept.
+CREATE TABLE api_keys(
+    ID SERIAL PRIMARY KEY,
+    Hash TEXT NOT NULL UNIQUE,
+    Name TEXT NOT NULL DEFAULT '',
+    Owner TEXT NOT NULL
+        REFERENCES users(Email) ON DELETE CASCADE ON UPDATE CASCADE,
+    Scope TEXT NOT NULL,
+    InsertedDatetime TIMESTAMPTZ,
+    RevokedDatetime TIMESTAMPTZ
+);
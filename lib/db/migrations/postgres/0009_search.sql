@@ -0,0 +1,6 @@
+-- Cards are searched by the words of their front and back.  The 'simple'
+-- configuration lower cases words but doesn't stem them, so that searches
+-- match whole words, as they do in SQLite.
+ALTER TABLE cards ADD COLUMN SearchVector tsvector
+    GENERATED ALWAYS AS (to_tsvector('simple', Front || ' ' || Back)) STORED;
+CREATE INDEX cards_search ON cards USING GIN (SearchVector);
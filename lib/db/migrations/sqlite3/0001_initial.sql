@@ -0,0 +1,20 @@
+-- The schema dbd shipped with.  Databases created before migrations existed
+-- already have these tables, so this is a no-op for them.
+CREATE TABLE IF NOT EXISTS decks(
+    Name TEXT PRIMARY KEY,
+    Desc TEXT,
+    InsertedDatetime DATETIME
+);
+CREATE TABLE IF NOT EXISTS users(
+    Email TEXT PRIMARY KEY,
+    Name TEXT,
+    Password TEXT,
+    InsertedDatetime DATETIME
+);
+CREATE TABLE IF NOT EXISTS cards(
+    ID INTEGER PRIMARY KEY,
+    Front TEXT,
+    Back  TEXT,
+    Owner TEXT,
+    InsertedDatetime DATETIME
+);
@@ -0,0 +1,6 @@
+-- SM-2 scheduling state.  Existing cards are new, and due straight away.
+ALTER TABLE cards ADD COLUMN Due DATETIME;
+ALTER TABLE cards ADD COLUMN Ease REAL NOT NULL DEFAULT 2.5;
+ALTER TABLE cards ADD COLUMN Interval INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE cards ADD COLUMN Reps INTEGER NOT NULL DEFAULT 0;
+UPDATE cards SET Due = strftime('%Y-%m-%d %H:%M:%S+00:00', 'now');
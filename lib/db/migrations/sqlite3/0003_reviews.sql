@@ -0,0 +1,12 @@
+-- The review log.
+CREATE TABLE reviews(
+    ID INTEGER PRIMARY KEY,
+    CardID INTEGER,
+    User TEXT,
+    Grade INTEGER,
+    ReviewedAt DATETIME,
+    PrevInterval INTEGER,
+    NextInterval INTEGER,
+    ResponseMS INTEGER
+);
+CREATE INDEX reviews_card ON reviews(CardID);
@@ -0,0 +1,5 @@
+-- Per deck schedulers, and the FSRS model's card state.
+ALTER TABLE decks ADD COLUMN Scheduler TEXT NOT NULL DEFAULT '';
+ALTER TABLE decks ADD COLUMN Params TEXT NOT NULL DEFAULT '';
+ALTER TABLE cards ADD COLUMN Stability REAL NOT NULL DEFAULT 0;
+ALTER TABLE cards ADD COLUMN Difficulty REAL NOT NULL DEFAULT 0;
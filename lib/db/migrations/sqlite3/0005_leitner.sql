@@ -0,0 +1,2 @@
+-- The Leitner box a card is in.
+ALTER TABLE cards ADD COLUMN Box INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,61 @@
+-- Replace 'email:deck' owner strings with foreign keys: decks get an id and
+-- an owner email, and cards a deck id.
+--
+-- Users and decks that were only ever named by those strings are created
+-- first, so no cards are lost.  Decks without an owner, and cards without a
+-- deck, can't be kept.
+INSERT OR IGNORE INTO decks(Name, Desc, Scheduler, Params, InsertedDatetime)
+SELECT DISTINCT lower(Owner), '', '', '', CURRENT_TIMESTAMP
+FROM cards
+WHERE instr(Owner, ':') > 1;
+
+INSERT OR IGNORE INTO users(Email, Name, Password, InsertedDatetime)
+SELECT DISTINCT lower(substr(Name, 1, instr(Name, ':') - 1)), '', '', CURRENT_TIMESTAMP
+FROM decks
+WHERE instr(Name, ':') > 1;
+
+CREATE TABLE decks_new(
+    ID INTEGER PRIMARY KEY,
+    OwnerEmail TEXT NOT NULL
+        REFERENCES users(Email) ON DELETE CASCADE ON UPDATE CASCADE,
+    Name TEXT NOT NULL,
+    Desc TEXT,
+    Scheduler TEXT NOT NULL DEFAULT '',
+    Params TEXT NOT NULL DEFAULT '',
+    InsertedDatetime DATETIME,
+    UNIQUE(OwnerEmail, Name)
+);
+INSERT OR IGNORE INTO decks_new(OwnerEmail, Name, Desc, Scheduler, Params, InsertedDatetime)
+SELECT lower(substr(Name, 1, instr(Name, ':') - 1)),
+       lower(substr(Name, instr(Name, ':') + 1)),
+       Desc, Scheduler, Params, InsertedDatetime
+FROM decks
+WHERE instr(Name, ':') > 1
+ORDER BY Name;
+
+CREATE TABLE cards_new(
+    ID INTEGER PRIMARY KEY,
+    DeckID INTEGER NOT NULL
+        REFERENCES decks_new(ID) ON DELETE CASCADE,
+    Front TEXT,
+    Back  TEXT,
+    Due DATETIME,
+    Ease REAL NOT NULL DEFAULT 2.5,
+    Interval INTEGER NOT NULL DEFAULT 0,
+    Reps INTEGER NOT NULL DEFAULT 0,
+    Stability REAL NOT NULL DEFAULT 0,
+    Difficulty REAL NOT NULL DEFAULT 0,
+    Box INTEGER NOT NULL DEFAULT 0,
+    InsertedDatetime DATETIME
+);
+INSERT INTO cards_new(ID, DeckID, Front, Back, Due, Ease, Interval, Reps,
+                      Stability, Difficulty, Box, InsertedDatetime)
+SELECT c.ID, d.ID, c.Front, c.Back, c.Due, c.Ease, c.Interval, c.Reps,
+       c.Stability, c.Difficulty, c.Box, c.InsertedDatetime
+FROM cards c JOIN decks_new d ON d.OwnerEmail || ':' || d.Name = lower(c.Owner);
+
+DROP TABLE cards;
+DROP TABLE decks;
+ALTER TABLE decks_new RENAME TO decks;
+ALTER TABLE cards_new RENAME TO cards;
+CREATE INDEX cards_deck ON cards(DeckID);
@@ -0,0 +1,35 @@
+-- Users have a role: admin, editor or learner.  Everyone was an editor
+-- before roles existed.
+ALTER TABLE users ADD COLUMN Role TEXT NOT NULL DEFAULT 'editor';
+
+-- Groups of users, which decks can be shared with.
+CREATE TABLE user_groups(
+    Name TEXT PRIMARY KEY,
+    Owner TEXT NOT NULL
+        REFERENCES users(Email) ON DELETE CASCADE ON UPDATE CASCADE,
+    InsertedDatetime DATETIME
+);
+
+CREATE TABLE group_members(
+    GroupName TEXT NOT NULL
+        REFERENCES user_groups(Name) ON DELETE CASCADE ON UPDATE CASCADE,
+    Email TEXT NOT NULL
+        REFERENCES users(Email) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY(GroupName, Email)
+);
+CREATE INDEX group_members_email ON group_members(Email);
+
+-- A deck is shared with either a user or a group, to read or to edit.
+CREATE TABLE deck_shares(
+    DeckID INTEGER NOT NULL
+        REFERENCES decks(ID) ON DELETE CASCADE,
+    UserEmail TEXT
+        REFERENCES users(Email) ON DELETE CASCADE ON UPDATE CASCADE,
+    GroupName TEXT
+        REFERENCES user_groups(Name) ON DELETE CASCADE ON UPDATE CASCADE,
+    Access TEXT NOT NULL,
+    CHECK ((UserEmail IS NULL) <> (GroupName IS NULL))
+);
+CREATE INDEX deck_shares_deck ON deck_shares(DeckID);
+CREATE INDEX deck_shares_user ON deck_shares(UserEmail);
+CREATE INDEX deck_shares_group ON deck_shares(GroupName);
@@ -0,0 +1,8 @@
+-- Cards can be tagged, and filtered by their tags.
+CREATE TABLE card_tags(
+    CardID INTEGER NOT NULL
+        REFERENCES cards(ID) ON DELETE CASCADE,
+    Tag TEXT NOT NULL,
+    PRIMARY KEY(CardID, Tag)
+);
+CREATE INDEX card_tags_tag ON card_tags(Tag);
@@ -0,0 +1,6 @@
+-- Cards were once stored at CURRENT_TIMESTAMP, whose text sorts before the
+-- times dbd stores now, so filters on when cards were created missed them at
+-- the boundary.  Store those times the way dbd does.
+UPDATE cards
+SET InsertedDatetime = strftime('%Y-%m-%d %H:%M:%S+00:00', InsertedDatetime)
+WHERE strftime('%Y-%m-%d %H:%M:%S+00:00', InsertedDatetime) IS NOT NULL;
@@ -0,0 +1,202 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Page lists l from ds, as List does, along with a cursor for the rest of
+// the list: setting l.Cursor to it lists the page after this one.  The
+// cursor is "" once there's nothing left, which is known when fewer than
+// l.Limit results were listed, and always without a Limit or for searches,
+// which can't be paged.
+//
+// Cursors are opaque, and name the last result listed rather than how many
+// came before it, so that paging through a list that's changing doesn't skip
+// or repeat anything that stays put.
+func Page(ds DataSource, l ListOp) (ListStorer, string, error) {
+	ls, err := ds.List(l)
+	if err != nil {
+		return nil, "", err
+	}
+	last, n := lastOf(ls)
+	if l.Limit <= 0 || n < l.Limit {
+		return ls, "", nil
+	}
+	key := sortKey(l, last)
+	if key == nil {
+		return ls, "", nil
+	}
+	b, err := json.Marshal(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return ls, base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// lastOf returns the last of the results in ls, and how many there are.
+func lastOf(ls ListStorer) (interface{}, int) {
+	switch ls := ls.(type) {
+	case UserList:
+		if n := len(ls); n > 0 {
+			return ls[n-1], n
+		}
+	case DeckList:
+		if n := len(ls); n > 0 {
+			return ls[n-1], n
+		}
+	case CardList:
+		if n := len(ls); n > 0 {
+			return ls[n-1], n
+		}
+	case ReviewList:
+		if n := len(ls); n > 0 {
+			return ls[n-1], n
+		}
+	case APIKeyList:
+		if n := len(ls); n > 0 {
+			return ls[n-1], n
+		}
+	case GroupList:
+		if n := len(ls); n > 0 {
+			return ls[n-1], n
+		}
+	case ShareList:
+		if n := len(ls); n > 0 {
+			return ls[n-1], n
+		}
+	case HitList:
+		if n := len(ls); n > 0 {
+			return ls[n-1], n
+		}
+	}
+	return nil, 0
+}
+
+// sortKey returns the values that the results of l are ordered by, for v,
+// one of those results, or for the zero value of the kind of result l lists
+// if v is nil.  Keys are made of strings, ints and times.  Search results
+// have no key, since they're ordered by rank.
+func sortKey(l ListOp, v interface{}) []interface{} {
+	if v == nil {
+		v = map[string]interface{}{
+			"users": User{}, "decks": Deck{}, "cards": Card{}, "reviews": Review{},
+			"keys": APIKey{}, "groups": Group{}, "shares": Share{},
+		}[l.What]
+	}
+	switch v := v.(type) {
+	case User:
+		return []interface{}{v.Email}
+	case Deck:
+		return []interface{}{v.Owner, v.Name}
+	case Card:
+		if !l.Due.IsZero() {
+			return []interface{}{v.Due, v.ID}
+		}
+		email, deck, _ := splitOwner(v.Owner)
+		return []interface{}{email, deck, v.ID}
+	case Review:
+		return []interface{}{v.At, v.ID}
+	case APIKey:
+		return []interface{}{v.ID}
+	case Group:
+		return []interface{}{v.Name}
+	case Share:
+		return []interface{}{v.DeckID, v.User, v.Group}
+	}
+	return nil
+}
+
+// cursorKey returns the sort key of the last result before l's cursor, or
+// nil if l doesn't have one.
+func cursorKey(l ListOp) ([]interface{}, error) {
+	if l.Cursor == "" {
+		return nil, nil
+	}
+	bad := errorf(ErrInvalid, "db.List(): bad cursor %q.", l.Cursor)
+	b, err := base64.RawURLEncoding.DecodeString(l.Cursor)
+	if err != nil {
+		return nil, bad
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, bad
+	}
+	key := sortKey(l, nil)
+	if key == nil || len(raw) != len(key) {
+		return nil, bad
+	}
+	for i := range key {
+		var err error
+		switch key[i].(type) {
+		case string:
+			var s string
+			err = json.Unmarshal(raw[i], &s)
+			key[i] = s
+		case int:
+			var n int
+			err = json.Unmarshal(raw[i], &n)
+			key[i] = n
+		case time.Time:
+			var t time.Time
+			err = json.Unmarshal(raw[i], &t)
+			key[i] = t
+		}
+		if err != nil {
+			return nil, bad
+		}
+	}
+	return key, nil
+}
+
+// compareKeys returns -1, 0 or 1 as the sort key a comes before, is the
+// same as, or comes after b.
+func compareKeys(a, b []interface{}) int {
+	for i := range a {
+		var c int
+		switch x := a[i].(type) {
+		case string:
+			c = strings.Compare(x, b[i].(string))
+		case int:
+			y := b[i].(int)
+			if x < y {
+				c = -1
+			} else if x > y {
+				c = 1
+			}
+		case time.Time:
+			y := b[i].(time.Time)
+			if x.Before(y) {
+				c = -1
+			} else if x.After(y) {
+				c = 1
+			}
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// afterKey adds to the WHERE clause of cmd, and to its args, the condition
+// that its rows come after key, when ordered by the columns cols.  It does
+// nothing if key is nil.
+func afterKey(cmd string, args []interface{}, key []interface{}, cols ...string) (string, []interface{}) {
+	if key == nil {
+		return cmd, args
+	}
+	params := make([]string, len(key))
+	for i, k := range key {
+		if t, ok := k.(time.Time); ok {
+			k = dbTime(t)
+		}
+		params[i] = "?"
+		args = append(args, k)
+	}
+	cmd += fmt.Sprintf(" AND (%s) > (%s)", strings.Join(cols, ", "), strings.Join(params, ", "))
+	return cmd, args
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Grade is a user's assessment of how well they recalled a Card, from 0
+// (complete blackout) to 5 (perfect response).  Grades below 3 count as
+// a failed recall.
+type Grade int
+
+// Named grades, for clients that offer four answer buttons instead of six.
+const (
+	Again Grade = 1
+	Hard  Grade = 3
+	Good  Grade = 4
+	Easy  Grade = 5
+)
+
+var gradeNames = map[string]Grade{
+	"again": Again,
+	"hard":  Hard,
+	"good":  Good,
+	"easy":  Easy,
+}
+
+// ParseGrade parses a grade given either as a number from 0 to 5 or as one
+// of the names again, hard, good or easy.
+func ParseGrade(s string) (Grade, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if g, ok := gradeNames[s]; ok {
+		return g, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > 5 {
+		return 0, errorf(ErrInvalid, "db.ParseGrade(): invalid grade %q.", s)
+	}
+	return Grade(n), nil
+}
+
+// UnmarshalJSON accepts a grade as either a JSON number or string.
+func (g *Grade) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var n int
+		if err := json.Unmarshal(b, &n); err != nil {
+			return errorf(ErrInvalid, "db.Grade: invalid grade %s.", b)
+		}
+		s = strconv.Itoa(n)
+	}
+	v, err := ParseGrade(s)
+	if err != nil {
+		return err
+	}
+	*g = v
+	return nil
+}
+
+// DefaultEase is the ease factor given to a Card that has never been
+// reviewed.  MinEase is the floor SM-2 lets an ease factor fall to.
+const (
+	DefaultEase = 2.5
+	MinEase     = 1.3
+)
+
+// Day is the unit Card intervals are measured in.
+const Day = 24 * time.Hour
+
+// A Scheduler decides when a Card should next be reviewed.  Each Deck names
+// the Scheduler its cards use.
+type Scheduler interface {
+	// Schedule returns a copy of c rescheduled for an answer graded g at now.
+	Schedule(c Card, g Grade, now time.Time) Card
+}
+
+// NewScheduler returns the Scheduler called name ("sm2", "fsrs" or "leitner"),
+// configured by params, a JSON object that may be empty.  An empty name
+// means SM-2, which takes no params.
+func NewScheduler(name string, params json.RawMessage) (Scheduler, error) {
+	switch strings.ToLower(name) {
+	case "", "sm2":
+		return SM2{}, nil
+	case "fsrs":
+		f := DefaultFSRS()
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &f); err != nil {
+				return nil, errorf(ErrInvalid, "db.NewScheduler(): %v", err)
+			}
+		}
+		if err := f.validate(); err != nil {
+			return nil, errorf(ErrInvalid, "%v", err)
+		}
+		return f, nil
+	case "leitner":
+		l := DefaultLeitner()
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &l); err != nil {
+				return nil, errorf(ErrInvalid, "db.NewScheduler(): %v", err)
+			}
+		}
+		if err := l.validate(); err != nil {
+			return nil, errorf(ErrInvalid, "%v", err)
+		}
+		return l, nil
+	}
+	return nil, errorf(ErrInvalid, "db.NewScheduler(): unknown scheduler %q.", name)
+}
+
+// SM2 schedules Cards using the SuperMemo 2 algorithm.  See
+// https://www.supermemo.com/english/ol/sm2.htm for details.
+type SM2 struct{}
+
+// Schedule returns a copy of c rescheduled for an answer graded g at now.
+func (SM2) Schedule(c Card, g Grade, now time.Time) Card {
+	if c.Ease == 0 {
+		c.Ease = DefaultEase
+	}
+
+	q := float64(g)
+	if g >= 3 {
+		switch c.Reps {
+		case 0:
+			c.Interval = 1
+		case 1:
+			c.Interval = 6
+		default:
+			// Intervals can be stored, so they may be far too long
+			// already.
+			c.Interval = int(math.Min(math.Ceil(float64(c.Interval)*c.Ease), maxInterval))
+		}
+		c.Reps++
+	} else {
+		// A failed recall starts the card's repetitions over.
+		c.Reps = 0
+		c.Interval = 1
+	}
+
+	c.Ease += 0.1 - (5-q)*(0.08+(5-q)*0.02)
+	if c.Ease < MinEase {
+		c.Ease = MinEase
+	}
+
+	c.Due = now.Add(time.Duration(c.Interval) * Day)
+	return c
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/askcarter/test"
+)
+
+func TestSM2_Schedule(t *testing.T) {
+	now := time.Date(2016, 6, 8, 20, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		desc  string
+		card  Card
+		grade Grade
+		want  Card
+	}{
+		{"new card, good answer",
+			Card{}, 4,
+			Card{Ease: 2.5, Interval: 1, Reps: 1, Due: now.Add(1 * Day)},
+		},
+		{"second review jumps to six days",
+			Card{Ease: 2.5, Interval: 1, Reps: 1}, 5,
+			Card{Ease: 2.6, Interval: 6, Reps: 2, Due: now.Add(6 * Day)},
+		},
+		{"later reviews multiply by ease",
+			Card{Ease: 2.5, Interval: 6, Reps: 2}, 3,
+			Card{Ease: 2.36, Interval: 15, Reps: 3, Due: now.Add(15 * Day)},
+		},
+		{"failed recall starts over",
+			Card{Ease: 2.5, Interval: 15, Reps: 3}, 1,
+			Card{Ease: 1.96, Interval: 1, Reps: 0, Due: now.Add(1 * Day)},
+		},
+		{"ease never drops below the minimum",
+			Card{Ease: 1.4, Interval: 1, Reps: 0}, 0,
+			Card{Ease: MinEase, Interval: 1, Reps: 0, Due: now.Add(1 * Day)},
+		},
+		{"huge intervals are capped",
+			Card{Ease: 2.5, Interval: 1 << 40, Reps: 3}, 4,
+			Card{Ease: 2.5, Interval: maxInterval, Reps: 4, Due: now.Add(maxInterval * Day)},
+		},
+	}
+
+	for i, tt := range tests {
+		c := test.Checker(t, test.Summary(fmt.Sprintf("With test %v: %s", i, tt.desc)))
+
+		got := SM2{}.Schedule(tt.card, tt.grade, now)
+		c.Expect(test.EQ, tt.want.Interval, got.Interval)
+		c.Expect(test.EQ, tt.want.Reps, got.Reps)
+		c.Expect(test.EQ, tt.want.Due, got.Due)
+		c.Expect(test.EQ, fmt.Sprintf("%.2f", tt.want.Ease), fmt.Sprintf("%.2f", got.Ease))
+	}
+}
+
+func TestParseGrade(t *testing.T) {
+	var tests = []struct {
+		in   string
+		want Grade
+		err  bool
+	}{
+		{"0", 0, false},
+		{"5", 5, false},
+		{"again", Again, false},
+		{" Good ", Good, false},
+		{"EASY", Easy, false},
+		{"6", 0, true},
+		{"-1", 0, true},
+		{"meh", 0, true},
+	}
+
+	for i, tt := range tests {
+		c := test.Checker(t, test.Summary(fmt.Sprintf("With test %v: %q", i, tt.in)))
+
+		got, err := ParseGrade(tt.in)
+		c.Expect(test.EQ, tt.err, err != nil)
+		c.Expect(test.EQ, tt.want, got)
+	}
+}
+
+func TestFSRS_Schedule(t *testing.T) {
+	c := test.Checker(t)
+	now := time.Date(2016, 6, 8, 20, 0, 0, 0, time.UTC)
+	f := DefaultFSRS()
+
+	// A new card starts with the stability its first rating gives it.
+	card := f.Schedule(Card{}, Good, now)
+	c.Expect(test.EQ, f.Weights[2], card.Stability)
+	c.Expect(test.EQ, 4, card.Interval)
+	c.Expect(test.EQ, 1, card.Reps)
+	c.Expect(test.EQ, now.Add(4*Day), card.Due)
+
+	// Recalling it on time makes it more stable...
+	next := f.Schedule(card, Good, card.Due)
+	c.Expect(test.EQ, true, next.Stability > card.Stability)
+	c.Expect(test.EQ, true, next.Interval > card.Interval)
+	c.Expect(test.EQ, 2, next.Reps)
+
+	// ...and easy answers more so than hard ones.
+	hard := f.Schedule(card, Hard, card.Due)
+	easy := f.Schedule(card, Easy, card.Due)
+	c.Expect(test.EQ, true, hard.Stability < next.Stability)
+	c.Expect(test.EQ, true, easy.Stability > next.Stability)
+	c.Expect(test.EQ, true, easy.Difficulty < hard.Difficulty)
+
+	// Forgetting it makes it less stable, and harder.
+	lapse := f.Schedule(next, Again, next.Due)
+	c.Expect(test.EQ, true, lapse.Stability < next.Stability)
+	c.Expect(test.EQ, true, lapse.Difficulty > next.Difficulty)
+	c.Expect(test.EQ, 0, lapse.Reps)
+	c.Expect(test.EQ, true, lapse.Interval < next.Interval)
+
+	// Cards scheduled by SM-2 carry on from their current interval.
+	sm2 := Card{Ease: 2.5, Interval: 15, Reps: 3, Due: now}
+	carried := f.Schedule(sm2, Good, now)
+	c.Expect(test.EQ, true, carried.Stability > 15)
+	c.Expect(test.EQ, true, carried.Interval > 15)
+	c.Expect(test.EQ, 4, carried.Reps)
+}
+
+func TestLeitner_Schedule(t *testing.T) {
+	now := time.Date(2016, 6, 8, 20, 0, 0, 0, time.UTC)
+	three := Leitner{Intervals: []int{1, 3, 7}}
+	down := Leitner{Intervals: []int{1, 3, 7}, Demote: "down"}
+
+	var tests = []struct {
+		desc     string
+		l        Leitner
+		box      int
+		grade    Grade
+		wantBox  int
+		interval int
+	}{
+		{"new cards start in box 1", three, 0, Again, 1, 1},
+		{"new cards are promoted from box 1", three, 0, Good, 2, 3},
+		{"correct answers promote", three, 2, Hard, 3, 7},
+		{"the last box is the last", three, 3, Easy, 3, 7},
+		{"wrong answers go back to box 1", three, 3, 2, 1, 1},
+		{"or down a box, if configured", down, 3, 2, 2, 3},
+		{"but never below box 1", down, 1, 0, 1, 1},
+		{"cards in removed boxes are in the last box", three, 5, Good, 3, 7},
+		{"huge intervals are capped", Leitner{Intervals: []int{1, 200000}}, 1, Good, 2, maxInterval},
+	}
+
+	for i, tt := range tests {
+		c := test.Checker(t, test.Summary(fmt.Sprintf("With test %v: %s", i, tt.desc)))
+
+		got := tt.l.Schedule(Card{Box: tt.box}, tt.grade, now)
+		c.Expect(test.EQ, tt.wantBox, got.Box)
+		c.Expect(test.EQ, tt.interval, got.Interval)
+		c.Expect(test.EQ, now.Add(time.Duration(tt.interval)*Day), got.Due)
+	}
+}
+
+func TestNewScheduler(t *testing.T) {
+	var tests = []struct {
+		name, params string
+		want         Scheduler
+		err          bool
+	}{
+		{"", "", SM2{}, false},
+		{"SM2", "", SM2{}, false},
+		{"fsrs", "", DefaultFSRS(), false},
+		{"fsrs", `{"retention": 0.85}`, FSRS{Retention: 0.85, Weights: DefaultFSRS().Weights}, false},
+		{"fsrs", `{"retention": 1.5}`, nil, true},
+		{"fsrs", `{"weights": [1, 2, 3]}`, nil, true},
+		{"fsrs", `not json`, nil, true},
+		{"leitner", "", DefaultLeitner(), false},
+		{"leitner", `{"intervals": [1, 5]}`, Leitner{Intervals: []int{1, 5}, Demote: "first"}, false},
+		{"leitner", `{"intervals": []}`, nil, true},
+		{"leitner", `{"intervals": [1, 0]}`, nil, true},
+		{"leitner", `{"intervals": [1, 200000]}`, nil, true},
+		{"leitner", `{"demote": "sideways"}`, nil, true},
+		{"anki", "", nil, true},
+	}
+
+	for i, tt := range tests {
+		c := test.Checker(t, test.Summary(fmt.Sprintf("With test %v: %s %s", i, tt.name, tt.params)))
+
+		got, err := NewScheduler(tt.name, json.RawMessage(tt.params))
+		c.Expect(test.EQ, tt.err, err != nil)
+		c.Expect(test.EQ, tt.want, got)
+	}
+}
@@ -0,0 +1,325 @@
+package db
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Searches match whole words, ignoring case, and a card is found when every
+// word searched for is on its front or back.
+//
+// SQLite searches use an FTS5 index over cards(Front, Back), named cards_fts
+// and kept up to date by triggers on cards.  FTS5 is optional in SQLite
+// builds (go-sqlite3 needs the sqlite_fts5 build tag), so the index isn't
+// made by a migration, which would fail without it.  Migrate makes it
+// instead, when it can, and DB falls back to scanning cards when there's no
+// index.  The index is derived from cards, so it's rebuilt whenever it's
+// made.  An SQLite without FTS5 drops the index's triggers, which it can't
+// run, and one with FTS5 remakes the index when it finds them gone.
+// PostgreSQL searches use the tsvector column of its 0009 migration.
+
+// snippetWords is about how many words a Hit's Snippet has.
+const snippetWords = 10
+
+// searchTerms splits s into the lower case words to search for.
+func searchTerms(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), notWordRune)
+	var terms []string
+	seen := map[string]bool{}
+	for _, w := range words {
+		if !seen[w] {
+			seen[w] = true
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+func notWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// A word is where a word starts and ends in some text, in bytes.
+type word struct {
+	start, end int
+}
+
+// words returns where the words of s are.
+func words(s string) []word {
+	var ws []word
+	start := -1
+	for i, r := range s {
+		switch {
+		case !notWordRune(r) && start < 0:
+			start = i
+		case notWordRune(r) && start >= 0:
+			ws = append(ws, word{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		ws = append(ws, word{start, len(s)})
+	}
+	return ws
+}
+
+// matchCard reports whether c has every one of terms on its front or back,
+// and if so returns it as a Hit ranked by how often the terms occur.  It's
+// how Mem searches, and DB when SQLite has no FTS5.
+func matchCard(c Card, terms []string) (Hit, bool) {
+	wanted := map[string]bool{}
+	for _, t := range terms {
+		wanted[t] = true
+	}
+
+	found := map[string]bool{}
+	var best string
+	var bestWords []word
+	bestCount := -1
+	total := 0
+	for _, side := range []string{c.Front, c.Back} {
+		ws := words(side)
+		count := 0
+		for _, w := range ws {
+			if t := strings.ToLower(side[w.start:w.end]); wanted[t] {
+				found[t] = true
+				count++
+			}
+		}
+		total += count
+		if count > bestCount {
+			best, bestWords, bestCount = side, ws, count
+		}
+	}
+	if len(terms) == 0 || len(found) < len(wanted) {
+		return Hit{}, false
+	}
+	return Hit{
+		Card:    c,
+		Rank:    float64(total),
+		Snippet: snippet(best, bestWords, wanted),
+	}, true
+}
+
+// snippet returns the words of s, which are at ws, around the first of them
+// that's wanted, with the wanted ones set off by "**" and "…" where s was
+// cut short.
+func snippet(s string, ws []word, wanted map[string]bool) string {
+	first := 0
+	for i, w := range ws {
+		if wanted[strings.ToLower(s[w.start:w.end])] {
+			first = i
+			break
+		}
+	}
+	// Lead in with a couple of words, but fill the snippet if s ends first.
+	start := first - 2
+	if start > len(ws)-snippetWords {
+		start = len(ws) - snippetWords
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetWords
+	if end > len(ws) {
+		end = len(ws)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	from := 0
+	if start > 0 {
+		from = ws[start].start
+	}
+	for _, w := range ws[start:end] {
+		b.WriteString(s[from:w.start])
+		if t := s[w.start:w.end]; wanted[strings.ToLower(t)] {
+			b.WriteString("**" + t + "**")
+		} else {
+			b.WriteString(t)
+		}
+		from = w.end
+	}
+	if end < len(ws) {
+		b.WriteString("…")
+	} else {
+		b.WriteString(s[from:])
+	}
+	return b.String()
+}
+
+// sortHits orders hs best first, and cards that rank the same by id.
+func sortHits(hs HitList) {
+	sort.SliceStable(hs, func(i, j int) bool {
+		if hs[i].Rank != hs[j].Rank {
+			return hs[i].Rank > hs[j].Rank
+		}
+		return hs[i].ID < hs[j].ID
+	})
+}
+
+// ftsIndex makes the FTS5 index of cards, and the triggers that keep it up
+// to date, if SQLite has FTS5 and the index isn't there yet, or drops the
+// triggers if SQLite doesn't.
+func ftsIndex(tx *sql.Tx) error {
+	var fts5 bool
+	err := tx.QueryRow(`SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&fts5)
+	if err != nil {
+		return err
+	}
+	if ok, err := hasFTSIndex(tx); err != nil || ok == fts5 {
+		return err
+	}
+	if !fts5 {
+		cmd := `
+    DROP TRIGGER cards_fts_insert;
+    DROP TRIGGER cards_fts_delete;
+    DROP TRIGGER cards_fts_update;`
+		_, err := tx.Exec(cmd)
+		return err
+	}
+
+	cmd := `
+    DROP TABLE IF EXISTS cards_fts;
+    CREATE VIRTUAL TABLE cards_fts USING fts5(
+        Front, Back, content='cards', content_rowid='ID'
+    );
+    CREATE TRIGGER cards_fts_insert AFTER INSERT ON cards BEGIN
+        INSERT INTO cards_fts(rowid, Front, Back)
+        VALUES (new.ID, new.Front, new.Back);
+    END;
+    CREATE TRIGGER cards_fts_delete AFTER DELETE ON cards BEGIN
+        INSERT INTO cards_fts(cards_fts, rowid, Front, Back)
+        VALUES ('delete', old.ID, old.Front, old.Back);
+    END;
+    CREATE TRIGGER cards_fts_update AFTER UPDATE OF Front, Back ON cards BEGIN
+        INSERT INTO cards_fts(cards_fts, rowid, Front, Back)
+        VALUES ('delete', old.ID, old.Front, old.Back);
+        INSERT INTO cards_fts(rowid, Front, Back)
+        VALUES (new.ID, new.Front, new.Back);
+    END;
+    INSERT INTO cards_fts(cards_fts) VALUES ('rebuild');`
+	_, err = tx.Exec(cmd)
+	return err
+}
+
+// hasFTSIndex reports whether the FTS5 index of cards is there and being
+// kept up to date.
+func hasFTSIndex(q queryer) (bool, error) {
+	var n int
+	cmd := `SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = 'cards_fts_insert'`
+	err := q.QueryRow(cmd).Scan(&n)
+	return n > 0, err
+}
+
+// search calls fn with each card that l searches for, best first.
+// cardsWhere is the WHERE clause that limits the cards, aliased c, to those
+// in the decks, aliased d, that l lists, and args are its arguments.
+func (db *DB) search(l ListOp, cardsWhere string, args []interface{}, fn func(interface{}) error) error {
+	terms := searchTerms(l.Search)
+	if len(terms) == 0 {
+		return errorf(ErrInvalid, "db.List(): nothing to search for in %q.", l.Search)
+	}
+
+	cols := `c.ID, c.DeckID, d.OwnerEmail || ':' || d.Name,
+	         c.Front, c.Back, ` + db.tagsCol() + `,
+	         c.Due, c.Ease, c."Interval", c.Reps,
+	         c.Stability, c.Difficulty, c.Box`
+	var cmd string
+	if db.postgres {
+		cmd = `SELECT ` + cols + `, ts_rank(c.SearchVector, query),
+		           ts_headline('simple', c.Front || ' ' || c.Back, query,
+		               'StartSel=**, StopSel=**, MinWords=5, MaxWords=` + strconv.Itoa(snippetWords) + `')
+		       FROM cards c JOIN decks d ON d.ID = c.DeckID,
+		            plainto_tsquery('simple', ?) query
+		       WHERE c.SearchVector @@ query AND ` + cardsWhere + `
+		       ORDER BY 14 DESC, c.ID ASC`
+		args = append([]interface{}{strings.Join(terms, " ")}, args...)
+	} else if ok, err := hasFTSIndex(db); err != nil {
+		return err
+	} else if ok {
+		// Terms are only letters and digits, so quoting them is enough to
+		// keep them from being read as FTS5 syntax.
+		cmd = `SELECT ` + cols + `, -bm25(cards_fts),
+		           snippet(cards_fts, -1, '**', '**', '…', ` + strconv.Itoa(snippetWords) + `)
+		       FROM cards_fts JOIN cards c ON c.ID = cards_fts.rowid
+		            JOIN decks d ON d.ID = c.DeckID
+		       WHERE cards_fts MATCH ? AND ` + cardsWhere + `
+		       ORDER BY bm25(cards_fts) ASC, c.ID ASC`
+		args = append([]interface{}{`"` + strings.Join(terms, `" "`) + `"`}, args...)
+	} else {
+		return db.scanSearch(l, terms, cols, cardsWhere, args, fn)
+	}
+
+	rows, err := db.Query(db.bind(cmd+limit(l)), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		h := Hit{}
+		var tags sql.NullString
+		err := rows.Scan(&h.ID, &h.DeckID, &h.Owner, &h.Front, &h.Back, &tags,
+			&h.Due, &h.Ease, &h.Interval, &h.Reps,
+			&h.Stability, &h.Difficulty, &h.Box, &h.Rank, &h.Snippet)
+		if err != nil {
+			return err
+		}
+		h.Tags = splitTags(tags)
+		if err := fn(h); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// scanSearch searches the cards that contain every term, as matchCard does,
+// for SQLites without FTS5.  LIKE finds the cards that might match, but
+// whole words can only be told apart once they've been read.
+func (db *DB) scanSearch(l ListOp, terms []string, cols, cardsWhere string, args []interface{}, fn func(interface{}) error) error {
+	cmd := `SELECT ` + cols + `
+	        FROM cards c JOIN decks d ON d.ID = c.DeckID
+	        WHERE ` + cardsWhere
+	for _, t := range terms {
+		cmd += ` AND (LOWER(c.Front) LIKE ? OR LOWER(c.Back) LIKE ?)`
+		args = append(args, "%"+t+"%", "%"+t+"%")
+	}
+
+	rows, err := db.Query(db.bind(cmd), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var hits HitList
+	for rows.Next() {
+		c := Card{}
+		var tags sql.NullString
+		err := rows.Scan(&c.ID, &c.DeckID, &c.Owner, &c.Front, &c.Back, &tags,
+			&c.Due, &c.Ease, &c.Interval, &c.Reps,
+			&c.Stability, &c.Difficulty, &c.Box)
+		if err != nil {
+			return err
+		}
+		c.Tags = splitTags(tags)
+		if h, ok := matchCard(c, terms); ok {
+			hits = append(hits, h)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	sortHits(hits)
+	if l.Limit > 0 && len(hits) > l.Limit {
+		hits = hits[:l.Limit]
+	}
+	return each(hits, fn)
+}
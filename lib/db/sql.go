@@ -7,54 +7,52 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"sort"
 	"strings"
-
-	_ "github.com/mattn/go-sqlite3"
+	"time"
 )
 
 // DB is a thin wrapper around sql.DB that know hows to operate on
 // db types.
 type DB struct {
 	*sql.DB
+
+	// postgres is set when the database is PostgreSQL rather than SQLite.
+	postgres bool
 }
 
-func (db *DB) createTables() error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+// bind rewrites a query written with SQLite's ? placeholders for the
+// database in use.  PostgreSQL numbers its placeholders: $1, $2 and so on.
+func (db *DB) bind(query string) string {
+	if !db.postgres {
+		return query
 	}
 
-	// Create decks table.
-	queries := []string{
-		`CREATE TABLE IF NOT EXISTS decks(
-            Name TEXT PRIMARY KEY,
-            Desc TEXT,
-            InsertedDatetime DATETIME
-        );`,
-		`CREATE TABLE IF NOT EXISTS users(
-            Email TEXT PRIMARY KEY,
-            Name TEXT,
-            Password TEXT,
-            InsertedDatetime DATETIME
-        );`,
-		`CREATE TABLE IF NOT EXISTS cards(
-            ID INTEGER PRIMARY KEY,
-            Front TEXT,
-            Back  TEXT,
-            Owner TEXT,
-            InsertedDatetime DATETIME
-        );`,
-	}
-	for _, query := range queries {
-		if _, err := tx.Exec(query); err != nil {
-			return err
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
 		}
+		b.WriteRune(r)
 	}
+	return b.String()
+}
 
-	if err := tx.Commit(); err != nil {
-		return err
+// migrationDir returns the directory holding the database's migrations.
+func (db *DB) migrationDir() string {
+	if db.postgres {
+		return "migrations/postgres"
 	}
-	return nil
+	return "migrations/sqlite3"
+}
+
+// dbTime normalizes t to the form times are stored in: UTC with whole
+// seconds, so that stored times sort and compare as plain text.
+func dbTime(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Second)
 }
 
 func readFromDisk(f string) (ListStorer, error) {
@@ -88,40 +86,62 @@ func readFromDisk(f string) (ListStorer, error) {
 	return ls, nil
 }
 
-// Init reads [decks|users|cards].json files from the files the given
+// Init reads [users|decks|cards].json files from the files the given
 // directory, and then stores them in db.
 func (db *DB) Init(dir string) error {
-	// populate tables
+	// Everything is stored in one transaction, so a bad file stores nothing.
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
-	files := []string{"decks.json", "users.json", "cards.json"}
+	defer tx.Rollback()
+
+	// Owners have to be stored before the things they own.
+	files := []string{"users.json", "decks.json", "cards.json"}
 	for _, f := range files {
 		f = filepath.Join(dir, f)
 		ul, err := readFromDisk(f)
 		if err != nil {
 			return err
 		}
-		if err := db.Store(ul); err != nil {
+		if err := db.store(tx, ul); err != nil {
 			return err
 		}
 	}
-
-	if err := tx.Commit(); err != nil {
-		return err
-	}
-	return nil
+	return tx.Commit()
 }
 
 // Open attempts to open an database and will check to make sure it
 // can connect to it.  After a DB is Open'd it is ready to Store/List data
 // from.
 //
-// Open doesn't populate any data into DB (other than what might already exist
-// in filename).
+// Open brings the database's schema up to date (see Migrate), but doesn't
+// populate any data into DB (other than what might already exist in
+// filename).
 func (db *DB) Open(filename string) error {
-	d, err := sql.Open("sqlite3", filename)
+	if err := db.Connect(filename); err != nil {
+		return err
+	}
+
+	if _, err := db.Migrate(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Connect opens a database like Open does, but leaves its schema as it is.
+func (db *DB) Connect(filename string) error {
+	// SQLite only enforces foreign keys when asked to, per connection.  In
+	// WAL mode readers don't lock writers out, so that a slow client reading
+	// a Stream doesn't hold up every Store.
+	params := "_foreign_keys=1&_journal_mode=WAL"
+	dsn := filename + "?" + params
+	if strings.Contains(filename, "?") {
+		dsn = filename + "&" + params
+	}
+
+	d, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return err
 	}
@@ -133,136 +153,1152 @@ func (db *DB) Open(filename string) error {
 	}
 
 	db.DB = d
-
-	err = db.createTables()
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
 
-// Store inserts the elements of ls into db.
+// Store inserts the elements of ls into db, replacing any users or decks
+// that already exist.  Decks must belong to a stored user, and cards to a
+// stored deck.  Cards stored with an ID replace that card, or fail with
+// ErrNotFound if there isn't one.  The IDs of stored decks and cards are set
+// in ls.
 func (db *DB) Store(ls ListStorer) error {
 	tx, err := db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	if err := db.store(tx, ls); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
 
+// store stores ls as Store does, in the transaction tx.
+func (db *DB) store(tx *sql.Tx, ls ListStorer) error {
 	switch ls := ls.(type) {
 	case DeckList:
 		cmd := `
-        INSERT OR REPLACE INTO decks(
-            Name, Desc, InsertedDatetime
-        ) values(?, ?, CURRENT_TIMESTAMP)`
-		for _, d := range ls {
-			if _, err := tx.Exec(cmd, strings.ToLower(d.Name), d.Desc); err != nil {
+        INSERT INTO decks(
+            OwnerEmail, Name, "Desc", Scheduler, Params, InsertedDatetime
+        ) values(?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+        ON CONFLICT(OwnerEmail, Name) DO UPDATE SET
+            "Desc" = excluded."Desc",
+            Scheduler = excluded.Scheduler,
+            Params = excluded.Params
+        RETURNING ID`
+		for i, d := range ls {
+			d = d.Normalize()
+			if _, err := NewScheduler(d.Scheduler, d.Params); err != nil {
+				return err
+			}
+			ok, err := db.exists(tx, `SELECT COUNT(*) FROM users WHERE Email = ?`, d.Owner)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errorf(ErrInvalid, "db.Store(): deck %q has no owner %q.", d.Name, d.Owner)
+			}
+			err = tx.QueryRow(db.bind(cmd), d.Owner, d.Name, d.Desc,
+				d.Scheduler, string(d.Params)).Scan(&ls[i].ID)
+			if err != nil {
 				return err
 			}
 		}
 	case UserList:
+		// Users stored without a role are editors, or keep the role they
+		// had.
 		cmd := `
-        INSERT OR REPLACE INTO users(
-            Email, Name, Password, InsertedDatetime
-        ) values(?, ?, ?, CURRENT_TIMESTAMP)`
+        INSERT INTO users(
+            Email, Name, Password, Role, InsertedDatetime
+        ) values(?, ?, ?, ?, CURRENT_TIMESTAMP)
+        ON CONFLICT(Email) DO UPDATE SET
+            Name = excluded.Name,
+            Password = CASE WHEN excluded.Password = '' THEN users.Password
+                            ELSE excluded.Password END,
+            Role = CASE WHEN ? = '' THEN users.Role ELSE excluded.Role END`
 		for _, u := range ls {
+			if err := u.validate(); err != nil {
+				return err
+			}
 			e := strings.ToLower(u.Email)
-			if _, err := tx.Exec(cmd, e, u.Name, u.Password); err != nil {
+			role := u.Role
+			if role == "" {
+				role = RoleEditor
+			}
+			_, err := tx.Exec(db.bind(cmd), e, u.Name, u.Password, role, u.Role)
+			if err != nil {
 				return err
 			}
 		}
 	case CardList:
+		replace := `
+        UPDATE cards
+        SET DeckID = ?, Front = ?, Back = ?, Due = ?, Ease = ?, "Interval" = ?,
+            Reps = ?, Stability = ?, Difficulty = ?, Box = ?
+        WHERE ID = ?`
+		cmd := `
+        INSERT INTO cards(
+            DeckID, Front, Back, Due, Ease, "Interval", Reps,
+            Stability, Difficulty, Box, InsertedDatetime
+        ) values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+        RETURNING ID`
+		now := time.Now()
+		decks := map[string]int{}
+		for i, c := range ls {
+			id, err := db.cardDeck(tx, c, decks)
+			if err != nil {
+				return err
+			}
+			if c.Due.IsZero() {
+				c.Due = now
+			}
+			if c.Ease == 0 {
+				c.Ease = DefaultEase
+			}
+			tags, err := c.normalTags()
+			if err != nil {
+				return err
+			}
+			// Cards stored with an ID replace that card.
+			if c.ID != 0 {
+				res, err := tx.Exec(db.bind(replace), id, c.Front, c.Back,
+					dbTime(c.Due), c.Ease, c.Interval, c.Reps,
+					c.Stability, c.Difficulty, c.Box, c.ID)
+				if err := changed(res, err); err != nil {
+					return err
+				}
+			} else {
+				err = tx.QueryRow(db.bind(cmd), id, c.Front, c.Back,
+					dbTime(c.Due), c.Ease, c.Interval, c.Reps,
+					c.Stability, c.Difficulty, c.Box, dbTime(now)).Scan(&ls[i].ID)
+				if err != nil {
+					return err
+				}
+			}
+			if err := db.setTags(tx, ls[i].ID, tags); err != nil {
+				return err
+			}
+		}
+	case ReviewList:
+		for _, r := range ls {
+			if err := db.insertReview(tx, r); err != nil {
+				return err
+			}
+		}
+	case APIKeyList:
 		cmd := `
-        INSERT OR REPLACE INTO cards(
-            ID, Front, Back, Owner, InsertedDatetime
-        ) values(NULL, ?, ?, ?, CURRENT_TIMESTAMP)`
+        INSERT INTO api_keys(
+            Hash, Name, Owner, Scope, InsertedDatetime
+        ) values(?, ?, ?, ?, ?)`
+		now := dbTime(time.Now())
+		for _, k := range ls {
+			if err := k.validate(); err != nil {
+				return err
+			}
+			owner := strings.ToLower(k.Owner)
+			ok, err := db.exists(tx, `SELECT COUNT(*) FROM users WHERE Email = ?`, owner)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errorf(ErrInvalid, "db.Store(): key %q has no owner %q.", k.Name, k.Owner)
+			}
+			ok, err = db.exists(tx, `SELECT COUNT(*) FROM api_keys WHERE Hash = ?`, k.Hash)
+			if err != nil {
+				return err
+			}
+			if ok {
+				return errorf(ErrConflict, "db.Store(): key %q already exists.", k.Name)
+			}
+			_, err = tx.Exec(db.bind(cmd), k.Hash, k.Name, owner, k.Scope, now)
+			if err != nil {
+				return err
+			}
+		}
+	case GroupList:
+		now := dbTime(time.Now())
+		for _, g := range ls {
+			if err := db.storeGroup(tx, g, now); err != nil {
+				return err
+			}
+		}
+	case ShareList:
+		for _, sh := range ls {
+			if err := db.storeShare(tx, sh); err != nil {
+				return err
+			}
+		}
+	default:
+		return errorf(ErrInvalid, "db.Store: bad typed (%T) passed in.", ls)
+	}
+	return nil
+}
+
+// changed returns ErrNotFound if the statement that returned res and err
+// changed no rows, and err otherwise.
+func changed(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Update changes the users, decks or cards in ls, named by their email or
+// ID, and returns ErrNotFound if any of them don't exist.
+func (db *DB) Update(ls ListStorer) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	switch ls := ls.(type) {
+	case UserList:
+		cmd := `UPDATE users
+		        SET Name = ?, Role = CASE WHEN ? = '' THEN Role ELSE ? END
+		        WHERE Email = ?`
+		for _, u := range ls {
+			if err := u.validate(); err != nil {
+				return err
+			}
+			res, err := tx.Exec(db.bind(cmd), u.Name, u.Role, u.Role,
+				strings.ToLower(u.Email))
+			if err := changed(res, err); err != nil {
+				return err
+			}
+		}
+	case DeckList:
+		cmd := `UPDATE decks
+		        SET Name = ?, "Desc" = ?, Scheduler = ?, Params = ?
+		        WHERE ID = ?`
+		taken := `SELECT COUNT(*) FROM decks
+		          WHERE OwnerEmail = (SELECT OwnerEmail FROM decks WHERE ID = ?)
+		          AND Name = ? AND ID <> ?`
+		for _, d := range ls {
+			d.Name, d.Scheduler = strings.ToLower(d.Name), strings.ToLower(d.Scheduler)
+			if d.Name == "" {
+				return errorf(ErrInvalid, "db.Update(): deck %d has no name.", d.ID)
+			}
+			if _, err := NewScheduler(d.Scheduler, d.Params); err != nil {
+				return err
+			}
+			ok, err := db.exists(tx, taken, d.ID, d.Name, d.ID)
+			if err != nil {
+				return err
+			}
+			if ok {
+				return errorf(ErrConflict, "db.Update(): deck %d's owner already has a deck %q.", d.ID, d.Name)
+			}
+			res, err := tx.Exec(db.bind(cmd), d.Name, d.Desc, d.Scheduler,
+				string(d.Params), d.ID)
+			if err := changed(res, err); err != nil {
+				return err
+			}
+		}
+	case CardList:
+		cmd := `UPDATE cards
+		        SET DeckID = ?, Front = ?, Back = ?
+		        WHERE ID = ?`
 		for _, c := range ls {
-			if _, err := tx.Exec(cmd, c.Front, c.Back, c.Owner); err != nil {
+			var deck int
+			q := `SELECT DeckID FROM cards WHERE ID = ?`
+			err := tx.QueryRow(db.bind(q), c.ID).Scan(&deck)
+			if err == sql.ErrNoRows {
+				return ErrNotFound
+			}
+			if err != nil {
+				return err
+			}
+			if c.DeckID != 0 {
+				ok, err := db.exists(tx, `SELECT COUNT(*) FROM decks WHERE ID = ?`, c.DeckID)
+				if err != nil {
+					return err
+				}
+				if !ok {
+					return errorf(ErrInvalid, "db.Update(): card %d has no deck %d.", c.ID, c.DeckID)
+				}
+				deck = c.DeckID
+			}
+			tags, err := c.normalTags()
+			if err != nil {
+				return err
+			}
+			res, err := tx.Exec(db.bind(cmd), deck, c.Front, c.Back, c.ID)
+			if err := changed(res, err); err != nil {
+				return err
+			}
+			if err := db.setTags(tx, c.ID, tags); err != nil {
 				return err
 			}
 		}
 	default:
-		return fmt.Errorf("db.Store: bad typed (%T) passed in.", ls)
+		return errorf(ErrInvalid, "db.Update: bad typed (%T) passed in.", ls)
 	}
 
-	if err := tx.Commit(); err != nil {
+	return tx.Commit()
+}
+
+// Delete deletes the users, decks, cards, groups or shares in ls, and
+// returns ErrNotFound if any of them don't exist.  The database's foreign
+// keys delete whatever they owned.
+func (db *DB) Delete(ls ListStorer) error {
+	tx, err := db.Begin()
+	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
+
+	// cmd is run once for each of args.
+	var cmd string
+	var args [][]interface{}
+	switch ls := ls.(type) {
+	case UserList:
+		cmd = `DELETE FROM users WHERE Email = ?`
+		for _, u := range ls {
+			args = append(args, []interface{}{strings.ToLower(u.Email)})
+		}
+	case DeckList:
+		cmd = `DELETE FROM decks WHERE ID = ?`
+		for _, d := range ls {
+			args = append(args, []interface{}{d.ID})
+		}
+	case CardList:
+		cmd = `DELETE FROM cards WHERE ID = ?`
+		for _, c := range ls {
+			args = append(args, []interface{}{c.ID})
+		}
+	case GroupList:
+		cmd = `DELETE FROM user_groups WHERE Name = ?`
+		for _, g := range ls {
+			args = append(args, []interface{}{strings.ToLower(g.Name)})
+		}
+	case ShareList:
+		cmd = `DELETE FROM deck_shares
+		       WHERE DeckID = ? AND (UserEmail = ? OR GroupName = ?)`
+		for _, sh := range ls {
+			args = append(args, []interface{}{sh.DeckID,
+				strings.ToLower(sh.User), strings.ToLower(sh.Group)})
+		}
+	default:
+		return errorf(ErrInvalid, "db.Delete: bad typed (%T) passed in.", ls)
+	}
+	for _, a := range args {
+		res, err := tx.Exec(db.bind(cmd), a...)
+		if err := changed(res, err); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// exists reports whether the COUNT(*) query q counts any rows.
+func (db *DB) exists(tx *sql.Tx, q string, args ...interface{}) (bool, error) {
+	var n int
+	if err := tx.QueryRow(db.bind(q), args...).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// storeGroup inserts g, or replaces the members of the group with g's name
+// if it has the same owner.
+func (db *DB) storeGroup(tx *sql.Tx, g Group, now time.Time) error {
+	name, owner := strings.ToLower(g.Name), strings.ToLower(g.Owner)
+	if name == "" {
+		return errorf(ErrInvalid, "db.Store(): group has no name.")
+	}
+	users := `SELECT COUNT(*) FROM users WHERE Email = ?`
+	ok, err := db.exists(tx, users, owner)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errorf(ErrInvalid, "db.Store(): group %q has no owner %q.", name, owner)
+	}
+
+	cmd := `
+    INSERT INTO user_groups(
+        Name, Owner, InsertedDatetime
+    ) values(?, ?, ?)
+    ON CONFLICT(Name) DO UPDATE SET Owner = excluded.Owner
+    WHERE user_groups.Owner = excluded.Owner`
+	res, err := tx.Exec(db.bind(cmd), name, owner, now)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errorf(ErrConflict, "db.Store(): group %q belongs to someone else.", name)
+	}
+
+	cmd = `DELETE FROM group_members WHERE GroupName = ?`
+	if _, err := tx.Exec(db.bind(cmd), name); err != nil {
+		return err
+	}
+	cmd = `
+    INSERT INTO group_members(GroupName, Email) values(?, ?)
+    ON CONFLICT(GroupName, Email) DO NOTHING`
+	for _, e := range g.Members {
+		e = strings.ToLower(e)
+		ok, err := db.exists(tx, users, e)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errorf(ErrInvalid, "db.Store(): group %q has no member %q.", name, e)
+		}
+		if _, err := tx.Exec(db.bind(cmd), name, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeShare inserts sh, replacing any share of the same deck with the same
+// user or group.
+func (db *DB) storeShare(tx *sql.Tx, sh Share) error {
+	if err := sh.validate(); err != nil {
+		return err
+	}
+	user, group := strings.ToLower(sh.User), strings.ToLower(sh.Group)
+
+	ok, err := db.exists(tx, `SELECT COUNT(*) FROM decks WHERE ID = ?`, sh.DeckID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errorf(ErrInvalid, "db.Store(): share has no deck %d.", sh.DeckID)
+	}
+	if user != "" {
+		ok, err = db.exists(tx, `SELECT COUNT(*) FROM users WHERE Email = ?`, user)
+	} else {
+		ok, err = db.exists(tx, `SELECT COUNT(*) FROM user_groups WHERE Name = ?`, group)
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errorf(ErrInvalid, "db.Store(): deck %d can't be shared with unknown %q.", sh.DeckID, user+group)
+	}
+
+	cmd := `DELETE FROM deck_shares
+	        WHERE DeckID = ? AND (UserEmail = ? OR GroupName = ?)`
+	if _, err := tx.Exec(db.bind(cmd), sh.DeckID, user, group); err != nil {
+		return err
+	}
+	cmd = `
+    INSERT INTO deck_shares(
+        DeckID, UserEmail, GroupName, Access
+    ) values(?, NULLIF(?, ''), NULLIF(?, ''), ?)`
+	_, err = tx.Exec(db.bind(cmd), sh.DeckID, user, group, sh.Access)
+	return err
+}
+
+// sharedDecks selects the ids of the decks shared with a user, directly or
+// through a group they're in, with the access each share gives.  It takes
+// the user's email twice.
+const sharedDecks = `
+    SELECT s.DeckID, s.Access FROM deck_shares s
+    WHERE s.UserEmail = ? OR s.GroupName IN (
+        SELECT GroupName FROM group_members WHERE Email = ?)`
+
+// visible returns the clause that limits the decks aliased d to those user
+// owns or has been shared, and its arguments.
+func visible(user string) (string, []interface{}) {
+	clause := ` AND (d.OwnerEmail = ? OR d.ID IN (
+	                SELECT DeckID FROM (` + sharedDecks + `) shared))`
+	return clause, []interface{}{user, user, user}
+}
+
+// access returns the most user can do with each deck shared with them.
+func (db *DB) access(user string) (map[int]string, error) {
+	rows, err := db.Query(db.bind(sharedDecks), user, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	access := map[int]string{}
+	for rows.Next() {
+		var id int
+		var a string
+		if err := rows.Scan(&id, &a); err != nil {
+			return nil, err
+		}
+		if access[id] != AccessEdit {
+			access[id] = a
+		}
+	}
+	return access, rows.Err()
+}
+
+// cardDeck returns the ID of the deck c belongs to, named either by its
+// DeckID or by its legacy 'email:deck' Owner.  Deck IDs that have already
+// been looked up are kept in ids, keyed by owner.
+func (db *DB) cardDeck(tx *sql.Tx, c Card, ids map[string]int) (int, error) {
+	var n int
+	if c.DeckID != 0 {
+		cmd := `SELECT COUNT(*) FROM decks WHERE ID = ?`
+		if err := tx.QueryRow(db.bind(cmd), c.DeckID).Scan(&n); err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, errorf(ErrInvalid, "db.Store(): card %q has no deck %d.", c.Front, c.DeckID)
+		}
+		return c.DeckID, nil
+	}
+
+	owner := strings.ToLower(c.Owner)
+	if id, ok := ids[owner]; ok {
+		return id, nil
+	}
+	email, name, ok := splitOwner(owner)
+	if !ok {
+		return 0, errorf(ErrInvalid, "db.Store(): card %q has no deck.", c.Front)
+	}
+	cmd := `SELECT ID FROM decks WHERE OwnerEmail = ? AND Name = ?`
+	err := tx.QueryRow(db.bind(cmd), email, name).Scan(&n)
+	if err == sql.ErrNoRows {
+		return 0, errorf(ErrInvalid, "db.Store(): card %q has no deck %q.", c.Front, c.Owner)
+	}
+	if err != nil {
+		return 0, err
+	}
+	ids[owner] = n
+	return n, nil
+}
+
+// Review grades the card named by r and stores its new schedule.  It returns
+// ErrNotFound if there is no such card.
+func (db *DB) Review(r ReviewOp) (Card, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return Card{}, err
+	}
+	defer tx.Rollback()
+
+	c := Card{ID: r.CardID}
+	var email, name, sched, params string
+	cmd := `SELECT c.DeckID, d.OwnerEmail, d.Name, c.Front, c.Back,
+	               c.Due, c.Ease, c."Interval", c.Reps,
+	               c.Stability, c.Difficulty, c.Box,
+	               d.Scheduler, d.Params
+	        FROM cards c JOIN decks d ON d.ID = c.DeckID
+	        WHERE c.ID = ?`
+	err = tx.QueryRow(db.bind(cmd), r.CardID).Scan(&c.DeckID, &email, &name,
+		&c.Front, &c.Back, &c.Due, &c.Ease, &c.Interval, &c.Reps,
+		&c.Stability, &c.Difficulty, &c.Box, &sched, &params)
+	if err == sql.ErrNoRows {
+		return Card{}, ErrNotFound
+	}
+	if err != nil {
+		return Card{}, err
+	}
+	// Other users' cards may as well not exist, unless they're shared.
+	if user := strings.ToLower(r.User); user != "" && user != email {
+		q := `SELECT COUNT(*) FROM (` + sharedDecks + `) shared WHERE DeckID = ?`
+		ok, err := db.exists(tx, q, user, user, c.DeckID)
+		if err != nil {
+			return Card{}, err
+		}
+		if !ok {
+			return Card{}, ErrNotFound
+		}
+	}
+	c.Owner = email + ":" + name
+
+	s, err := NewScheduler(sched, json.RawMessage(params))
+	if err != nil {
+		return Card{}, err
+	}
+
+	prev := c.Interval
+	c = s.Schedule(c, r.Grade, r.At)
+	c.Due = dbTime(c.Due)
+
+	cmd = `UPDATE cards
+	       SET Due = ?, Ease = ?, "Interval" = ?, Reps = ?,
+	           Stability = ?, Difficulty = ?, Box = ?
+	       WHERE ID = ?`
+	_, err = tx.Exec(db.bind(cmd), c.Due, c.Ease, c.Interval, c.Reps,
+		c.Stability, c.Difficulty, c.Box, c.ID)
+	if err != nil {
+		return Card{}, err
+	}
+
+	err = db.insertReview(tx, Review{
+		CardID:       c.ID,
+		User:         r.User,
+		Grade:        r.Grade,
+		At:           r.At,
+		PrevInterval: prev,
+		NextInterval: c.Interval,
+		ResponseMS:   int(r.ResponseTime / time.Millisecond),
+	})
+	if err != nil {
+		return Card{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Card{}, err
+	}
+	return c, nil
+}
+
+// insertReview appends r to the review log.
+func (db *DB) insertReview(tx *sql.Tx, r Review) error {
+	cmd := `
+    INSERT INTO reviews(
+        CardID, "User", Grade, ReviewedAt, PrevInterval, NextInterval, ResponseMS
+    ) values(?, ?, ?, ?, ?, ?, ?)`
+	_, err := tx.Exec(db.bind(cmd), r.CardID, strings.ToLower(r.User), r.Grade,
+		dbTime(r.At), r.PrevInterval, r.NextInterval, r.ResponseMS)
 	return err
 }
 
+// Credentials returns the password hash of the user with the given email, or
+// ErrNotFound if there's no such user.
+func (db *DB) Credentials(email string) (string, error) {
+	var hash string
+	cmd := `SELECT COALESCE(Password, '') FROM users WHERE Email = ?`
+	err := db.QueryRow(db.bind(cmd), strings.ToLower(email)).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return hash, err
+}
+
+// Role returns the role of the user with the given email, or ErrNotFound if
+// there's no such user.
+func (db *DB) Role(email string) (string, error) {
+	var role string
+	cmd := `SELECT Role FROM users WHERE Email = ?`
+	err := db.QueryRow(db.bind(cmd), strings.ToLower(email)).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return role, err
+}
+
+// SetCredentials replaces the password hash of the user with the given email,
+// or returns ErrNotFound if there's no such user.
+func (db *DB) SetCredentials(email, hash string) error {
+	cmd := `UPDATE users SET Password = ? WHERE Email = ?`
+	res, err := db.Exec(db.bind(cmd), hash, strings.ToLower(email))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CreateDeck stores d, a deck its owner doesn't have yet, and returns it as
+// stored, or returns ErrConflict if its owner already has a deck with its
+// name.
+func (db *DB) CreateDeck(d Deck) (Deck, error) {
+	d = d.Normalize()
+	if _, err := NewScheduler(d.Scheduler, d.Params); err != nil {
+		return Deck{}, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return Deck{}, err
+	}
+	defer tx.Rollback()
+
+	ok, err := db.exists(tx, `SELECT COUNT(*) FROM users WHERE Email = ?`, d.Owner)
+	if err != nil {
+		return Deck{}, err
+	}
+	if !ok {
+		return Deck{}, errorf(ErrInvalid, "db.CreateDeck(): deck %q has no owner %q.", d.Name, d.Owner)
+	}
+	cmd := `
+    INSERT INTO decks(
+        OwnerEmail, Name, "Desc", Scheduler, Params, InsertedDatetime
+    ) values(?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+    ON CONFLICT(OwnerEmail, Name) DO NOTHING
+    RETURNING ID`
+	err = tx.QueryRow(db.bind(cmd), d.Owner, d.Name, d.Desc,
+		d.Scheduler, string(d.Params)).Scan(&d.ID)
+	if err == sql.ErrNoRows {
+		return Deck{}, errorf(ErrConflict, "db.CreateDeck(): %q already has a deck %q.", d.Owner, d.Name)
+	}
+	if err != nil {
+		return Deck{}, err
+	}
+	return d, tx.Commit()
+}
+
+// CreateUser stores u, a user who doesn't exist yet, with their password
+// hash, or returns ErrConflict if the email is taken.  Users created without a
+// role are editors.
+func (db *DB) CreateUser(u User) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+	if u.Role == "" {
+		u.Role = RoleEditor
+	}
+	cmd := `
+    INSERT INTO users(
+        Email, Name, Password, Role, InsertedDatetime
+    ) values(?, ?, ?, ?, CURRENT_TIMESTAMP)
+    ON CONFLICT(Email) DO NOTHING`
+	e := strings.ToLower(u.Email)
+	res, err := db.Exec(db.bind(cmd), e, u.Name, u.Password, u.Role)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errorf(ErrConflict, "db.CreateUser(): %q already exists.", e)
+	}
+	return nil
+}
+
+// APIKey returns the unrevoked API key with the given hash, or ErrNotFound if
+// there isn't one.
+func (db *DB) APIKey(hash string) (APIKey, error) {
+	k := APIKey{Hash: hash}
+	cmd := `SELECT ID, Name, Owner, Scope, InsertedDatetime FROM api_keys
+	        WHERE Hash = ? AND RevokedDatetime IS NULL`
+	err := db.QueryRow(db.bind(cmd), hash).Scan(&k.ID, &k.Name, &k.Owner,
+		&k.Scope, &k.Created)
+	if err == sql.ErrNoRows {
+		return APIKey{}, ErrNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	return k, nil
+}
+
+// RevokeAPIKey revokes the API key with the given id, or returns ErrNotFound
+// if there's no such key.  Revoking a key again changes nothing.
+func (db *DB) RevokeAPIKey(id int) error {
+	cmd := `UPDATE api_keys SET RevokedDatetime = COALESCE(RevokedDatetime, ?)
+	        WHERE ID = ?`
+	res, err := db.Exec(db.bind(cmd), dbTime(time.Now()), id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
 // List retrieves ListStorers from the db as specified by a ListOp.
 func (db *DB) List(l ListOp) (ListStorer, error) {
+	ls := emptyList(l.What)
+	err := db.Stream(l, func(v interface{}) error {
+		ls = appendTo(ls, v)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// Stream calls fn with each result that List would return for l, in turn,
+// as it reads them from the db, and stops at the first error fn returns.
+func (db *DB) Stream(l ListOp, fn func(interface{}) error) error {
+	// Emails and deck names are stored in lower case.
+	l.Query = strings.ToLower(l.Query)
 	if strings.HasSuffix(l.Query, "*") {
 		l.Query = strings.TrimRight(l.Query, "*")
 		l.Query += "%"
 	}
 
+	// scope is the clause that limits results to what l.User owns.
+	user := strings.ToLower(l.User)
+	scope := func(col string) string {
+		if user == "" {
+			return ""
+		}
+		return " AND " + col + " = ?"
+	}
+	args := []interface{}{l.Query}
+	if user != "" {
+		args = append(args, user)
+	}
+	key, err := cursorKey(l)
+	if err != nil {
+		return err
+	}
+	f, err := listFilter(l, time.Now())
+	if err != nil {
+		return err
+	}
+
 	switch l.What {
 	case "users":
-		cmd := `SELECT Email, Name, Password FROM users
-                WHERE Email LIKE ?
-                ORDER BY Email ASC`
+		cmd := `SELECT Email, Name, Role FROM users
+                WHERE Email LIKE ?` + scope("Email")
+		email := db.collate("Email")
+		cmd, args := afterKey(cmd, args, key, email)
+		cmd += ` ORDER BY ` + email + ` ASC`
 
-		rows, err := db.Query(cmd, l.Query)
+		rows, err := db.Query(db.bind(cmd+limit(l)), args...)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		defer rows.Close()
 
-		var result UserList
 		for rows.Next() {
 			user := User{}
-			err := rows.Scan(&user.Email, &user.Name, &user.Password)
+			err := rows.Scan(&user.Email, &user.Name, &user.Role)
 			if err != nil {
-				return nil, err
+				return err
+			}
+			if err := fn(user); err != nil {
+				return err
 			}
-			result = append(result, user)
 		}
-		return result, nil
+		return rows.Err()
 	case "decks":
-		cmd := `SELECT Name, Desc FROM decks
-		        WHERE Name LIKE ?
-		        ORDER BY Name ASC`
+		cmd := `SELECT d.ID, d.OwnerEmail, d.Name, d."Desc", d.Scheduler, d.Params
+		        FROM decks d
+		        WHERE d.OwnerEmail || ':' || d.Name LIKE ?`
+		args := []interface{}{l.Query}
+		access := map[int]string{}
+		if user != "" {
+			clause, vargs := visible(user)
+			cmd += clause
+			args = append(args, vargs...)
+			var err error
+			if access, err = db.access(user); err != nil {
+				return err
+			}
+		}
+		if l.ID != 0 {
+			cmd += ` AND d.ID = ?`
+			args = append(args, l.ID)
+		}
+		owner, name := db.collate("d.OwnerEmail"), db.collate("d.Name")
+		cmd, args = afterKey(cmd, args, key, owner, name)
+		cmd += ` ORDER BY ` + owner + ` ASC, ` + name + ` ASC`
 
-		rows, err := db.Query(cmd, l.Query)
+		rows, err := db.Query(db.bind(cmd+limit(l)), args...)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		defer rows.Close()
 
-		var result DeckList
 		for rows.Next() {
 			deck := Deck{}
-			err := rows.Scan(&deck.Name, &deck.Desc)
+			var params string
+			err := rows.Scan(&deck.ID, &deck.Owner, &deck.Name, &deck.Desc,
+				&deck.Scheduler, &params)
 			if err != nil {
-				return nil, err
+				return err
+			}
+			if params != "" {
+				deck.Params = json.RawMessage(params)
+			}
+			if deck.Owner != user {
+				deck.Access = access[deck.ID]
+			}
+			if err := fn(deck); err != nil {
+				return err
 			}
-			result = append(result, deck)
 		}
-		return result, nil
+		return rows.Err()
 	case "cards":
-		cmd := `SELECT ID, Owner, Front, Back FROM cards
-		        WHERE Owner LIKE ?
-		        ORDER BY Owner ASC`
+		cmd := `SELECT c.ID, c.DeckID, d.OwnerEmail || ':' || d.Name,
+		               c.Front, c.Back, ` + db.tagsCol() + `,
+		               c.Due, c.Ease, c."Interval", c.Reps,
+		               c.Stability, c.Difficulty, c.Box
+		        FROM cards c JOIN decks d ON d.ID = c.DeckID
+		        WHERE d.OwnerEmail || ':' || d.Name LIKE ?`
+		args := []interface{}{l.Query}
+		if user != "" {
+			clause, vargs := visible(user)
+			cmd += clause
+			args = append(args, vargs...)
+		}
+		if l.ID != 0 {
+			cmd += ` AND c.ID = ?`
+			args = append(args, l.ID)
+		}
+		if f != nil {
+			var where string
+			where, args = f.where(args)
+			cmd += ` AND ` + where
+		}
+		if l.Due.IsZero() {
+			owner, name := db.collate("d.OwnerEmail"), db.collate("d.Name")
+			cmd, args = afterKey(cmd, args, key, owner, name, "c.ID")
+			cmd += ` ORDER BY ` + owner + ` ASC, ` + name + ` ASC, c.ID ASC`
+		} else {
+			cmd += ` AND c.Due <= ?`
+			args = append(args, dbTime(l.Due))
+			cmd, args = afterKey(cmd, args, key, "c.Due", "c.ID")
+			cmd += ` ORDER BY c.Due ASC, c.ID ASC`
+		}
 
-		rows, err := db.Query(cmd, l.Query)
+		rows, err := db.Query(db.bind(cmd+limit(l)), args...)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		defer rows.Close()
 
-		var result CardList
 		for rows.Next() {
 			card := Card{}
-			err := rows.Scan(&card.ID, &card.Owner, &card.Front, &card.Back)
+			var tags sql.NullString
+			err := rows.Scan(&card.ID, &card.DeckID, &card.Owner,
+				&card.Front, &card.Back, &tags,
+				&card.Due, &card.Ease, &card.Interval, &card.Reps,
+				&card.Stability, &card.Difficulty, &card.Box)
+			if err != nil {
+				return err
+			}
+			card.Tags = splitTags(tags)
+			if err := fn(card); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	case "search":
+		where := `d.OwnerEmail || ':' || d.Name LIKE ?`
+		args := []interface{}{l.Query}
+		if user != "" {
+			clause, vargs := visible(user)
+			where += clause
+			args = append(args, vargs...)
+		}
+		if l.ID != 0 {
+			where += ` AND c.ID = ?`
+			args = append(args, l.ID)
+		}
+		if f != nil {
+			var fwhere string
+			fwhere, args = f.where(args)
+			where += ` AND ` + fwhere
+		}
+		return db.search(l, where, args, fn)
+	case "reviews":
+		cmd := `SELECT ID, CardID, "User", Grade, ReviewedAt,
+		               PrevInterval, NextInterval, ResponseMS
+		        FROM reviews
+		        WHERE "User" LIKE ?` + scope(`"User"`)
+		cmd, args := afterKey(cmd, args, key, "ReviewedAt", "ID")
+		cmd += ` ORDER BY ReviewedAt ASC, ID ASC`
+
+		rows, err := db.Query(db.bind(cmd+limit(l)), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			r := Review{}
+			err := rows.Scan(&r.ID, &r.CardID, &r.User, &r.Grade, &r.At,
+				&r.PrevInterval, &r.NextInterval, &r.ResponseMS)
+			if err != nil {
+				return err
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	case "keys":
+		cmd := `SELECT ID, Name, Owner, Scope, InsertedDatetime, RevokedDatetime
+		        FROM api_keys
+		        WHERE Owner LIKE ?` + scope("Owner")
+		cmd, args := afterKey(cmd, args, key, "ID")
+		cmd += ` ORDER BY ID ASC`
+
+		rows, err := db.Query(db.bind(cmd+limit(l)), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			k := APIKey{}
+			var revoked sql.NullTime
+			err := rows.Scan(&k.ID, &k.Name, &k.Owner, &k.Scope, &k.Created, &revoked)
 			if err != nil {
-				return nil, err
+				return err
+			}
+			if revoked.Valid {
+				k.Revoked = &revoked.Time
+			}
+			if err := fn(k); err != nil {
+				return err
 			}
-			result = append(result, card)
 		}
-		return result, nil
+		return rows.Err()
+	case "groups":
+		cmd := `SELECT Name, Owner FROM user_groups
+		        WHERE Name LIKE ?`
+		if user != "" {
+			cmd += ` AND (Owner = ? OR Name IN (
+			            SELECT GroupName FROM group_members WHERE Email = ?))`
+			args = append(args, user)
+		}
+		name := db.collate("Name")
+		cmd, args = afterKey(cmd, args, key, name)
+		cmd += ` ORDER BY ` + name + ` ASC`
+
+		rows, err := db.Query(db.bind(cmd+limit(l)), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		var result GroupList
+		for rows.Next() {
+			g := Group{}
+			if err := rows.Scan(&g.Name, &g.Owner); err != nil {
+				return err
+			}
+			result = append(result, g)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		rows.Close()
+
+		cmd = `SELECT Email FROM group_members WHERE GroupName = ?
+		       ORDER BY ` + db.collate("Email") + ` ASC`
+		// Groups are few, so they're all read before their members, which
+		// can't be queried while rows is still open.
+		for i, g := range result {
+			members, err := db.Query(db.bind(cmd), g.Name)
+			if err != nil {
+				return err
+			}
+			for members.Next() {
+				var e string
+				if err := members.Scan(&e); err != nil {
+					members.Close()
+					return err
+				}
+				result[i].Members = append(result[i].Members, e)
+			}
+			err = members.Err()
+			members.Close()
+			if err != nil {
+				return err
+			}
+		}
+		for _, g := range result {
+			if err := fn(g); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "shares":
+		cmd := `SELECT s.DeckID, COALESCE(s.UserEmail, ''), COALESCE(s.GroupName, ''),
+		               s.Access
+		        FROM deck_shares s JOIN decks d ON d.ID = s.DeckID
+		        WHERE d.OwnerEmail || ':' || d.Name LIKE ?` + scope("d.OwnerEmail")
+		email := db.collate("COALESCE(s.UserEmail, '')")
+		group := db.collate("COALESCE(s.GroupName, '')")
+		cmd, args := afterKey(cmd, args, key, "s.DeckID", email, group)
+		cmd += ` ORDER BY s.DeckID ASC, ` + email + ` ASC, ` + group + ` ASC`
+
+		rows, err := db.Query(db.bind(cmd+limit(l)), args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			sh := Share{}
+			err := rows.Scan(&sh.DeckID, &sh.User, &sh.Group, &sh.Access)
+			if err != nil {
+				return err
+			}
+			if err := fn(sh); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
 	}
 
-	return nil, errors.New("db.List(): unknown type passed in: " + l.What)
+	return errorf(ErrInvalid, "db.List(): unknown type passed in: %s", l.What)
+}
+
+// tagsCol returns the column of the tags of cards aliased c, joined by commas
+// in no particular order, or NULL for cards without any.
+func (db *DB) tagsCol() string {
+	agg := "group_concat(t.Tag, ',')"
+	if db.postgres {
+		agg = "string_agg(t.Tag, ',')"
+	}
+	return `(SELECT ` + agg + ` FROM card_tags t WHERE t.CardID = c.ID)`
+}
+
+// collate returns the text column col, compared byte by byte as SQLite and
+// Mem compare text.  PostgreSQL compares text by the database's locale,
+// which would list things in a different order, and so read cursors
+// differently, than the other backends.
+func (db *DB) collate(col string) string {
+	if !db.postgres {
+		return col
+	}
+	return col + ` COLLATE "C"`
+}
+
+// splitTags splits the tags read from tagsCol, and puts them in order.
+func splitTags(s sql.NullString) []string {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	tags := strings.Split(s.String, ",")
+	sort.Strings(tags)
+	return tags
+}
+
+// setTags replaces the tags of the card with id.
+func (db *DB) setTags(tx *sql.Tx, id int, tags []string) error {
+	if _, err := tx.Exec(db.bind(`DELETE FROM card_tags WHERE CardID = ?`), id); err != nil {
+		return err
+	}
+	cmd := `INSERT INTO card_tags(CardID, Tag) VALUES(?, ?)`
+	for _, t := range tags {
+		if _, err := tx.Exec(db.bind(cmd), id, t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// limit returns the LIMIT clause for l, if it has one.
+func limit(l ListOp) string {
+	if l.Limit <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" LIMIT %d", l.Limit)
 }
@@ -0,0 +1,8 @@
+//go:build cgo
+// +build cgo
+
+package db
+
+// The SQLite driver needs cgo.  Without it, DB can't be used, but Mem and
+// Postgres still can.
+import _ "github.com/mattn/go-sqlite3"
@@ -1,34 +1,286 @@
 package db
 
-import "io"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The errors a DataSource returns can be told apart with errors.Is:
+// ErrNotFound when an operation names a row that doesn't exist, ErrConflict
+// when it would clash with one that does, and ErrInvalid when its input
+// doesn't make sense.
+var (
+	ErrNotFound = errors.New("db: not found")
+	ErrConflict = errors.New("db: conflict")
+	ErrInvalid  = errors.New("db: invalid")
+)
+
+// kindError is an error that errors.Is matches to its kind, one of the errors
+// above, while keeping its own message.
+type kindError struct {
+	kind error
+	msg  string
+}
+
+func (e *kindError) Error() string { return e.msg }
+func (e *kindError) Unwrap() error { return e.kind }
+
+// errorf returns an error of the given kind, formatted as fmt.Sprintf does.
+func errorf(kind error, format string, args ...interface{}) error {
+	return &kindError{kind, fmt.Sprintf(format, args...)}
+}
 
 // User stores information about a user including hashed password,
 // an email address (which acts as an unique id), and a display name.
+//
+// Password is only used to Store users, and a user stored without one keeps
+// the password they had.  Listed users never have one; the hash is only
+// available to authentication, through Credentials.
+//
+// Role is one of RoleAdmin, RoleEditor or RoleLearner.  Users are stored as
+// editors unless given a role, and a user stored again without one keeps the
+// role they had.
 type User struct {
 	Email    string `json:"email"`
 	Name     string `json:"name"`
-	Password string `json:"password"`
+	Password string `json:"password,omitempty"`
+	Role     string `json:"role,omitempty"`
 }
 
-// Decks belong to a User.  The first part of their name specifies a owner.
-// So a the name of a deck called 'math' belonging to 'carter@carter.com' would
-// be stored as 'carter@carter.com:math'.  'Name' must be unique.
+// User roles.  Admins can do anything.  Editors can make decks and cards of
+// their own, and edit the decks shared with them to edit.  Learners can only
+// study their own decks and the decks shared with them.
+const (
+	RoleAdmin   = "admin"
+	RoleEditor  = "editor"
+	RoleLearner = "learner"
+)
+
+func (u User) validate() error {
+	switch u.Role {
+	case "", RoleAdmin, RoleEditor, RoleLearner:
+		return nil
+	}
+	return errorf(ErrInvalid, "db.Store(): user %q has bad role %q.", u.Email, u.Role)
+}
+
+// Decks belong to a User, whose email is the deck's Owner.  A deck's Name must
+// be unique among its owner's decks.  Decks stored without an Owner may name
+// it as the first part of their name instead, so a deck called 'math'
+// belonging to 'carter@carter.com' can also be stored as
+// 'carter@carter.com:math'.
+//
+// Scheduler names the Scheduler used for the deck's cards, configured by the
+// JSON object in Params.  See NewScheduler.
+//
+// Access is only set on decks listed for a user they've been shared with,
+// and is the most the user can do with the deck: AccessRead or AccessEdit.
 type Deck struct {
-	Name string `json:"name"`
-	Desc string `json:"desc,omitempty"`
+	ID    int    `json:"id,omitempty"`
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+	Desc  string `json:"desc,omitempty"`
+
+	Scheduler string          `json:"scheduler,omitempty"`
+	Params    json.RawMessage `json:"params,omitempty"`
+
+	Access string `json:"access,omitempty"`
 }
 
 // A Deck can have many flashcards.  There is no checking that a card is unique.
+//
+// Cards belong to the deck with id DeckID.  Cards stored without a DeckID may
+// name their deck in Owner as 'email:deck' instead, which is how Owner is
+// always listed.
+//
+// Tags are words, such as "verbs", that cards can be filtered by (see
+// ListOp).  They're stored in lower case, and listed in order.
+//
+// Due, Ease, Interval and Reps hold a card's review schedule.  Interval is
+// measured in days and Reps counts successful reviews in a row.  A card stored
+// with a zero Due is due straight away.  Stability and Difficulty are only
+// used by the FSRS scheduler, and Box by the Leitner scheduler.
 type Card struct {
-	ID    int    `json:"id,omitempty"`
-	Owner string `json:"owner"`
-	Front string `json:"front"`
-	Back  string `json:"back"`
+	ID     int    `json:"id,omitempty"`
+	DeckID int    `json:"deck_id,omitempty"`
+	Owner  string `json:"owner"`
+	Front  string `json:"front"`
+	Back   string `json:"back"`
+
+	Tags []string `json:"tags,omitempty"`
+
+	Due      time.Time `json:"due"`
+	Ease     float64   `json:"ease"`
+	Interval int       `json:"interval"`
+	Reps     int       `json:"reps"`
+
+	Stability  float64 `json:"stability,omitempty"`
+	Difficulty float64 `json:"difficulty,omitempty"`
+	Box        int     `json:"box,omitempty"`
+}
+
+// A Hit is a Card that a search found.  Rank says how well it matched, higher
+// being better, and Snippet is the few words of its front or back around the
+// match, with the words searched for set off by "**".
+type Hit struct {
+	Card
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
+}
+
+// normalTags returns c's tags in lower case, in order and without
+// duplicates.  Tags are made of letters, digits and "-_.:/".
+func (c Card) normalTags() ([]string, error) {
+	var tags []string
+	seen := map[string]bool{}
+	for _, t := range c.Tags {
+		t = strings.ToLower(t)
+		if !validTag(t) {
+			return nil, errorf(ErrInvalid, "db.Store(): card %d has bad tag %q.", c.ID, t)
+		}
+		if !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+func validTag(t string) bool {
+	if t == "" {
+		return false
+	}
+	for _, r := range t {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-_.:/", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// A Review is one graded answer to a Card, as kept in the review log.
+// PrevInterval and NextInterval are the card's interval in days before and
+// after the review, and ResponseMS is how long the user took to answer.
+type Review struct {
+	ID           int       `json:"id,omitempty"`
+	CardID       int       `json:"card"`
+	User         string    `json:"user"`
+	Grade        Grade     `json:"grade"`
+	At           time.Time `json:"at"`
+	PrevInterval int       `json:"prev_interval"`
+	NextInterval int       `json:"next_interval"`
+	ResponseMS   int       `json:"response_ms"`
+}
+
+// An APIKey lets a service act as its Owner without logging in.  Only a hash
+// of the key itself is ever stored.  Scope limits what the key can do: "read"
+// keys can only list what their owner can, "write" keys can also store and
+// review as their owner, and "admin" keys can do whatever an admin can.
+// Revoked keys are kept, with the time they were revoked, but can't be used.
+type APIKey struct {
+	ID      int        `json:"id,omitempty"`
+	Name    string     `json:"name"`
+	Owner   string     `json:"owner"`
+	Scope   string     `json:"scope"`
+	Created time.Time  `json:"created"`
+	Revoked *time.Time `json:"revoked,omitempty"`
+
+	Hash string `json:"-"`
+}
+
+// API key scopes.
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeAdmin = "admin"
+)
+
+func (k APIKey) validate() error {
+	switch k.Scope {
+	case ScopeRead, ScopeWrite, ScopeAdmin:
+	default:
+		return errorf(ErrInvalid, "db.Store(): key %q has bad scope %q.", k.Name, k.Scope)
+	}
+	if k.Hash == "" {
+		return errorf(ErrInvalid, "db.Store(): key %q has no hash.", k.Name)
+	}
+	return nil
+}
+
+// A Group is a named set of users that decks can be shared with.  Group names
+// are unique, and only a group's Owner can change who its Members are.
+// Storing a group replaces its members.
+type Group struct {
+	Name    string   `json:"name"`
+	Owner   string   `json:"owner"`
+	Members []string `json:"members"`
+}
+
+// A Share lets a User, or every member of a Group, use the deck with id
+// DeckID.  Exactly one of User and Group is set.  Access is AccessRead to
+// study the deck, or AccessEdit to also change its cards.  Storing a share
+// replaces any share of the same deck with the same user or group.
+type Share struct {
+	DeckID int    `json:"deck_id"`
+	User   string `json:"user,omitempty"`
+	Group  string `json:"group,omitempty"`
+	Access string `json:"access"`
+}
+
+// Deck share access levels.
+const (
+	AccessRead = "read"
+	AccessEdit = "edit"
+)
+
+func (s Share) validate() error {
+	if (s.User == "") == (s.Group == "") {
+		return errorf(ErrInvalid, "db.Store(): share of deck %d needs a user or a group, not both.", s.DeckID)
+	}
+	if s.Access != AccessRead && s.Access != AccessEdit {
+		return errorf(ErrInvalid, "db.Store(): share of deck %d has bad access %q.", s.DeckID, s.Access)
+	}
+	return nil
+}
+
+// Normalize returns d with its owner split from a legacy 'email:deck' name,
+// and its owner, name and scheduler in lower case.
+func (d Deck) Normalize() Deck {
+	if d.Owner == "" {
+		if email, name, ok := splitOwner(d.Name); ok {
+			d.Owner, d.Name = email, name
+		}
+	}
+	d.Owner = strings.ToLower(d.Owner)
+	d.Name = strings.ToLower(d.Name)
+	d.Scheduler = strings.ToLower(d.Scheduler)
+	return d
+}
+
+// splitOwner splits a legacy 'email:deck' owner into its two parts.
+func splitOwner(s string) (email, deck string, ok bool) {
+	i := strings.Index(s, ":")
+	if i < 1 || i == len(s)-1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
 }
 
 type CardList []Card
 type DeckList []Deck
 type UserList []User
+type ReviewList []Review
+type APIKeyList []APIKey
+type GroupList []Group
+type ShareList []Share
+type HitList []Hit
 
 func (dl DeckList) List(ds DataSource, l ListOp) error {
 	return nil
@@ -48,9 +300,170 @@ func (cl CardList) List(ds DataSource, l ListOp) error {
 func (cl CardList) Store(ds DataSource, r io.Reader, s string) error {
 	return nil
 }
+func (rl ReviewList) List(ds DataSource, l ListOp) error {
+	return nil
+}
+func (rl ReviewList) Store(ds DataSource, r io.Reader, s string) error {
+	return nil
+}
+func (kl APIKeyList) List(ds DataSource, l ListOp) error {
+	return nil
+}
+func (kl APIKeyList) Store(ds DataSource, r io.Reader, s string) error {
+	return nil
+}
+func (gl GroupList) List(ds DataSource, l ListOp) error {
+	return nil
+}
+func (gl GroupList) Store(ds DataSource, r io.Reader, s string) error {
+	return nil
+}
+func (sl ShareList) List(ds DataSource, l ListOp) error {
+	return nil
+}
+func (sl ShareList) Store(ds DataSource, r io.Reader, s string) error {
+	return nil
+}
+func (hl HitList) List(ds DataSource, l ListOp) error {
+	return nil
+}
+func (hl HitList) Store(ds DataSource, r io.Reader, s string) error {
+	return nil
+}
 
+// emptyList returns an empty list of the kind of results that List returns
+// for what, or nil if there's no such kind.
+func emptyList(what string) ListStorer {
+	switch what {
+	case "users":
+		return UserList(nil)
+	case "decks":
+		return DeckList(nil)
+	case "cards":
+		return CardList(nil)
+	case "reviews":
+		return ReviewList(nil)
+	case "keys":
+		return APIKeyList(nil)
+	case "groups":
+		return GroupList(nil)
+	case "shares":
+		return ShareList(nil)
+	case "search":
+		return HitList(nil)
+	}
+	return nil
+}
+
+// appendTo appends v, one of the results that List returns, to ls, a list
+// of its kind.
+func appendTo(ls ListStorer, v interface{}) ListStorer {
+	switch v := v.(type) {
+	case User:
+		return append(ls.(UserList), v)
+	case Deck:
+		return append(ls.(DeckList), v)
+	case Card:
+		return append(ls.(CardList), v)
+	case Review:
+		return append(ls.(ReviewList), v)
+	case APIKey:
+		return append(ls.(APIKeyList), v)
+	case Group:
+		return append(ls.(GroupList), v)
+	case Share:
+		return append(ls.(ShareList), v)
+	case Hit:
+		return append(ls.(HitList), v)
+	}
+	return ls
+}
+
+// each calls fn with each of the results in ls, a list List returned, and
+// stops at the first error fn returns.
+func each(ls ListStorer, fn func(interface{}) error) error {
+	var err error
+	switch ls := ls.(type) {
+	case UserList:
+		for i := 0; i < len(ls) && err == nil; i++ {
+			err = fn(ls[i])
+		}
+	case DeckList:
+		for i := 0; i < len(ls) && err == nil; i++ {
+			err = fn(ls[i])
+		}
+	case CardList:
+		for i := 0; i < len(ls) && err == nil; i++ {
+			err = fn(ls[i])
+		}
+	case ReviewList:
+		for i := 0; i < len(ls) && err == nil; i++ {
+			err = fn(ls[i])
+		}
+	case APIKeyList:
+		for i := 0; i < len(ls) && err == nil; i++ {
+			err = fn(ls[i])
+		}
+	case GroupList:
+		for i := 0; i < len(ls) && err == nil; i++ {
+			err = fn(ls[i])
+		}
+	case ShareList:
+		for i := 0; i < len(ls) && err == nil; i++ {
+			err = fn(ls[i])
+		}
+	case HitList:
+		for i := 0; i < len(ls) && err == nil; i++ {
+			err = fn(ls[i])
+		}
+	}
+	return err
+}
+
+// ListOp describes what to List.  Query matches a user's email, a deck's or
+// card's 'email:deck' owner, a review's user, an API key's owner, a group's
+// name, or the 'email:deck' name of a shared deck, either exactly or, when it
+// ends in '*', as a prefix.
+//
+// A non-empty User scopes the results to what that user can see: their own
+// user, reviews, API keys and the groups they own or are in, the decks and
+// cards they own or that have been shared with them, and the shares of their
+// own decks.  An empty User lists everything, as only admins should.
+//
+// For decks and cards, a non-zero ID limits the results to the one with that
+// id.  For cards, a non-zero Due limits the results to cards that are due at
+// or before Due, soonest first.  A positive Limit caps the number of results.
+//
+// A non-empty Cursor, as returned by Page, starts the results after the last
+// one of the page it was returned with.  Page through a list with the same
+// ListOp, but for its Cursor.
+//
+// For cards and searches, a non-empty Filter narrows the results further,
+// e.g. to "tag = verbs AND due < now+7d".  See filter.go for what filters
+// can say.
+//
+// What "search" lists the cards whose front or back has every word in Search,
+// as Hits, best first.  Query, User and Limit narrow a search as they do a
+// list of cards, but searches can't be paged with a Cursor.
 type ListOp struct {
 	What, User, Query string
+	Search, Filter    string
+
+	ID     int
+	Due    time.Time
+	Limit  int
+	Cursor string
+}
+
+// ReviewOp records User's answer to the card with id CardID, graded Grade and
+// given at time At after thinking for ResponseTime.  A non-empty User can only
+// review cards in their own decks, or in decks shared with them.
+type ReviewOp struct {
+	CardID       int
+	User         string
+	Grade        Grade
+	At           time.Time
+	ResponseTime time.Duration
 }
 
 // ListStorers now how to read from and write to a DataSource.
@@ -68,4 +481,62 @@ type DataSource interface {
 
 	List(ListOp) (ListStorer, error)
 	Store(ls ListStorer) error
+
+	// Stream calls fn with each of the results that List would return for
+	// l, as a User, Deck, Card and so on, and stops at the first error fn
+	// returns.  SQL DataSources read results as fn takes them, so that
+	// long lists needn't be held in memory.
+	Stream(l ListOp, fn func(interface{}) error) error
+
+	// Update changes the users, decks or cards in ls, named by their email
+	// or ID, and returns ErrNotFound if any of them don't exist.  Users keep
+	// their password, and their role unless given one.  Decks keep their
+	// owner.  Cards keep their schedule, and their deck unless given a
+	// DeckID, but have their tags replaced.  Nothing is updated unless
+	// everything can be.
+	Update(ls ListStorer) error
+
+	// Delete deletes the users, decks, cards, groups or shares in ls, named
+	// by their email, ID or name, or for shares by their deck and user or
+	// group, and returns ErrNotFound if any of them don't exist.  Deleting a
+	// user deletes everything they own, and deleting a deck deletes its
+	// cards and shares; the review log is kept.  Nothing is deleted unless
+	// everything can be.
+	Delete(ls ListStorer) error
+
+	// Review reschedules a card for a graded answer, appends the answer to
+	// the review log, and returns the card with its new schedule.
+	Review(ReviewOp) (Card, error)
+
+	// Credentials returns the password hash of the user with the given
+	// email, or ErrNotFound if there's no such user.
+	Credentials(email string) (string, error)
+
+	// SetCredentials replaces the password hash of the user with the given
+	// email, or returns ErrNotFound if there's no such user.
+	SetCredentials(email, hash string) error
+
+	// CreateUser stores u, a user who doesn't exist yet, with their
+	// password hash, or returns ErrConflict if the email is taken.  Unlike
+	// Store, it never changes a user that's already there.
+	CreateUser(u User) error
+
+	// CreateDeck stores d, a deck its owner doesn't have yet, and returns
+	// it as stored, with its ID, or returns ErrConflict if its owner
+	// already has a deck with its name.  Unlike Store, it never changes a
+	// deck that's already there.
+	CreateDeck(d Deck) (Deck, error)
+
+	// Role returns the role of the user with the given email, or
+	// ErrNotFound if there's no such user.
+	Role(email string) (string, error)
+
+	// APIKey returns the unrevoked API key with the given hash, or
+	// ErrNotFound if there isn't one.  Keys are stored as APIKeyLists and
+	// listed as "keys".
+	APIKey(hash string) (APIKey, error)
+
+	// RevokeAPIKey revokes the API key with the given id, or returns
+	// ErrNotFound if there's no such key.
+	RevokeAPIKey(id int) error
 }